@@ -0,0 +1,170 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+
+	"github.com/disintegration/imaging"
+)
+
+// pngHeader is the signature at the start of every PNG file.
+const pngHeader = "\x89PNG\r\n\x1a\n"
+
+// encodeAPNG writes the animated GIF g to w as an animated PNG, applying
+// transform to each frame.  As with gifresize, each frame is first drawn on
+// top of the previous frames, so that the transformed frames are complete
+// images.  Frame timing and loop count are preserved.
+func encodeAPNG(w io.Writer, g *gif.GIF, transform func(image.Image) image.Image) error {
+	if len(g.Image) == 0 {
+		return errors.New("gif has no frames")
+	}
+
+	// canvas holds the frames drawn so far
+	first := g.Image[0].Bounds()
+	canvas := image.NewNRGBA(image.Rect(0, 0, first.Dx(), first.Dy()))
+	if g.Config.Width > 0 && g.Config.Height > 0 {
+		canvas = image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	}
+
+	frames := make([]*image.NRGBA, len(g.Image))
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = imaging.Clone(canvas)
+		}
+
+		bounds := frame.Bounds()
+		draw.Draw(canvas, bounds, frame, bounds.Min, draw.Over)
+		frames[i] = imaging.Clone(transform(canvas))
+		if !frames[i].Bounds().Size().Eq(frames[0].Bounds().Size()) {
+			return errors.New("transformed frames have different sizes")
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, bounds, image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	// the number of times to play the animation, where zero is forever
+	var plays uint32
+	switch {
+	case g.LoopCount < 0:
+		plays = 1
+	case g.LoopCount > 0:
+		plays = uint32(g.LoopCount) + 1
+	}
+
+	size := frames[0].Bounds().Size()
+	e := &apngEncoder{w: w}
+	if _, e.err = io.WriteString(w, pngHeader); e.err != nil {
+		return e.err
+	}
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(size.X))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(size.Y))
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 6 // color type: truecolor with alpha
+	e.writeChunk("IHDR", ihdr)
+
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:4], uint32(len(frames)))
+	binary.BigEndian.PutUint32(actl[4:8], plays)
+	e.writeChunk("acTL", actl)
+
+	for i, frame := range frames {
+		var delay uint16
+		if i < len(g.Delay) {
+			delay = uint16(g.Delay[i])
+		}
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:4], e.nextSeq())
+		binary.BigEndian.PutUint32(fctl[4:8], uint32(size.X))
+		binary.BigEndian.PutUint32(fctl[8:12], uint32(size.Y))
+		// x and y offsets are zero, since frames cover the entire image
+		binary.BigEndian.PutUint16(fctl[20:22], delay)
+		binary.BigEndian.PutUint16(fctl[22:24], 100) // delays are in 100ths of a second
+		// dispose op none and blend op source, since frames are complete images
+		e.writeChunk("fcTL", fctl)
+
+		data, err := apngFrameData(frame)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			// the first frame is also the default image for non-animated decoders
+			e.writeChunk("IDAT", data)
+		} else {
+			seq := make([]byte, 4)
+			binary.BigEndian.PutUint32(seq, e.nextSeq())
+			e.writeChunk("fdAT", append(seq, data...))
+		}
+	}
+
+	e.writeChunk("IEND", nil)
+	return e.err
+}
+
+// apngEncoder writes PNG chunks, retaining the first error encountered.
+type apngEncoder struct {
+	w   io.Writer
+	seq uint32 // sequence number of animation chunks
+	err error
+}
+
+// nextSeq returns the sequence number for the next animation chunk.
+func (e *apngEncoder) nextSeq() uint32 {
+	seq := e.seq
+	e.seq++
+	return seq
+}
+
+// writeChunk writes a PNG chunk with the specified type and data.
+func (e *apngEncoder) writeChunk(name string, data []byte) {
+	if e.err != nil {
+		return
+	}
+	b := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(data)))
+	copy(b[4:8], name)
+	b = append(b, data...)
+	b = binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[4:]))
+	_, e.err = e.w.Write(b)
+}
+
+// apngFrameData returns the compressed image data for m, in the format of a
+// PNG IDAT chunk.  Scanlines are not filtered.
+func apngFrameData(m *image.NRGBA) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	zw := zlib.NewWriter(buf)
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		if _, err := zw.Write([]byte{0}); err != nil { // filter type none
+			return nil, err
+		}
+		if _, err := zw.Write(m.Pix[m.PixOffset(b.Min.X, y):m.PixOffset(b.Max.X, y)]); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
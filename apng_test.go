@@ -0,0 +1,155 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// pngChunk is a chunk read from an encoded PNG.
+type pngChunk struct {
+	name string
+	data []byte
+}
+
+// readPNGChunks returns the chunks in the encoded PNG b.
+func readPNGChunks(t *testing.T, b []byte) []pngChunk {
+	t.Helper()
+	if !bytes.HasPrefix(b, []byte(pngHeader)) {
+		t.Fatalf("missing PNG header")
+	}
+	b = b[len(pngHeader):]
+
+	var chunks []pngChunk
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated PNG chunk")
+		}
+		n := binary.BigEndian.Uint32(b[0:4])
+		c := pngChunk{name: string(b[4:8]), data: b[8 : 8+n]}
+		if got, want := binary.BigEndian.Uint32(b[8+n:12+n]), crc32.ChecksumIEEE(b[4:8+n]); got != want {
+			t.Errorf("chunk %s has crc %x, want %x", c.name, got, want)
+		}
+		chunks = append(chunks, c)
+		b = b[12+n:]
+	}
+	return chunks
+}
+
+// twoFrameGIF returns an encoded animated gif with a red frame followed by a
+// blue frame.
+func twoFrameGIF(t *testing.T) []byte {
+	t.Helper()
+	palette := color.Palette{red, blue}
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			image.NewPaletted(image.Rect(0, 0, 4, 4), palette),
+			image.NewPaletted(image.Rect(0, 0, 4, 4), palette),
+		},
+		Delay: []int{10, 20},
+	}
+	for i := range g.Image[1].Pix {
+		g.Image[1].Pix[i] = 1
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, g); err != nil {
+		t.Fatalf("error encoding gif: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestTransform_APNG(t *testing.T) {
+	b, err := Transform(twoFrameGIF(t), Options{Width: 2, Format: "png"})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+
+	// non-animated decoders should see the first frame
+	m, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("error decoding png: %v", err)
+	}
+	if got, want := m.Bounds(), image.Rect(0, 0, 2, 2); !got.Eq(want) {
+		t.Errorf("first frame has bounds %v, want %v", got, want)
+	}
+	if got := color.NRGBAModel.Convert(m.At(0, 0)); got != red {
+		t.Errorf("first frame has color %v, want %v", got, red)
+	}
+
+	var ihdr []byte
+	var actl []byte
+	var delays []uint16
+	var frames [][]byte // image data of each frame
+	for _, c := range readPNGChunks(t, b) {
+		switch c.name {
+		case "IHDR":
+			ihdr = c.data
+		case "acTL":
+			actl = c.data
+		case "fcTL":
+			delays = append(delays, binary.BigEndian.Uint16(c.data[20:22]))
+			if den := binary.BigEndian.Uint16(c.data[22:24]); den != 100 {
+				t.Errorf("fcTL has delay denominator %d, want 100", den)
+			}
+		case "IDAT":
+			frames = append(frames, c.data)
+		case "fdAT":
+			frames = append(frames, c.data[4:])
+		}
+	}
+
+	if actl == nil {
+		t.Fatalf("missing acTL chunk")
+	}
+	if got, want := binary.BigEndian.Uint32(actl[0:4]), uint32(2); got != want {
+		t.Errorf("acTL has %d frames, want %d", got, want)
+	}
+	if got, want := binary.BigEndian.Uint32(actl[4:8]), uint32(0); got != want {
+		t.Errorf("acTL has %d plays, want %d", got, want)
+	}
+	if len(delays) != 2 || delays[0] != 10 || delays[1] != 20 {
+		t.Errorf("frame delays are %v, want [10 20]", delays)
+	}
+
+	// decode the second frame as a standalone png
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames, want 2", len(frames))
+	}
+	buf := bytes.NewBufferString(pngHeader)
+	e := &apngEncoder{w: buf}
+	e.writeChunk("IHDR", ihdr)
+	e.writeChunk("IDAT", frames[1])
+	e.writeChunk("IEND", nil)
+	m, err = png.Decode(buf)
+	if err != nil {
+		t.Fatalf("error decoding second frame: %v", err)
+	}
+	if got := color.NRGBAModel.Convert(m.At(1, 1)); got != blue {
+		t.Errorf("second frame has color %v, want %v", got, blue)
+	}
+}
+
+func TestTransform_animatedGIFFlatten(t *testing.T) {
+	// formats that can't represent animation use the first frame
+	b, err := Transform(twoFrameGIF(t), Options{Format: "jpeg"})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+	m, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("error decoding jpeg: %v", err)
+	}
+	if r, g, b, _ := m.At(0, 0).RGBA(); r>>8 < 200 || g>>8 > 50 || b>>8 > 50 {
+		t.Errorf("jpeg has color %v, want red", m.At(0, 0))
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"image"
+	"math"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// number of horizontal and vertical components used in blurhash strings.
+const (
+	blurhashComponentsX = 4
+	blurhashComponentsY = 3
+)
+
+// maximum width and height images are downsampled to before calculating a
+// blurhash.  Blurhash only captures low frequency components, so there is
+// nothing to gain from analyzing full size images.
+const blurhashMaxSize = 32
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurhash returns the Blurhash string for m.
+// See https://github.com/woltapp/blurhash/blob/master/Algorithm.md
+func blurhash(m image.Image) string {
+	img := imaging.Fit(m, blurhashMaxSize, blurhashMaxSize, imaging.Box)
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+
+	// convert pixels to linear RGB once, rather than for each component
+	linear := make([][3]float64, w*h)
+	for y := range h {
+		for x := range w {
+			i := y*img.Stride + x*4
+			linear[y*w+x] = [3]float64{
+				sRGBToLinear(img.Pix[i]),
+				sRGBToLinear(img.Pix[i+1]),
+				sRGBToLinear(img.Pix[i+2]),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, blurhashComponentsX*blurhashComponentsY)
+	for j := range blurhashComponentsY {
+		for i := range blurhashComponentsX {
+			var f [3]float64
+			for y := range h {
+				for x := range w {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					for c := range 3 {
+						f[c] += basis * linear[y*w+x][c]
+					}
+				}
+			}
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			scale := norm / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(encodeBase83((blurhashComponentsX-1)+(blurhashComponentsY-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+
+	var maxAC float64
+	for _, f := range ac {
+		maxAC = max(maxAC, math.Abs(f[0]), math.Abs(f[1]), math.Abs(f[2]))
+	}
+	quantMax := int(max(0, min(82, math.Floor(maxAC*166-0.5))))
+	maxValue := float64(quantMax+1) / 166
+	b.WriteString(encodeBase83(quantMax, 1))
+
+	b.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+
+	for _, f := range ac {
+		var v int
+		for _, c := range f {
+			q := int(max(0, min(18, math.Floor(signPow(c/maxValue, 0.5)*9+9.5))))
+			v = v*19 + q
+		}
+		b.WriteString(encodeBase83(v, 2))
+	}
+
+	return b.String()
+}
+
+// encodeBase83 encodes n as a base83 string of the specified length.
+func encodeBase83(n, length int) string {
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = base83Chars[n%83]
+		n /= 83
+	}
+	return string(b)
+}
+
+func sRGBToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(f float64) int {
+	f = max(0, min(1, f))
+	if f <= 0.0031308 {
+		return int(f*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(f, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// signPow returns the absolute value of v raised to exp, with the sign of v.
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
@@ -0,0 +1,64 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBlurhash(t *testing.T) {
+	black := color.NRGBA{0, 0, 0, 255}
+	tests := []struct {
+		name string
+		src  image.Image
+		want string
+	}{
+		{"black", newImage(8, 8, black), "L00000fQfQfQfQfQfQfQfQfQfQfQ"},
+		{"red", newImage(8, 8, red), "LfTI:j|cfQ|c|csUfQsUfQfQfQfQ"},
+		{"red and blue", newImage(2, 1, red, blue), "L~LjfL|c|T|c|l|c|T|c|l|c|T|c"},
+
+		// large images are downsampled before calculating the hash,
+		// so this matches the hash of a 32x16 image.
+		{"large red", newImage(100, 50, red), "LKTI:j,YfQ,Y|co1fQo1fQfQfQfQ"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := blurhash(tt.src); got != tt.want {
+				t.Errorf("blurhash() returned %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxy_ServeHTTP_blurhash(t *testing.T) {
+	p := NewProxy(&testTransport{}, nil)
+	p.ContentTypes = []string{"image/*"}
+
+	req := httptest.NewRequest("GET", "/blurhash/http://good.test/png", nil)
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Errorf("ServeHTTP returned status %d, want %d", got, want)
+	}
+	if got, want := resp.Header().Get("Content-Type"), "text/plain"; got != want {
+		t.Errorf("ServeHTTP returned content type %q, want %q", got, want)
+	}
+	if got, want := resp.Body.String(), "L00000fQfQfQfQfQfQfQfQfQfQfQ"; got != want {
+		t.Errorf("ServeHTTP returned body %q, want %q", got, want)
+	}
+
+	// non-image responses can't be described
+	req = httptest.NewRequest("GET", "/blurhash/http://good.test/plain", nil)
+	resp = httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+	if resp.Code == http.StatusOK {
+		t.Errorf("ServeHTTP returned status %d for non-image response", resp.Code)
+	}
+}
@@ -3,6 +3,12 @@
 
 package imageproxy
 
+import (
+	"net/url"
+	"slices"
+	"strings"
+)
+
 // The Cache interface defines a cache for storing arbitrary data.  The
 // interface is designed to align with httpcache.Cache.
 type Cache interface {
@@ -16,6 +22,23 @@ type Cache interface {
 	Delete(key string)
 }
 
+// CacheStats are statistics describing the contents and usage of a cache.
+// Statistics that a cache is unable to report are zero.
+type CacheStats struct {
+	Entries   int64 `json:"entries"`   // number of cached entries
+	Bytes     int64 `json:"bytes"`     // total size of cached data
+	Hits      int64 `json:"hits"`      // number of successful lookups
+	Misses    int64 `json:"misses"`    // number of unsuccessful lookups
+	Evictions int64 `json:"evictions"` // number of entries removed to free space
+}
+
+// StatsReporter is implemented by caches that can report statistics about
+// their contents and usage, which are served by the proxy's cache statistics
+// endpoint.
+type StatsReporter interface {
+	CacheStats() CacheStats
+}
+
 // NopCache provides a no-op cache implementation that doesn't actually cache anything.
 var NopCache = new(nopCache)
 
@@ -24,3 +47,42 @@ type nopCache struct{}
 func (c nopCache) Get(string) ([]byte, bool) { return nil, false }
 func (c nopCache) Set(string, []byte)        {}
 func (c nopCache) Delete(string)             {}
+
+// normalizedCache is a Cache that normalizes keys before they are passed to
+// the underlying cache.
+type normalizedCache struct {
+	Cache
+	normalize func(key string) string
+}
+
+func (c *normalizedCache) Get(key string) ([]byte, bool) { return c.Cache.Get(c.normalize(key)) }
+func (c *normalizedCache) Set(key string, data []byte)   { c.Cache.Set(c.normalize(key), data) }
+func (c *normalizedCache) Delete(key string)             { c.Cache.Delete(c.normalize(key)) }
+
+// stripQueryParams returns key with the named query parameters removed, if
+// key is a URL.  The order and encoding of other parameters is preserved.
+func stripQueryParams(key string, params []string) string {
+	if len(params) == 0 || !strings.Contains(key, "?") {
+		return key
+	}
+	u, err := url.Parse(key)
+	if err != nil || u.RawQuery == "" {
+		return key
+	}
+
+	var kept []string
+	removed := false
+	for _, kv := range strings.Split(u.RawQuery, "&") {
+		name, _, _ := strings.Cut(kv, "=")
+		if n, err := url.QueryUnescape(name); err == nil && slices.Contains(params, n) {
+			removed = true
+			continue
+		}
+		kept = append(kept, kv)
+	}
+	if !removed {
+		return key
+	}
+	u.RawQuery = strings.Join(kept, "&")
+	return u.String()
+}
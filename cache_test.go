@@ -3,7 +3,11 @@
 
 package imageproxy
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/die-net/lrucache"
+)
 
 func TestNopCache(t *testing.T) {
 	data, ok := NopCache.Get("foo")
@@ -18,3 +22,43 @@ func TestNopCache(t *testing.T) {
 	NopCache.Set("", []byte{})
 	NopCache.Delete("")
 }
+
+func TestStripQueryParams(t *testing.T) {
+	tests := []struct {
+		key    string
+		params []string
+		want   string
+	}{
+		{"http://example.com/image?v=1", nil, "http://example.com/image?v=1"},
+		{"http://example.com/image?v=1", []string{"v"}, "http://example.com/image"},
+		{"http://example.com/image?a=1&v=2&b=3#100x", []string{"v"}, "http://example.com/image?a=1&b=3#100x"},
+		{"http://example.com/image?b=2&a=1", []string{"v"}, "http://example.com/image?b=2&a=1"},
+		{"http://example.com/image?v=1&v=2&cb", []string{"v", "cb"}, "http://example.com/image"},
+		{"http://example.com/image#100x", []string{"v"}, "http://example.com/image#100x"},
+	}
+
+	for _, tt := range tests {
+		if got := stripQueryParams(tt.key, tt.params); got != tt.want {
+			t.Errorf("stripQueryParams(%q, %q) returned %q, want %q", tt.key, tt.params, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizedCache(t *testing.T) {
+	c := &normalizedCache{
+		Cache:     lrucache.New(1024, 0),
+		normalize: func(key string) string { return stripQueryParams(key, []string{"v"}) },
+	}
+
+	c.Set("http://example.com/image?v=1", []byte("data"))
+	if got, ok := c.Get("http://example.com/image?v=2"); !ok || string(got) != "data" {
+		t.Errorf("Get with different ignored param returned %q, %t; want %q, true", got, ok, "data")
+	}
+	if _, ok := c.Get("http://example.com/image?w=1"); ok {
+		t.Errorf("Get with different param returned cached data")
+	}
+	c.Delete("http://example.com/image?v=3")
+	if _, ok := c.Get("http://example.com/image"); ok {
+		t.Errorf("Get after Delete returned cached data")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// default duration a circuit stays open before allowing a trial request.
+const defaultCircuitBreakerCooldown = 30 * time.Second
+
+// circuitBreaker tracks consecutive failures for remote hosts, and
+// short-circuits requests to hosts that are repeatedly failing.
+// The zero value is ready to use.
+type circuitBreaker struct {
+	mu    sync.Mutex
+	hosts map[string]*circuit
+}
+
+// circuit is the state of the circuit for a single remote host.
+type circuit struct {
+	failures  int       // number of consecutive failures
+	firstFail time.Time // time of the first of the consecutive failures
+	openUntil time.Time // time at which the circuit becomes half-open
+	trial     bool      // whether a half-open trial request is in progress
+}
+
+// allow returns whether a request to host may proceed at time now.  Once an
+// open circuit's cooldown has passed, a single trial request is allowed
+// through; other requests continue to fail until that trial completes.
+func (b *circuitBreaker) allow(host string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.hosts[host]
+	if c == nil || c.openUntil.IsZero() {
+		return true // closed
+	}
+	if now.Before(c.openUntil) || c.trial {
+		return false // open, or half-open with a trial already in progress
+	}
+	c.trial = true
+	return true
+}
+
+// hostFailed reports whether the result of fetching a remote image, resp or
+// err, is a failure of the remote host.  Only errors connecting to or reading
+// from the host, and 5xx responses, are failures.  Requests the proxy
+// declined, images too large or otherwise unable to be transformed, and
+// errors fetching a client-chosen overlay are not the host's fault.
+func hostFailed(resp *http.Response, err error) bool {
+	if err == nil {
+		return resp.StatusCode >= 500
+	}
+	var oerr overlayError
+	if errors.As(err, &oerr) {
+		return false
+	}
+	for _, target := range []error{errDeniedNetwork, errRedirectNotAllowed, errTooManyRedirects, errDecodedTooLarge, errImageTooLarge, errTransform} {
+		if errors.Is(err, target) {
+			return false
+		}
+	}
+	return true
+}
+
+// abandon records that a request to host completed without a result, such
+// as when the client canceled it.  A half-open trial request is released, so
+// that another trial may be made, but no failure is counted.
+func (b *circuitBreaker) abandon(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c := b.hosts[host]; c != nil {
+		c.trial = false
+	}
+}
+
+// record records the result of a request to host at time now.  If threshold
+// consecutive failures have occurred within window, or if a half-open trial
+// request failed, the circuit is opened for cooldown.  A zero window counts
+// all consecutive failures.
+func (b *circuitBreaker) record(host string, success bool, now time.Time, threshold int, window, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if success {
+		delete(b.hosts, host)
+		return
+	}
+
+	if b.hosts == nil {
+		b.hosts = make(map[string]*circuit)
+	}
+	c := b.hosts[host]
+	if c == nil {
+		c = new(circuit)
+		b.hosts[host] = c
+	}
+
+	if c.failures == 0 || (window > 0 && now.Sub(c.firstFail) > window) {
+		c.failures = 0
+		c.firstFail = now
+	}
+	c.failures++
+
+	// a failed trial request re-opens the circuit immediately
+	trial := c.trial
+	c.trial = false
+
+	if trial || c.failures >= threshold {
+		if cooldown <= 0 {
+			cooldown = defaultCircuitBreakerCooldown
+		}
+		c.openUntil = now.Add(cooldown)
+	}
+}
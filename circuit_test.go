@@ -0,0 +1,226 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var b circuitBreaker
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	record := func(success bool) {
+		b.record("a.test", success, now, 2, time.Minute, time.Minute)
+	}
+
+	if !b.allow("a.test", now) {
+		t.Fatalf("allow returned false for unknown host")
+	}
+
+	// a single failure does not open the circuit
+	record(false)
+	if !b.allow("a.test", now) {
+		t.Errorf("allow returned false after one failure")
+	}
+
+	// failures outside of the window are not counted together
+	now = now.Add(2 * time.Minute)
+	record(false)
+	if !b.allow("a.test", now) {
+		t.Errorf("allow returned false after failures outside window")
+	}
+
+	// second consecutive failure within the window opens the circuit
+	record(false)
+	if b.allow("a.test", now) {
+		t.Errorf("allow returned true for open circuit")
+	}
+	if !b.allow("b.test", now) {
+		t.Errorf("allow returned false for unrelated host")
+	}
+
+	// after cooldown, a single trial request is allowed
+	now = now.Add(2 * time.Minute)
+	if !b.allow("a.test", now) {
+		t.Errorf("allow returned false for half-open circuit")
+	}
+	if b.allow("a.test", now) {
+		t.Errorf("allow returned true while trial request is in progress")
+	}
+
+	// failed trial re-opens the circuit
+	record(false)
+	if b.allow("a.test", now) {
+		t.Errorf("allow returned true after failed trial request")
+	}
+
+	// abandoned trial allows another trial, without re-opening the circuit
+	now = now.Add(2 * time.Minute)
+	if !b.allow("a.test", now) {
+		t.Errorf("allow returned false for half-open circuit")
+	}
+	b.abandon("a.test")
+	if !b.allow("a.test", now) {
+		t.Errorf("allow returned false after abandoned trial request")
+	}
+	b.abandon("a.test")
+
+	// successful trial closes the circuit
+	now = now.Add(2 * time.Minute)
+	if !b.allow("a.test", now) {
+		t.Errorf("allow returned false for half-open circuit")
+	}
+	record(true)
+	if !b.allow("a.test", now) || !b.allow("a.test", now) {
+		t.Errorf("allow returned false for closed circuit")
+	}
+}
+
+func TestHostFailed(t *testing.T) {
+	tests := []struct {
+		code int
+		err  error
+		want bool
+	}{
+		{http.StatusOK, nil, false},
+		{http.StatusNotFound, nil, false},
+		{http.StatusServiceUnavailable, nil, true},
+		{0, errors.New("connection refused"), true},
+		{0, context.DeadlineExceeded, true},
+		{0, fmt.Errorf("dial: %w", errDeniedNetwork), false},
+		{0, &url.Error{Op: "Get", URL: "http://a.test/", Err: errRedirectNotAllowed}, false},
+		{0, fmt.Errorf("%w http://a.test/: bad image", errTransform), false},
+		{0, errDecodedTooLarge, false},
+		{0, errImageTooLarge, false},
+		{0, overlayError{errors.New("fetching overlay: remote returned status 404")}, false},
+	}
+	for _, tt := range tests {
+		var resp *http.Response
+		if tt.err == nil {
+			resp = &http.Response{StatusCode: tt.code}
+		}
+		if got := hostFailed(resp, tt.err); got != tt.want {
+			t.Errorf("hostFailed(%d, %v) returned %t, want %t", tt.code, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_circuitBreakerOverlay(t *testing.T) {
+	p := NewProxy(imagesTransport{
+		"http://good.test/base": newImage(4, 4, blue),
+	}, nil)
+	p.Logger = log.New(io.Discard, "", 0)
+	p.MaxRetries = -1
+	p.CircuitBreakerThreshold = 1
+
+	// a missing overlay doesn't count against the host of the image
+	u := "/" + overlayOption("http://good.test/missing") + ",png/http://good.test/base"
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, httptest.NewRequest("GET", u, nil))
+	if got, want := resp.Code, http.StatusBadGateway; got != want {
+		t.Errorf("ServeHTTP(%v) returned status %d, want %d", u, got, want)
+	}
+
+	u = "/http://good.test/base"
+	resp = httptest.NewRecorder()
+	p.ServeHTTP(resp, httptest.NewRequest("GET", u, nil))
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Errorf("ServeHTTP(%v) returned status %d, want %d", u, got, want)
+	}
+}
+
+func TestProxy_ServeHTTP_circuitBreaker(t *testing.T) {
+	tr := &statusTransport{code: http.StatusServiceUnavailable}
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	p := &Proxy{
+		Client:                  &http.Client{Transport: tr},
+		Logger:                  log.New(io.Discard, "", 0),
+		MaxRetries:              -1,
+		CircuitBreakerThreshold: 2,
+		CircuitBreakerCooldown:  time.Minute,
+		Clock:                   clock,
+	}
+
+	serve := func() int {
+		req := httptest.NewRequest("GET", "/http://bad.test/image", nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	// drive the host into the open state
+	for range 2 {
+		if got, want := serve(), http.StatusServiceUnavailable; got != want {
+			t.Errorf("ServeHTTP returned status %d, want %d", got, want)
+		}
+	}
+
+	// requests fail fast during cooldown, without contacting the host
+	for range 3 {
+		if got, want := serve(), http.StatusBadGateway; got != want {
+			t.Errorf("ServeHTTP returned status %d, want %d", got, want)
+		}
+	}
+	if got, want := tr.requests, 2; got != want {
+		t.Errorf("remote host received %d requests, want %d", got, want)
+	}
+
+	// after cooldown, host has recovered
+	clock.now = clock.now.Add(2 * time.Minute)
+	tr.code = http.StatusNoContent
+	if got, want := serve(), http.StatusNoContent; got != want {
+		t.Errorf("ServeHTTP returned status %d, want %d", got, want)
+	}
+	if got, want := tr.requests, 3; got != want {
+		t.Errorf("remote host received %d requests, want %d", got, want)
+	}
+}
+
+func TestProxy_ServeHTTP_circuitBreakerCanceledTrial(t *testing.T) {
+	tr := &statusTransport{code: http.StatusServiceUnavailable}
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	p := &Proxy{
+		Client:                  &http.Client{Transport: tr},
+		Logger:                  log.New(io.Discard, "", 0),
+		MaxRetries:              -1,
+		CircuitBreakerThreshold: 1,
+		CircuitBreakerCooldown:  time.Minute,
+		Clock:                   clock,
+	}
+
+	serve := func(ctx context.Context) int {
+		req := httptest.NewRequest("GET", "/http://bad.test/image", nil).WithContext(ctx)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	// open the circuit
+	if got, want := serve(context.Background()), http.StatusServiceUnavailable; got != want {
+		t.Errorf("ServeHTTP returned status %d, want %d", got, want)
+	}
+
+	// the client cancels the half-open trial request
+	clock.now = clock.now.Add(2 * time.Minute)
+	p.Client.Transport = &slowTransport{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	serve(ctx)
+
+	// the next request is allowed through as a new trial
+	tr.code = http.StatusNoContent
+	p.Client.Transport = tr
+	if got, want := serve(context.Background()), http.StatusNoContent; got != want {
+		t.Errorf("ServeHTTP after canceled trial returned status %d, want %d", got, want)
+	}
+}
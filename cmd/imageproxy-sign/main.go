@@ -15,6 +15,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
 
 	"willnorris.com/go/imageproxy"
@@ -22,12 +23,17 @@ import (
 
 var signingKey = flag.String("key", "@/etc/imageproxy.key", "signing key, or file containing key prefixed with '@'")
 var urlOnly = flag.Bool("url", false, "only sign the URL value, do not include options")
+var headers headerList
+
+func init() {
+	flag.Var(&headers, "header", `request header to include in the signature, as "Name: value" (may be repeated)`)
+}
 
 func main() {
 	flag.Parse()
 	u := flag.Arg(0)
 
-	sig, err := sign(*signingKey, u, *urlOnly)
+	sig, err := sign(*signingKey, u, *urlOnly, headers)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -37,7 +43,7 @@ func main() {
 	fmt.Printf("signature: %v\n", base64.URLEncoding.EncodeToString(sig))
 }
 
-func sign(key string, s string, urlOnly bool) ([]byte, error) {
+func sign(key string, s string, urlOnly bool, headers []string) ([]byte, error) {
 	if s == "" {
 		return nil, errors.New("imageproxy-sign url [key]")
 	}
@@ -47,7 +53,12 @@ func sign(key string, s string, urlOnly bool) ([]byte, error) {
 		return nil, fmt.Errorf("unable to parse URL: %v", s)
 	}
 	if urlOnly {
+		// URL only signatures must still include any expiry
+		opt := imageproxy.ParseOptions(u.Fragment)
 		u.Fragment = ""
+		if !opt.ValidUntil.IsZero() {
+			u.Fragment = fmt.Sprintf("vu%d", opt.ValidUntil.Unix())
+		}
 	}
 
 	k, err := parseKey(key)
@@ -55,13 +66,57 @@ func sign(key string, s string, urlOnly bool) ([]byte, error) {
 		return nil, fmt.Errorf("error parsing key: %w", err)
 	}
 
+	h, err := signedHeaderValues(headers)
+	if err != nil {
+		return nil, err
+	}
+
 	mac := hmac.New(sha256.New, k)
-	if _, err := mac.Write([]byte(u.String())); err != nil {
+	if _, err := mac.Write([]byte(imageproxy.CanonicalURL(u) + h)); err != nil {
 		return nil, err
 	}
 	return mac.Sum(nil), nil
 }
 
+// signedHeaderValues returns the headers, each specified as "Name: value", in
+// the form they are appended to the signed message.  This must match the
+// headers configured on the imageproxy server with the signedHeaders flag.
+func signedHeaderValues(headers []string) (string, error) {
+	values := make(map[string][]string)
+	for _, header := range headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return "", fmt.Errorf("header %q must be of the form \"Name: value\"", header)
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		values[name] = append(values[name], strings.TrimSpace(value))
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "\n%s:%s", name, strings.Join(values[name], ","))
+	}
+	return b.String(), nil
+}
+
+// headerList is a list of request headers specified via flags.
+type headerList []string
+
+func (hl *headerList) String() string {
+	return fmt.Sprint(*hl)
+}
+
+func (hl *headerList) Set(value string) error {
+	*hl = append(*hl, value)
+	return nil
+}
+
 func parseKey(s string) ([]byte, error) {
 	if strings.HasPrefix(s, "@") {
 		return os.ReadFile(s[1:])
@@ -4,6 +4,8 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"net/url"
 	"os"
 	"reflect"
@@ -15,7 +17,7 @@ var key = "secret"
 func TestSign(t *testing.T) {
 	s := "http://example.com/image.jpg#0x0"
 
-	got, err := sign(key, s, false)
+	got, err := sign(key, s, false, nil)
 	if err != nil {
 		t.Errorf("sign(%q, %q, false) returned error: %v", key, s, err)
 	}
@@ -28,7 +30,7 @@ func TestSign(t *testing.T) {
 func TestSign_URLOnly(t *testing.T) {
 	s := "http://example.com/image.jpg#0x0"
 
-	got, err := sign(key, s, true)
+	got, err := sign(key, s, true, nil)
 	if err != nil {
 		t.Errorf("sign(%q, %q, true) returned error: %v", key, s, err)
 	}
@@ -38,6 +40,52 @@ func TestSign_URLOnly(t *testing.T) {
 	}
 }
 
+func TestSign_URLOnlyValidUntil(t *testing.T) {
+	s := "http://example.com/image.jpg#0x0,r90,vu1577836800"
+
+	got, err := sign(key, s, true, nil)
+	if err != nil {
+		t.Errorf("sign(%q, %q, true) returned error: %v", key, s, err)
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("http://example.com/image.jpg#vu1577836800"))
+	if want := mac.Sum(nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("sign(%q, %q, true) returned %v, want %v", key, s, got, want)
+	}
+}
+
+func TestSign_Canonical(t *testing.T) {
+	s := "HTTP://Example.com/foo bar.jpg?b=2&a=1#0x0"
+
+	got, err := sign(key, s, false, nil)
+	if err != nil {
+		t.Errorf("sign(%q, %q, false) returned error: %v", key, s, err)
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("http://example.com/foo%20bar.jpg?a=1&b=2#0x0"))
+	if want := mac.Sum(nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("sign(%q, %q, false) returned %v, want %v", key, s, got, want)
+	}
+}
+
+func TestSign_Headers(t *testing.T) {
+	s := "http://example.com/image.jpg#0x0"
+	headers := []string{"Referer: http://a.test/", "accept:image/webp"}
+
+	got, err := sign(key, s, false, headers)
+	if err != nil {
+		t.Errorf("sign(%q, %q, false, %q) returned error: %v", key, s, headers, err)
+	}
+	want := []byte{0x86, 0xf7, 0xdd, 0x79, 0xec, 0xe3, 0xbe, 0xbb, 0x2e, 0x66, 0x71, 0x62, 0xb, 0x3a, 0xee, 0xa9, 0x9c, 0x54, 0xdb, 0xcd, 0x48, 0xfa, 0xd8, 0x4d, 0xbb, 0x3a, 0x4d, 0x79, 0x49, 0xa5, 0xa2, 0x48}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sign(%q, %q, false, %q) returned %v, want %v", key, s, headers, got, want)
+	}
+
+	if _, err := sign(key, s, false, []string{"Referer"}); err == nil {
+		t.Errorf("sign(%q, %q, false, %q) did not return expected error", key, s, []string{"Referer"})
+	}
+}
+
 func TestSign_Errors(t *testing.T) {
 	var err error
 
@@ -50,7 +98,7 @@ func TestSign_Errors(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		_, err = sign(tt.key, tt.url, false)
+		_, err = sign(tt.key, tt.url, false, nil)
 		if err == nil {
 			t.Errorf("sign(%q, %q, false) did not return expected error", tt.key, tt.url)
 		}
@@ -5,24 +5,33 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"image/color"
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/PaulARoy/azurestoragecache"
 	"github.com/die-net/lrucache"
 	"github.com/die-net/lrucache/twotier"
+	"github.com/disintegration/imaging"
 	"github.com/gomodule/redigo/redis"
 	"github.com/gregjones/httpcache/diskcache"
 	rediscache "github.com/gregjones/httpcache/redis"
 	"github.com/peterbourgon/diskv"
+	"golang.org/x/image/font/opentype"
 	"willnorris.com/go/imageproxy"
 	"willnorris.com/go/imageproxy/internal/gcscache"
 	"willnorris.com/go/imageproxy/internal/s3cache"
@@ -34,26 +43,91 @@ const defaultMemorySize = 100
 var addr = flag.String("addr", "localhost:8080", "address to listen on, either a TCP address or a Unix domain socket path prefixed with unix:")
 var allowHosts = flag.String("allowHosts", "", "comma separated list of allowed remote hosts")
 var denyHosts = flag.String("denyHosts", "", "comma separated list of denied remote hosts")
+var denyPrivateNetworks = flag.Bool("denyPrivateNetworks", false, "deny fetching remote images from private, loopback, and link-local addresses")
+var maxIdleConnsPerHost = flag.Int("maxIdleConnsPerHost", 0, "maximum idle connections kept to each remote host (0 for default)")
+var maxConnsPerHost = flag.Int("maxConnsPerHost", 0, "maximum connections to each remote host, including active connections (0 for no limit)")
+var dialTimeout = flag.Duration("dialTimeout", 0, "maximum time to wait for a connection to a remote host (0 for default of 30s)")
+var keepAlive = flag.Duration("keepAlive", 0, "interval between TCP keep-alive probes on remote connections (0 for default of 30s, negative to disable)")
+var denyNetworks = flag.String("denyNetworks", "", "comma separated list of CIDR networks that remote images cannot be fetched from")
 var referrers = flag.String("referrers", "", "comma separated list of allowed referring hosts")
+var allowedOrigins = flag.String("allowedOrigins", "", "comma separated list of origins allowed to access images using CORS")
 var includeReferer = flag.Bool("includeReferer", false, "include referer header in remote requests")
 var followRedirects = flag.Bool("followRedirects", true, "follow redirects")
+var maxRedirects = flag.Int("maxRedirects", 10, "maximum number of redirects to follow (0 to treat any redirect as an error)")
 var baseURL = flag.String("baseURL", "", "default base URL for relative remote URLs")
-var passRequestHeaders = flag.String("passRequestHeaders", "", "comma separatetd list of request headers to pass to remote server")
-var passResponseHeaders = flag.String("passResponseHeaders", "Cache-Control,Last-Modified,Expires,Etag,Link", "comma separated list of response headers to pass from remote server")
+var passRequestHeaders = flag.String("passRequestHeaders", "", "comma separatetd list of request headers to pass to remote server (may include glob patterns)")
+var passResponseHeaders = flag.String("passResponseHeaders", "Cache-Control,Last-Modified,Expires,Etag,Link", "comma separated list of response headers to pass from remote server (may include glob patterns)")
+var stripResponseHeaders = flag.String("stripResponseHeaders", "", "comma separated list of response headers to remove, even if passed from remote server")
 var cache tieredCache
 var signatureKeys signatureKeyList
+var signatureKeyIDs = signatureKeyMap{}
+var hostContentTypes = hostContentTypeMap{}
+var hostMinCacheDurations = hostDurationMap{}
+var hostUserAgents = hostUserAgentMap{}
+var signedHeaders = flag.String("signedHeaders", "", "comma separated list of request headers to include in request signatures")
 var scaleUp = flag.Bool("scaleUp", false, "allow images to scale beyond their original dimensions")
+var autoFormat = flag.Bool("autoFormat", false, "encode transformed images as JPEG if opaque, or PNG if transparent, unless a format is requested")
+var failOnTransformError = flag.Bool("failOnTransformError", false, "return an error if an image cannot be transformed, rather than serving the original image")
+var smartCropMaxPixels = flag.Int("smartCropMaxPixels", 4_000_000, "maximum number of pixels analyzed by smart crop; larger images are downsampled first (0 for no limit)")
+var resampleFilter = flag.String("resampleFilter", "", "default resampling filter used when resizing images: lanczos, catmullrom, linear, box, or nearest (default lanczos)")
+var allowAutoQuality = flag.Bool("allowAutoQuality", false, "allow the autoq option, which encodes images several times to choose a quality")
+var decodeCacheSize = flag.Int64("decodeCacheSize", 0, "maximum memory in bytes used to cache decoded images, shared between requests for different sizes of an image (0 to disable)")
+var purgeIndexSize = flag.Int("purgeIndexSize", 0, "maximum number of cache keys indexed so that every cached rendition of a remote image can be purged (0 to disable purging)")
+var maxDecodedBytes = flag.Int64("maxDecodedBytes", 0, "maximum memory in bytes a remote image may use once decoded; larger images are rejected (0 for no limit)")
+var strictOptions = flag.Bool("strictOptions", false, "reject requests with unrecognized, invalid, or conflicting options")
 var timeout = flag.Duration("timeout", 0, "time limit for requests served by this proxy")
+var fetchTimeout = flag.Duration("fetchTimeout", 0, "time limit for fetching remote images, separate from timeout (0 for no limit)")
 var verbose = flag.Bool("verbose", false, "print verbose logging messages")
 var _ = flag.Bool("version", false, "Deprecated: this flag does nothing")
 var contentTypes = flag.String("contentTypes", "image/*", "comma separated list of allowed content types")
+var verifyContentType = flag.Bool("verifyContentType", false, "reject remote images whose content doesn't match their declared content type")
 var userAgent = flag.String("userAgent", "willnorris/imageproxy", "specify the user-agent used by imageproxy when fetching images from origin website")
+var requestGzip = flag.Bool("requestGzip", false, "request gzip compressed responses from remote servers, which are decompressed before use")
 var minCacheDuration = flag.Duration("minCacheDuration", 0, "minimum duration to cache remote images")
 var forceCache = flag.Bool("forceCache", false, "Ignore no-store and private directives in responses")
+var allowedFormats = flag.String("allowedFormats", "", "comma separated list of output formats that may be requested, such as jpeg,png (default all)")
+var ignoreQueryParams = flag.String("ignoreQueryParams", "", "comma separated list of remote URL query parameters to ignore when caching images")
+var responseCacheControl = flag.String("responseCacheControl", "", "Cache-Control header sent to clients, overriding remote cache headers")
+var maxRetries = flag.Int("maxRetries", 0, "maximum number of retries for failed remote requests (0 for default of 3, negative to disable)")
+var retryDelay = flag.Duration("retryDelay", 0, "delay before the first retry of a failed remote request (0 for default of 100ms)")
+var retryBackoff = flag.String("retryBackoff", "linear", "how the delay between retries grows: linear or exponential")
+var retryStatusCodes = flag.String("retryStatusCodes", "500,502,503,504,429", "comma separated list of remote response status codes that are retried (501 and 505 are never retried)")
+var circuitBreakerThreshold = flag.Int("circuitBreakerThreshold", 0, "consecutive failed requests after which a remote host is short-circuited (0 to disable)")
+var circuitBreakerWindow = flag.Duration("circuitBreakerWindow", 0, "period within which consecutive failures must occur to short-circuit a remote host")
+var circuitBreakerCooldown = flag.Duration("circuitBreakerCooldown", 0, "how long a failing remote host is short-circuited (0 for default of 30s)")
+var timingAllowOrigin = flag.String("timingAllowOrigin", "*", "value of the Timing-Allow-Origin response header (empty to omit)")
+var blockedResponse = flag.String("blockedResponse", "error", "response to requests that are not allowed: error (403 Forbidden) or pixel (1x1 transparent PNG)")
+var urlUserinfo = flag.String("urlUserinfo", "strip", "handling of remote URLs with credentials: strip, forward (as basic auth), or reject")
+var blockedStatus = flag.Int("blockedStatus", 0, "status code of pixel responses to requests that are not allowed (0 for default of 200)")
+var contentSecurityPolicy = flag.String("contentSecurityPolicy", "script-src 'none'", "value of the Content-Security-Policy response header (empty to omit)")
+var omitSecurityHeaders = flag.Bool("omitSecurityHeaders", false, "omit CORS and security headers from image responses")
+var serverTiming = flag.Bool("serverTiming", false, "add a Server-Timing header reporting fetch and transform durations")
+var contentDisposition = flag.Bool("contentDisposition", false, "set Content-Disposition header with a filename derived from the remote URL")
+var healthCheckPaths = flag.String("healthCheckPaths", "/,/health-check", "comma separated list of paths that respond with OK while imageproxy is running")
+var readyURL = flag.String("readyURL", "", "canary URL that must be reachable for the /ready endpoint to report the proxy as ready")
+var readyCheckCache = flag.Bool("readyCheckCache", false, "require the cache to be writable for the /ready endpoint to report the proxy as ready")
+var shutdownTimeout = flag.Duration("shutdownTimeout", 30*time.Second, "time to wait for in-flight requests to finish when shutting down")
+var metricsAddr = flag.String("metricsAddr", "", "separate TCP address on which to serve Prometheus metrics at /metrics, instead of addr (such as an internal-only address)")
+var enablePrewarm = flag.Bool("enablePrewarm", false, "enable the /prewarm endpoint for generating images ahead of time (items must be signed if signature keys are set)")
+var enableProfiling = flag.Bool("enableProfiling", false, "serve runtime profiling data under /debug/pprof/ (do not enable on public proxies)")
+var watermark = flag.String("watermark", "", "path to an image overlaid on top of transformed images")
+var watermarkPosition = flag.String("watermarkPosition", "bottomright", "position of the watermark: center, top, bottom, left, right, topleft, topright, bottomleft, or bottomright")
+var watermarkOpacity = flag.Float64("watermarkOpacity", 1, "opacity of the watermark, between 0 and 1")
+var watermarkScale = flag.Float64("watermarkScale", 0, "width of the watermark as a fraction of the image width (0 for original size)")
+var watermarkOptIn = flag.Bool("watermarkOptIn", false, "only apply the watermark to requests with the wm option")
+var textWatermark = flag.String("textWatermark", "", "text drawn on top of all transformed images")
+var textWatermarkFont = flag.String("textWatermarkFont", "", "path to a TrueType or OpenType font for the text watermark (default Go Regular)")
+var textWatermarkSize = flag.Float64("textWatermarkSize", 0, "size of the text watermark in pixels (0 for default of 24)")
+var textWatermarkColor = flag.String("textWatermarkColor", "ffffff", "color of the text watermark, as hex RGB or RGBA")
+var textWatermarkPosition = flag.String("textWatermarkPosition", "bottomright", "position of the text watermark (see watermarkPosition)")
 
 func init() {
 	flag.Var(&cache, "cache", "location to cache images (see https://github.com/willnorris/imageproxy#cache)")
 	flag.Var(&signatureKeys, "signatureKey", "HMAC key used in calculating request signatures")
+	flag.Var(signatureKeyIDs, "signatureKeyID", "HMAC key used in calculating request signatures, with a key ID, specified as id=key")
+	flag.Var(hostContentTypes, "hostContentTypes", "comma separated list of content types allowed from a remote host, overriding contentTypes, specified as host=types")
+	flag.Var(hostMinCacheDurations, "hostMinCacheDuration", "minimum duration to cache images from a remote host, overriding minCacheDuration, specified as host=duration")
+	flag.Var(hostUserAgents, "hostUserAgent", "user-agent used when fetching images from a remote host, overriding userAgent, specified as host=user-agent")
 }
 
 func main() {
@@ -67,12 +141,33 @@ func main() {
 	if *denyHosts != "" {
 		p.DenyHosts = strings.Split(*denyHosts, ",")
 	}
+	p.DenyPrivateNetworks = *denyPrivateNetworks
+	if *denyNetworks != "" {
+		for _, n := range strings.Split(*denyNetworks, ",") {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(n))
+			if err != nil {
+				log.Fatalf("invalid denyNetworks entry: %v", err)
+			}
+			p.DenyNetworks = append(p.DenyNetworks, prefix)
+		}
+	}
+	p.MaxIdleConnsPerHost = *maxIdleConnsPerHost
+	p.MaxConnsPerHost = *maxConnsPerHost
+	p.DialTimeout = *dialTimeout
+	p.KeepAlive = *keepAlive
 	if *referrers != "" {
 		p.Referrers = strings.Split(*referrers, ",")
 	}
+	if *allowedOrigins != "" {
+		p.AllowedOrigins = strings.Split(*allowedOrigins, ",")
+	}
 	if *contentTypes != "" {
 		p.ContentTypes = strings.Split(*contentTypes, ",")
 	}
+	p.VerifyContentType = *verifyContentType
+	if len(hostContentTypes) > 0 {
+		p.HostContentTypes = hostContentTypes
+	}
 	if *passRequestHeaders != "" {
 		p.PassRequestHeaders = strings.Split(*passRequestHeaders, ",")
 	}
@@ -82,7 +177,16 @@ func main() {
 		// set to a non-nil empty slice to pass no headers.
 		p.PassResponseHeaders = []string{}
 	}
+	if *stripResponseHeaders != "" {
+		p.StripResponseHeaders = strings.Split(*stripResponseHeaders, ",")
+	}
 	p.SignatureKeys = signatureKeys
+	if len(signatureKeyIDs) > 0 {
+		p.SignatureKeysByID = signatureKeyIDs
+	}
+	if *signedHeaders != "" {
+		p.SignedHeaders = strings.Split(*signedHeaders, ",")
+	}
 	if *baseURL != "" {
 		var err error
 		p.DefaultBaseURL, err = url.Parse(*baseURL)
@@ -93,12 +197,128 @@ func main() {
 
 	p.IncludeReferer = *includeReferer
 	p.FollowRedirects = *followRedirects
+	p.MaxRedirects = *maxRedirects
 	p.Timeout = *timeout
+	p.FetchTimeout = *fetchTimeout
 	p.ScaleUp = *scaleUp
+	p.AutoFormat = *autoFormat
+	p.SmartCropMaxPixels = *smartCropMaxPixels
+	p.FailOnTransformError = *failOnTransformError
+	if *resampleFilter != "" {
+		if imageproxy.ParseOptions("filter"+*resampleFilter).Filter == "" {
+			log.Fatalf("invalid resampleFilter: %q", *resampleFilter)
+		}
+		p.ResampleFilter = *resampleFilter
+	}
+	p.AllowAutoQuality = *allowAutoQuality
+	p.StrictOptions = *strictOptions
+	p.DecodeCacheSize = *decodeCacheSize
+	p.MaxDecodedBytes = *maxDecodedBytes
+	p.PurgeIndexSize = *purgeIndexSize
 	p.Verbose = *verbose
 	p.UserAgent = *userAgent
+	if len(hostUserAgents) > 0 {
+		p.HostUserAgent = hostUserAgents
+	}
+	p.RequestGzip = *requestGzip
+	if *allowedFormats != "" {
+		p.AllowedFormats = strings.Split(*allowedFormats, ",")
+	}
+	if *ignoreQueryParams != "" {
+		p.IgnoreQueryParams = strings.Split(*ignoreQueryParams, ",")
+	}
 	p.MinimumCacheDuration = *minCacheDuration
+	if len(hostMinCacheDurations) > 0 {
+		p.HostMinimumCacheDuration = hostMinCacheDurations
+	}
 	p.ForceCache = *forceCache
+	p.ResponseCacheControl = *responseCacheControl
+	p.MaxRetries = *maxRetries
+	p.RetryBaseDelay = *retryDelay
+	switch *retryBackoff {
+	case "linear":
+		p.RetryBackoff = imageproxy.LinearBackoff
+	case "exponential":
+		p.RetryBackoff = imageproxy.ExponentialBackoff
+	default:
+		log.Fatalf("invalid retryBackoff: %q", *retryBackoff)
+	}
+	// set to a non-nil slice, so an empty flag disables retrying on any status.
+	p.RetryStatusCodes = []int{}
+	if *retryStatusCodes != "" {
+		for _, v := range strings.Split(*retryStatusCodes, ",") {
+			code, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				log.Fatalf("invalid retryStatusCodes entry: %q", v)
+			}
+			p.RetryStatusCodes = append(p.RetryStatusCodes, code)
+		}
+	}
+	switch *blockedResponse {
+	case "error":
+		p.BlockedResponse = imageproxy.BlockedError
+	case "pixel":
+		p.BlockedResponse = imageproxy.BlockedPixel
+	default:
+		log.Fatalf("invalid blockedResponse: %q", *blockedResponse)
+	}
+	p.BlockedStatus = *blockedStatus
+	switch *urlUserinfo {
+	case "strip":
+		p.URLUserinfo = imageproxy.UserinfoStrip
+	case "forward":
+		p.URLUserinfo = imageproxy.UserinfoForward
+	case "reject":
+		p.URLUserinfo = imageproxy.UserinfoReject
+	default:
+		log.Fatalf("invalid urlUserinfo: %q", *urlUserinfo)
+	}
+	p.CircuitBreakerThreshold = *circuitBreakerThreshold
+	p.CircuitBreakerWindow = *circuitBreakerWindow
+	p.CircuitBreakerCooldown = *circuitBreakerCooldown
+	p.SetContentDisposition = *contentDisposition
+	p.HealthCheckPaths = []string{}
+	if *healthCheckPaths != "" {
+		p.HealthCheckPaths = strings.Split(*healthCheckPaths, ",")
+	}
+	if *readyURL != "" {
+		client := &http.Client{Timeout: 10 * time.Second}
+		p.ReadinessChecks = append(p.ReadinessChecks, imageproxy.OriginReadinessCheck(client, *readyURL))
+	}
+	if *readyCheckCache && cache.Cache != nil {
+		p.ReadinessChecks = append(p.ReadinessChecks, imageproxy.CacheReadinessCheck(cache.Cache))
+	}
+	p.TimingAllowOrigin = *timingAllowOrigin
+	p.ContentSecurityPolicy = *contentSecurityPolicy
+	p.OmitSecurityHeaders = *omitSecurityHeaders
+	p.ServerTiming = *serverTiming
+	p.EnableProfiling = *enableProfiling
+	p.EnablePrewarm = *enablePrewarm
+	p.DisableMetricsRoute = *metricsAddr != ""
+	if *watermark != "" {
+		img, err := imaging.Open(*watermark)
+		if err != nil {
+			log.Fatalf("error loading watermark: %v", err)
+		}
+		pos, ok := watermarkPositions[strings.ToLower(*watermarkPosition)]
+		if !ok {
+			log.Fatalf("invalid watermarkPosition: %q", *watermarkPosition)
+		}
+		p.Watermark = &imageproxy.Watermark{
+			Image:    img,
+			Position: pos,
+			Opacity:  *watermarkOpacity,
+			Scale:    *watermarkScale,
+			OptIn:    *watermarkOptIn,
+		}
+	}
+	if *textWatermark != "" {
+		var err error
+		p.TextWatermark, err = parseTextWatermark()
+		if err != nil {
+			log.Fatalf("error configuring text watermark: %v", err)
+		}
+	}
 
 	var ln net.Listener
 	var err error
@@ -121,8 +341,100 @@ func main() {
 		IdleTimeout:  120 * time.Second,
 	}
 
+	var metricsServer *http.Server
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", p.MetricsHandler())
+		metricsServer = &http.Server{
+			Addr:    *metricsAddr,
+			Handler: mux,
+
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		}
+		go func() {
+			fmt.Printf("imageproxy serving metrics on %s\n", *metricsAddr)
+			if err := metricsServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("metrics server failed: %v", err)
+			}
+		}()
+	}
+
+	// on SIGINT or SIGTERM, stop accepting connections and wait for
+	// in-flight requests to finish before exiting.
+	stopped := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("error shutting down server: %v", err)
+		}
+		if metricsServer != nil {
+			metricsServer.Shutdown(ctx)
+		}
+		if err := p.Shutdown(ctx); err != nil {
+			log.Printf("error waiting for in-flight requests: %v", err)
+		}
+		close(stopped)
+	}()
+
 	fmt.Printf("imageproxy listening on %s\n", *addr)
-	log.Fatal(server.Serve(ln))
+	if err := server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-stopped
+}
+
+// watermarkPositions maps watermarkPosition flag values to anchor points.
+var watermarkPositions = map[string]imaging.Anchor{
+	"center":      imaging.Center,
+	"top":         imaging.Top,
+	"bottom":      imaging.Bottom,
+	"left":        imaging.Left,
+	"right":       imaging.Right,
+	"topleft":     imaging.TopLeft,
+	"topright":    imaging.TopRight,
+	"bottomleft":  imaging.BottomLeft,
+	"bottomright": imaging.BottomRight,
+}
+
+// parseTextWatermark returns the text watermark specified by flags.
+func parseTextWatermark() (*imageproxy.TextWatermark, error) {
+	wm := &imageproxy.TextWatermark{
+		Text: *textWatermark,
+		Size: *textWatermarkSize,
+	}
+
+	var ok bool
+	if wm.Position, ok = watermarkPositions[strings.ToLower(*textWatermarkPosition)]; !ok {
+		return nil, fmt.Errorf("invalid position: %q", *textWatermarkPosition)
+	}
+
+	hex := strings.TrimPrefix(*textWatermarkColor, "#")
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 8 {
+		return nil, fmt.Errorf("invalid color: %q", *textWatermarkColor)
+	}
+	wm.Color = color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}
+
+	if *textWatermarkFont != "" {
+		b, err := os.ReadFile(*textWatermarkFont)
+		if err != nil {
+			return nil, err
+		}
+		if wm.Font, err = opentype.Parse(b); err != nil {
+			return nil, err
+		}
+	}
+
+	return wm, nil
 }
 
 type signatureKeyList [][]byte
@@ -147,6 +459,100 @@ func (skl *signatureKeyList) Set(value string) error {
 	return nil
 }
 
+// signatureKeyMap allows specifying signature keys with key IDs via flags,
+// in the form "id=key".
+type signatureKeyMap map[string][]byte
+
+func (skm signatureKeyMap) String() string {
+	ids := make([]string, 0, len(skm))
+	for id := range skm {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return fmt.Sprint(ids)
+}
+
+func (skm signatureKeyMap) Set(value string) error {
+	for _, v := range strings.Fields(value) {
+		id, k, ok := strings.Cut(v, "=")
+		if !ok || id == "" {
+			return fmt.Errorf("signature key must be of the form id=key")
+		}
+		key := []byte(k)
+		if strings.HasPrefix(k, "@") {
+			file := strings.TrimPrefix(k, "@")
+			var err error
+			key, err = os.ReadFile(file)
+			if err != nil {
+				log.Fatalf("error reading signature file: %v", err)
+			}
+		}
+		skm[id] = key
+	}
+	return nil
+}
+
+// hostContentTypeMap allows specifying the content types allowed from remote
+// hosts via flags, in the form "host=type1,type2".
+type hostContentTypeMap map[string][]string
+
+func (hcm hostContentTypeMap) String() string {
+	return fmt.Sprint(map[string][]string(hcm))
+}
+
+func (hcm hostContentTypeMap) Set(value string) error {
+	for _, v := range strings.Fields(value) {
+		host, types, ok := strings.Cut(v, "=")
+		if !ok || host == "" {
+			return fmt.Errorf("host content types must be of the form host=types")
+		}
+		hcm[host] = nil
+		if types != "" {
+			hcm[host] = strings.Split(types, ",")
+		}
+	}
+	return nil
+}
+
+type hostDurationMap map[string]time.Duration
+
+func (hdm hostDurationMap) String() string {
+	return fmt.Sprint(map[string]time.Duration(hdm))
+}
+
+func (hdm hostDurationMap) Set(value string) error {
+	for _, v := range strings.Fields(value) {
+		host, duration, ok := strings.Cut(v, "=")
+		if !ok || host == "" {
+			return fmt.Errorf("host durations must be of the form host=duration")
+		}
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return err
+		}
+		hdm[host] = d
+	}
+	return nil
+}
+
+// hostUserAgentMap allows specifying the user-agent used for remote hosts via
+// flags, in the form "host=user-agent".  Because user-agents commonly contain
+// spaces, each flag value specifies a single host.
+type hostUserAgentMap map[string]string
+
+func (hum hostUserAgentMap) String() string {
+	return fmt.Sprint(map[string]string(hum))
+}
+
+func (hum hostUserAgentMap) Set(value string) error {
+	host, ua, ok := strings.Cut(value, "=")
+	if !ok || host == "" {
+		return fmt.Errorf("host user-agents must be of the form host=user-agent")
+	}
+	hum[host] = ua
+	return nil
+}
+
 // tieredCache allows specifying multiple caches via flags, which will create
 // tiered caches using the twotier package.
 type tieredCache struct {
@@ -0,0 +1,70 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+
+	"github.com/disintegration/imaging"
+)
+
+// adobeCMYKMarker is an Adobe APP14 segment specifying that the components of
+// a 4-component JPEG are stored as CMYK.
+var adobeCMYKMarker = []byte{
+	0xff, 0xee, 0x00, 0x0e, // APP14 marker and length
+	'A', 'd', 'o', 'b', 'e',
+	0x00, 0x64, // version
+	0x00, 0x00, 0x00, 0x00, // flags
+	0x00, // transform: CMYK
+}
+
+// isCMYKJPEG returns whether the image that failed to decode with err is a
+// 4-component JPEG image which can be decoded with decodeCMYKJPEG.
+func isCMYKJPEG(format string, cfg image.Config, err error) bool {
+	var unsupported jpeg.UnsupportedError
+	return format == "jpeg" && cfg.ColorModel == color.CMYKModel && errors.As(err, &unsupported)
+}
+
+// decodeCMYKJPEG decodes a 4-component JPEG image that lacks the Adobe APP14
+// marker, which the image/jpeg package requires to determine how components
+// are stored.  Images without the marker are assumed to store plain CMYK
+// values, rather than the inverted values written by Adobe applications.
+func decodeCMYKJPEG(img []byte) (image.Image, error) {
+	if len(img) < 2 {
+		return nil, errors.New("invalid jpeg image")
+	}
+	b := make([]byte, 0, len(img)+len(adobeCMYKMarker))
+	b = append(b, img[:2]...) // SOI marker
+	b = append(b, adobeCMYKMarker...)
+	b = append(b, img[2:]...)
+
+	m, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	c, ok := m.(*image.CMYK)
+	if !ok {
+		return nil, errors.New("jpeg image is not CMYK")
+	}
+
+	// undo the inversion applied to Adobe CMYK images
+	for i := range c.Pix {
+		c.Pix[i] = 255 - c.Pix[i]
+	}
+	return c, nil
+}
+
+// cmykToRGB returns m converted to RGB if it is a CMYK image, so that the
+// color conversion happens once, before any other transformations.  Embedded
+// ICC profiles are not applied, so colors are only approximate.
+func cmykToRGB(m image.Image) image.Image {
+	if _, ok := m.(*image.CMYK); ok {
+		return imaging.Clone(m)
+	}
+	return m
+}
@@ -0,0 +1,127 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// newCMYKJPEG returns an 8x8 baseline JPEG image filled with c, stored as
+// four CMYK components.  If adobe is true, the image includes an Adobe APP14
+// marker and stores inverted values, as written by Adobe applications.
+func newCMYKJPEG(c color.CMYK, adobe bool) []byte {
+	b := []byte{0xff, 0xd8} // SOI
+	if adobe {
+		b = append(b, adobeCMYKMarker...)
+	}
+
+	// quantization table of all ones
+	b = append(b, 0xff, 0xdb, 0x00, 0x43, 0x00)
+	b = append(b, bytes.Repeat([]byte{1}, 64)...)
+
+	// baseline frame with four components and no subsampling
+	b = append(b, 0xff, 0xc0, 0x00, 0x14, 8, 0, 8, 0, 8, 4)
+	for id := byte(1); id <= 4; id++ {
+		b = append(b, id, 0x11, 0)
+	}
+
+	// DC table with 4-bit codes for each of the 12 categories, and an AC
+	// table with only the end of block code.
+	b = append(b, 0xff, 0xc4, 0x00, 0x1f, 0x00, 0, 0, 0, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	b = append(b, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)
+	b = append(b, 0xff, 0xc4, 0x00, 0x14, 0x10, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x00)
+
+	// start of scan
+	b = append(b, 0xff, 0xda, 0x00, 0x0e, 4)
+	for id := byte(1); id <= 4; id++ {
+		b = append(b, id, 0x00)
+	}
+	b = append(b, 0, 63, 0)
+
+	// entropy coded data: the DC coefficient of each component's single
+	// block, followed by the end of block code.
+	var data []byte
+	var bits, n uint32
+	write := func(v, size uint32) {
+		for i := int(size) - 1; i >= 0; i-- {
+			bits = bits<<1 | (v>>i)&1
+			if n++; n == 8 {
+				data = append(data, byte(bits))
+				if byte(bits) == 0xff {
+					data = append(data, 0x00)
+				}
+				bits, n = 0, 0
+			}
+		}
+	}
+	for _, v := range []uint8{c.C, c.M, c.Y, c.K} {
+		if adobe {
+			v = 255 - v
+		}
+		dc := 8 * (int32(v) - 128)
+		category := uint32(0)
+		for a := max(dc, -dc); a > 0; a >>= 1 {
+			category++
+		}
+		write(category, 4)
+		if dc < 0 {
+			dc--
+		}
+		write(uint32(dc)&(1<<category-1), category)
+		write(0, 1) // end of block
+	}
+	for n != 0 {
+		write(1, 1) // pad with ones
+	}
+	b = append(b, data...)
+
+	return append(b, 0xff, 0xd9) // EOI
+}
+
+func TestTransform_CMYK(t *testing.T) {
+	tests := []struct {
+		cmyk color.CMYK
+		want color.NRGBA
+	}{
+		{color.CMYK{255, 0, 0, 0}, color.NRGBA{0, 255, 255, 255}},   // cyan
+		{color.CMYK{0, 255, 255, 0}, color.NRGBA{255, 0, 0, 255}},   // red
+		{color.CMYK{0, 0, 0, 0}, color.NRGBA{255, 255, 255, 255}},   // white
+		{color.CMYK{0, 0, 0, 255}, color.NRGBA{0, 0, 0, 255}},       // black
+		{color.CMYK{0, 128, 0, 64}, color.NRGBA{191, 95, 191, 255}}, // purple
+	}
+
+	for _, tt := range tests {
+		for _, adobe := range []bool{true, false} {
+			src := newCMYKJPEG(tt.cmyk, adobe)
+			out, err := Transform(src, Options{Width: 4, Format: "png"})
+			if err != nil {
+				t.Errorf("Transform(%v, adobe=%t) returned error: %v", tt.cmyk, adobe, err)
+				continue
+			}
+			m, err := png.Decode(bytes.NewReader(out))
+			if err != nil {
+				t.Errorf("error decoding transformed image: %v", err)
+				continue
+			}
+			if got, want := m.Bounds().Size(), image.Pt(4, 4); got != want {
+				t.Errorf("Transform(%v, adobe=%t) returned size %v, want %v", tt.cmyk, adobe, got, want)
+			}
+
+			got := color.NRGBAModel.Convert(m.At(2, 2)).(color.NRGBA)
+			if !colorsClose(got, tt.want, 2) {
+				t.Errorf("Transform(%v, adobe=%t) returned color %v, want %v", tt.cmyk, adobe, got, tt.want)
+			}
+		}
+	}
+}
+
+// colorsClose returns whether each channel of a and b differ by at most d.
+func colorsClose(a, b color.NRGBA, d int) bool {
+	diff := func(x, y uint8) int { return max(int(x)-int(y), int(y)-int(x)) }
+	return diff(a.R, b.R) <= d && diff(a.G, b.G) <= d && diff(a.B, b.B) <= d && diff(a.A, b.A) <= d
+}
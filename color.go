@@ -0,0 +1,76 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+
+	"github.com/disintegration/imaging"
+)
+
+// maximum width and height images are downsampled to before finding their
+// dominant color.
+const dominantColorMaxSize = 64
+
+// number of bits per channel used to group similar colors.
+const dominantColorBits = 4
+
+// dominantColor returns the most common color in m.  Similar colors are
+// grouped together, and the average of the largest group is returned.  Fully
+// transparent pixels are ignored.
+func dominantColor(m image.Image) color.NRGBA {
+	img := imaging.Fit(m, dominantColorMaxSize, dominantColorMaxSize, imaging.Box)
+
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	const shift = 8 - dominantColorBits
+	buckets := make(map[int]*bucket)
+	var best *bucket
+
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		r, g, b, a := img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]
+		if a == 0 {
+			continue
+		}
+		key := int(r>>shift)<<(2*dominantColorBits) | int(g>>shift)<<dominantColorBits | int(b>>shift)
+		bk := buckets[key]
+		if bk == nil {
+			bk = new(bucket)
+			buckets[key] = bk
+		}
+		bk.count++
+		bk.r += int(r)
+		bk.g += int(g)
+		bk.b += int(b)
+		if best == nil || bk.count > best.count {
+			best = bk
+		}
+	}
+
+	if best == nil {
+		return color.NRGBA{}
+	}
+	return color.NRGBA{
+		R: uint8(best.r / best.count),
+		G: uint8(best.g / best.count),
+		B: uint8(best.b / best.count),
+		A: 255,
+	}
+}
+
+// colorJSON returns the JSON description of c.
+func colorJSON(c color.NRGBA) ([]byte, error) {
+	return json.Marshal(struct {
+		Hex string `json:"hex"`
+		RGB [3]int `json:"rgb"`
+	}{
+		Hex: fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B),
+		RGB: [3]int{int(c.R), int(c.G), int(c.B)},
+	})
+}
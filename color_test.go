@@ -0,0 +1,79 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDominantColor(t *testing.T) {
+	transparent := color.NRGBA{}
+	tests := []struct {
+		name string
+		src  image.Image
+		want color.NRGBA
+	}{
+		{"solid", newImage(8, 8, color.NRGBA{170, 187, 204, 255}), color.NRGBA{170, 187, 204, 255}},
+		{"two colors", newImage(2, 2, red, red, red, blue), red},
+		{"two colors, majority blue", newImage(3, 1, blue, red, blue), blue},
+		{"ignore transparent", newImage(3, 1, transparent, transparent, green), green},
+		{"fully transparent", newImage(2, 2, transparent), color.NRGBA{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dominantColor(tt.src); got != tt.want {
+				t.Errorf("dominantColor() returned %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestColorJSON(t *testing.T) {
+	got, err := colorJSON(color.NRGBA{170, 187, 204, 255})
+	if err != nil {
+		t.Fatalf("colorJSON returned unexpected error: %v", err)
+	}
+	if want := `{"hex":"#aabbcc","rgb":[170,187,204]}`; string(got) != want {
+		t.Errorf("colorJSON returned %s, want %s", got, want)
+	}
+}
+
+func TestProxy_ServeHTTP_color(t *testing.T) {
+	p := NewProxy(&testTransport{}, nil)
+	p.AllowHosts = []string{"good.test"}
+	p.ContentTypes = []string{"image/*"}
+
+	tests := []struct {
+		url  string
+		code int
+		body string
+	}{
+		{"/color/http://good.test/png", http.StatusOK, `{"hex":"#000000","rgb":[0,0,0]}`},
+		{"/color/http://bad.test/png", http.StatusForbidden, ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.url, nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("ServeHTTP(%q) returned status %d, want %d", tt.url, got, want)
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		if got, want := resp.Header().Get("Content-Type"), "application/json"; got != want {
+			t.Errorf("ServeHTTP(%q) returned content type %q, want %q", tt.url, got, want)
+		}
+		if got := resp.Body.String(); got != tt.body {
+			t.Errorf("ServeHTTP(%q) returned body %s, want %s", tt.url, got, tt.body)
+		}
+	}
+}
@@ -6,9 +6,11 @@ package imageproxy
 import (
 	"encoding/base64"
 	"fmt"
+	"image/color"
 	"net/http"
 	"net/url"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -18,23 +20,56 @@ import (
 
 const (
 	optFit             = "fit"
+	optBlurFill        = "blurfill"
+	optCover           = "cover"
+	optContain         = "contain"
 	optFlipVertical    = "fv"
 	optFlipHorizontal  = "fh"
 	optFormatJPEG      = "jpeg"
 	optFormatPNG       = "png"
 	optFormatTIFF      = "tiff"
+	optFormatBMP       = "bmp"
+	optFormatICO       = "ico"
+	optICOSizesPrefix  = "ico:"
+	optFormatFallback  = "format:"
+	optFormatBlurhash  = "blurhash"
+	optFormatColor     = "color"
+	optFormatMetadata  = "metadata"
 	optRotatePrefix    = "r"
 	optQualityPrefix   = "q"
 	optSignaturePrefix = "s"
+	optKeyIDPrefix     = "k"
 	optSizeDelimiter   = "x"
 	optScaleUp         = "scaleUp"
+	optAutoFormat      = "autoFormat"
 	optCropX           = "cx"
 	optCropY           = "cy"
 	optCropWidth       = "cw"
 	optCropHeight      = "ch"
 	optSmartCrop       = "sc"
+	optSmartCropDebug  = "scdebug"
+	optSmartCropFaces  = "scface"
 	optTrim            = "trim"
+	optTrimEdgesPrefix = "trim:"
 	optValidUntil      = "vu"
+	optAspectRatio     = "ar"
+	optThumbPrefix     = "thumb:"
+	optWatermark       = "wm"
+	optNoWatermark     = "nowm"
+	optPosterizePrefix = "posterize"
+	optThresholdPrefix = "threshold"
+	optTintPrefix      = "tint"
+	optPixelatePrefix  = "pixelate"
+	optProgressive     = "progressive"
+	optDepth16         = "depth16"
+	optPagePrefix      = "page"
+	optFilterPrefix    = "filter"
+	optAutoQuality     = "autoq"
+	optSubsamplePrefix = "subsample"
+	optOverlayPrefix   = "overlay:"
+	optOverlayGravity  = "g:"
+	optOverlayOpacity  = "op:"
+	optOverlayScale    = "os:"
 )
 
 // URLError reports a malformed URL error.
@@ -57,6 +92,10 @@ type Options struct {
 	// will not be cropped, and aspect ratio will be maintained.
 	Fit bool
 
+	// If true, resize the image to fit in the specified dimensions like
+	// Fit, and fill the rest of the box with a blurred copy of the image.
+	BlurFill bool
+
 	// Rotate image the specified degrees counter-clockwise.  Valid values
 	// are 90, 180, 270.
 	Rotate int
@@ -70,13 +109,34 @@ type Options struct {
 	// HMAC Signature for signed requests.
 	Signature string
 
+	// ID of the key used to generate Signature.  If empty, all signature
+	// keys are tried.
+	KeyID string
+
 	// Allow image to scale beyond its original dimensions.  This value
 	// will always be overwritten by the value of Proxy.ScaleUp.
 	ScaleUp bool
 
-	// Desired image format. Valid values are "jpeg", "png", "tiff".
+	// If no Format is specified, encode transformed images as JPEG if they
+	// are opaque, or in a format that preserves transparency if not.  This
+	// value will always be overwritten by the value of Proxy.AutoFormat.
+	AutoFormat bool
+
+	// Desired image format. Valid values are "jpeg", "png", "tiff", "bmp",
+	// and "ico".  Additionally, "blurhash", "color", and "metadata" return
+	// data describing the image rather than the image itself.
 	Format string
 
+	// Sizes of the square images included in an ICO image, as a sorted
+	// colon separated list such as "16:32:48".  If empty, the ICO image
+	// contains a single image of the transformed size.
+	ICOSizes string
+
+	// Ordered list of preferred output formats separated by ">", such as
+	// "png>jpeg".  The first format that is smaller than the original
+	// image is used, otherwise Format is used.
+	FormatFallback string
+
 	// Crop rectangle params
 	CropX      float64
 	CropY      float64
@@ -86,11 +146,216 @@ type Options struct {
 	// Automatically find good crop points based on image content.
 	SmartCrop bool
 
+	// Instead of cropping, outline the crop chosen by SmartCrop on the
+	// original image.  This is useful for tuning smart crop.
+	SmartCropDebug bool
+
+	// Center smart crops on any faces detected in the image, falling back
+	// to SmartCrop if none are found.  Face detection is only available if
+	// imageproxy is built with the "pigo" build tag.
+	SmartCropFaces bool
+
 	// If true, automatically trim pixels of the same color around the edges
 	Trim bool
 
+	// The edges to trim when Trim is true.  If zero, all edges are trimmed.
+	TrimEdges Edges
+
 	// If non-zero, the URL is valid until this time.
 	ValidUntil time.Time
+
+	// If non-zero, crop the image to this aspect ratio before resizing.
+	AspectRatio AspectRatio
+
+	// Pixelate the image using square blocks of this size, in pixels.
+	Pixelate int
+
+	// Reduce each color channel to this many levels.  Values less than 2
+	// are ignored.
+	Posterize int
+
+	// Convert the image to black and white, with pixels whose luminance is
+	// at least this percentage becoming white.  Valid values are greater
+	// than 0 and at most 100.
+	Threshold float64
+
+	// Map the luminance of the image onto this color.  Tint is applied
+	// after other color adjustments.
+	Tint color.Color
+
+	// If non-zero, choose the lowest JPEG quality for which the structural
+	// similarity (SSIM) of the output compared to the source is at least
+	// this value.  Valid values are greater than 0 and less than 1.
+	AutoQuality float64
+
+	// Chroma subsampling ratio of JPEG images, one of "444", "422", or
+	// "420".  If empty, the encoder's default of 4:2:0 is used.
+	ChromaSubsampling string
+
+	// Name of the resampling filter used when resizing the image, such as
+	// "lanczos" or "nearest".  If empty, the default filter is used.
+	Filter string
+
+	// Page of a multi-page TIFF image to use, starting from 0.  Ignored for
+	// other formats.
+	Page int
+
+	// Encode the image so that it can be displayed progressively while
+	// loading.  Only supported for PNG images, which are interlaced.
+	Progressive bool
+
+	// Preserve the depth of 16-bit PNG and TIFF images, rather than
+	// converting them to 8 bits per channel.  Only supported for crops,
+	// rotations, and flips, which don't change pixel values.
+	Depth16 bool
+
+	// Request that the proxy's watermark be applied to, or omitted from,
+	// the image.  See Watermark.OptIn.
+	Watermark   bool
+	NoWatermark bool
+
+	// watermark to overlay on the image.  This is never specified in
+	// requests, and is instead provided by the proxy's configuration.
+	watermark *Watermark
+
+	// textWatermark to draw on the image.  Like watermark, this is
+	// provided by the proxy's configuration.
+	textWatermark *TextWatermark
+
+	// URL of a remote image to composite on top of the image, and the
+	// gravity, opacity percentage, and scale percentage of the overlay.
+	// See ParseOptions for details.
+	Overlay        string
+	OverlayGravity string
+	OverlayOpacity float64
+	OverlayScale   float64
+
+	// decodeCache, if non-nil, caches the decoded image under decodeKey so
+	// that it can be shared with other transformations of the same image.
+	// Like watermark, this is provided by the proxy.
+	decodeCache *decodeCache
+	decodeKey   string
+
+	// overlay is the image to composite on top of the image, fetched
+	// from the Overlay URL by the proxy.
+	overlay *Watermark
+
+	// smartCropMaxPixels is the maximum number of pixels in images analyzed
+	// by smart crop.  Like watermark, this is provided by the proxy.
+	smartCropMaxPixels int
+
+	// maxDecodedBytes is the maximum estimated memory used by the decoded
+	// image.  Like watermark, this is provided by the proxy.
+	maxDecodedBytes int64
+}
+
+// Edges is a set of edges of an image.
+type Edges uint8
+
+// Image edges, which can be combined to form a set of edges.
+const (
+	EdgeTop Edges = 1 << iota
+	EdgeBottom
+	EdgeLeft
+	EdgeRight
+
+	allEdges = EdgeTop | EdgeBottom | EdgeLeft | EdgeRight
+)
+
+// edgeLetters are the letters used to specify each edge in options, in the
+// same order as the Edges constants.
+const edgeLetters = "tblr"
+
+// String returns the edges in e as a string such as "tb".
+func (e Edges) String() string {
+	var s []byte
+	for i := range len(edgeLetters) {
+		if e&(1<<i) != 0 {
+			s = append(s, edgeLetters[i])
+		}
+	}
+	return string(s)
+}
+
+// parseEdges parses a string of edge letters such as "tb".  It returns false
+// if s is empty or includes any invalid letters.
+func parseEdges(s string) (Edges, bool) {
+	var e Edges
+	for _, c := range s {
+		i := strings.IndexRune(edgeLetters, c)
+		if i < 0 {
+			return 0, false
+		}
+		e |= 1 << i
+	}
+	return e, e != 0
+}
+
+// validFormatFallback returns whether s is a valid list of formats for the
+// format fallback option.  Formats are separated by ">", and must be formats
+// that images can be encoded in.
+func validFormatFallback(s string) bool {
+	for _, f := range strings.Split(s, ">") {
+		if !canEncode(f) {
+			return false
+		}
+	}
+	return true
+}
+
+// maxICOSize is the largest image size that can be included in an ICO image.
+const maxICOSize = 256
+
+// parseICOSizes parses a colon separated list of ICO image sizes, returning
+// the valid sizes sorted and with duplicates removed.
+func parseICOSizes(s string) string {
+	var sizes []int
+	for _, v := range strings.Split(s, ":") {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= maxICOSize {
+			sizes = append(sizes, n)
+		}
+	}
+	slices.Sort(sizes)
+	sizes = slices.Compact(sizes)
+
+	strs := make([]string, len(sizes))
+	for i, n := range sizes {
+		strs[i] = strconv.Itoa(n)
+	}
+	return strings.Join(strs, ":")
+}
+
+// icoSizes returns the sizes of the images to include in an ICO image.
+func (o Options) icoSizes() []int {
+	if o.ICOSizes == "" {
+		return nil
+	}
+	var sizes []int
+	for _, v := range strings.Split(o.ICOSizes, ":") {
+		if n, err := strconv.Atoi(v); err == nil {
+			sizes = append(sizes, n)
+		}
+	}
+	return sizes
+}
+
+// trimEdges returns the edges to trim, which defaults to all edges.
+func (o Options) trimEdges() Edges {
+	if o.TrimEdges == 0 {
+		return allEdges
+	}
+	return o.TrimEdges
+}
+
+// AspectRatio is a ratio of width to height, such as 16:9.
+type AspectRatio struct {
+	Width  float64
+	Height float64
+}
+
+// valid returns whether a is a usable aspect ratio.
+func (a AspectRatio) valid() bool {
+	return a.Width > 0 && a.Height > 0
 }
 
 func (o Options) String() string {
@@ -98,6 +363,9 @@ func (o Options) String() string {
 	if o.Fit {
 		opts = append(opts, optFit)
 	}
+	if o.BlurFill {
+		opts = append(opts, optBlurFill)
+	}
 	if o.Rotate != 0 {
 		opts = append(opts, fmt.Sprintf("%s%d", optRotatePrefix, o.Rotate))
 	}
@@ -113,12 +381,23 @@ func (o Options) String() string {
 	if o.Signature != "" {
 		opts = append(opts, fmt.Sprintf("%s%s", optSignaturePrefix, o.Signature))
 	}
+	if o.KeyID != "" {
+		opts = append(opts, fmt.Sprintf("%s%s", optKeyIDPrefix, o.KeyID))
+	}
 	if o.ScaleUp {
 		opts = append(opts, optScaleUp)
 	}
-	if o.Format != "" {
+	if o.AutoFormat {
+		opts = append(opts, optAutoFormat)
+	}
+	if o.Format == optFormatICO && o.ICOSizes != "" {
+		opts = append(opts, optICOSizesPrefix+o.ICOSizes)
+	} else if o.Format != "" {
 		opts = append(opts, o.Format)
 	}
+	if o.FormatFallback != "" {
+		opts = append(opts, optFormatFallback+o.FormatFallback)
+	}
 	if o.CropX != 0 {
 		opts = append(opts, fmt.Sprintf("%s%v", optCropX, o.CropX))
 	}
@@ -134,12 +413,74 @@ func (o Options) String() string {
 	if o.SmartCrop {
 		opts = append(opts, optSmartCrop)
 	}
+	if o.SmartCropDebug {
+		opts = append(opts, optSmartCropDebug)
+	}
+	if o.SmartCropFaces {
+		opts = append(opts, optSmartCropFaces)
+	}
 	if o.Trim {
-		opts = append(opts, optTrim)
+		if e := o.trimEdges(); e != allEdges {
+			opts = append(opts, optTrimEdgesPrefix+e.String())
+		} else {
+			opts = append(opts, optTrim)
+		}
 	}
 	if !o.ValidUntil.IsZero() {
 		opts = append(opts, fmt.Sprintf("%s%d", optValidUntil, o.ValidUntil.Unix()))
 	}
+	if o.AspectRatio.valid() {
+		opts = append(opts, fmt.Sprintf("%s%v%s%v", optAspectRatio, o.AspectRatio.Width, optSizeDelimiter, o.AspectRatio.Height))
+	}
+	if o.Pixelate != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d", optPixelatePrefix, o.Pixelate))
+	}
+	if o.Posterize != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d", optPosterizePrefix, o.Posterize))
+	}
+	if o.Threshold != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optThresholdPrefix, o.Threshold))
+	}
+	if o.Tint != nil {
+		c := color.NRGBAModel.Convert(o.Tint).(color.NRGBA)
+		opts = append(opts, fmt.Sprintf("%s%02x%02x%02x", optTintPrefix, c.R, c.G, c.B))
+	}
+	if o.Progressive {
+		opts = append(opts, optProgressive)
+	}
+	if o.Depth16 {
+		opts = append(opts, optDepth16)
+	}
+	if o.AutoQuality != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optAutoQuality, o.AutoQuality))
+	}
+	if o.ChromaSubsampling != "" {
+		opts = append(opts, optSubsamplePrefix+o.ChromaSubsampling)
+	}
+	if o.Page != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d", optPagePrefix, o.Page))
+	}
+	if o.Filter != "" {
+		opts = append(opts, optFilterPrefix+o.Filter)
+	}
+	if o.Watermark {
+		opts = append(opts, optWatermark)
+	}
+	if o.NoWatermark {
+		opts = append(opts, optNoWatermark)
+	}
+	if o.Overlay != "" {
+		opts = append(opts, optOverlayPrefix+base64.RawURLEncoding.EncodeToString([]byte(o.Overlay)))
+	}
+	if o.OverlayGravity != "" {
+		opts = append(opts, optOverlayGravity+o.OverlayGravity)
+	}
+	if o.OverlayOpacity != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optOverlayOpacity, o.OverlayOpacity))
+	}
+	if o.OverlayScale != 0 {
+		opts = append(opts, fmt.Sprintf("%s%v", optOverlayScale, o.OverlayScale))
+	}
 
 	sort.Strings(opts)
 
@@ -151,7 +492,7 @@ func (o Options) String() string {
 // the presence of other fields (like Fit).  A non-empty Format value is
 // assumed to involve a transformation.
 func (o Options) transform() bool {
-	return o.Width != 0 || o.Height != 0 || o.Rotate != 0 || o.FlipHorizontal || o.FlipVertical || o.Quality != 0 || o.Format != "" || o.CropX != 0 || o.CropY != 0 || o.CropWidth != 0 || o.CropHeight != 0 || o.Trim
+	return o.Width != 0 || o.Height != 0 || o.Rotate != 0 || o.FlipHorizontal || o.FlipVertical || o.Quality != 0 || o.AutoQuality != 0 || o.ChromaSubsampling != "" || o.Format != "" || o.FormatFallback != "" || o.CropX != 0 || o.CropY != 0 || o.CropWidth != 0 || o.CropHeight != 0 || o.Trim || o.SmartCropDebug || o.AspectRatio.valid() || o.Pixelate > 1 || o.Posterize > 1 || o.Threshold > 0 || o.Tint != nil || o.Progressive || o.Page != 0 || o.watermark != nil || o.textWatermark != nil || o.Overlay != ""
 }
 
 // ParseOptions parses str as a list of comma separated transformation options.
@@ -172,9 +513,11 @@ func (o Options) transform() bool {
 // size. Negative values for cx and cy are measured from the right and bottom
 // edges of the image, respectively.
 //
-// If the crop width or height exceed the width or height of the image, the
-// crop width or height will be adjusted, preserving the specified cx and cy
-// values.  Rectangular crop is applied before any other transformations.
+// If the crop rectangle extends beyond the edges of the image, it is clipped
+// to the image, preserving the specified cx and cy values where they are
+// within the image.  Pixel and percentage values are clipped in the same way.
+// If the crop rectangle is entirely outside the image, no crop is performed.
+// Rectangular crop is applied before any other transformations.
 //
 // # Smart Crop
 //
@@ -182,6 +525,33 @@ func (o Options) transform() bool {
 // requested image width and height dimensions (see Size and Cropping below).
 // The smart crop option will override any requested rectangular crop.
 //
+// To see which region smart crop chooses, add the "scdebug" option.  Rather
+// than being cropped, the original image is returned with the chosen region
+// outlined, and no other transformations are applied.
+//
+// The "scface" option performs a smart crop that is centered on any faces
+// found in the image, which keeps faces in portrait thumbnails that smart crop
+// would otherwise cut off.  If no faces are found, the "sc" smart crop is
+// used.  Face detection requires building imageproxy with the "pigo" build
+// tag; otherwise "scface" is the same as "sc".
+//
+// # Aspect Ratio Crop
+//
+// The "ar{width}x{height}" option will crop the image to the specified aspect
+// ratio, such as "ar16x9", regardless of the image size.  The largest possible
+// area of the image is kept, centered unless the "sc" option is also
+// specified, in which case smart crop is used to position the crop.  Aspect
+// ratio crop is applied after any rectangular crop, and before resizing.  If
+// only one of width or height is requested, the other dimension is derived
+// from the aspect ratio.
+//
+// The "thumb:{width}x{height}:{gravity}" option combines an aspect ratio crop
+// with how the crop is positioned in a single option, such as
+// "thumb:16x9:face".  Gravity is one of "face", which positions the crop
+// using "scface", "smart", which uses "sc", or "center".  If omitted, gravity
+// defaults to "face".  For example, "thumb:16x9:face,320x" is equivalent to
+// "ar16x9,scface,320x".
+//
 // # Size and Cropping
 //
 // The size option takes the general form "{width}x{height}", where width and
@@ -211,6 +581,24 @@ func (o Options) transform() bool {
 // option with only one of either width or height does the same thing as if
 // "fit" had not been specified.
 //
+// For those more familiar with the CSS object-fit property, the "cover" and
+// "contain" options may be used to make the resize mode explicit.  "cover"
+// scales the image to fill the box, cropping as needed, which is the default
+// behavior.  "contain" is an alias for "fit".  The two options are mutually
+// exclusive, and neither can be combined with "fit".
+//
+// The "blurfill" option letterboxes the image: like "fit", the image is
+// resized to fit within the box, but the result is the full size of the box,
+// with the empty space filled by a blurred copy of the image scaled to cover
+// the box.  It has no effect unless both width and height are specified.
+// Unless scaling up is allowed, a box larger than the image is scaled down
+// to fit within it, keeping the box's aspect ratio.
+//
+// The "filter{name}" option selects the resampling filter used when resizing
+// the image.  Valid filters are "lanczos" (the default), "catmullrom",
+// "linear", "box", and "nearest".  Nearest neighbor resampling is useful for
+// scaling pixel art without blurring.
+//
 // # Rotation and Flips
 //
 // The "r{degrees}" option will rotate the image the specified number of
@@ -222,12 +610,145 @@ func (o Options) transform() bool {
 // # Quality
 //
 // The "q{qualityPercentage}" option can be used to specify the quality of the
-// output file (JPEG only). If not specified, the default value of "95" is used.
+// output file. For JPEG, if not specified, the default value of "95" is used.
+//
+// PNG is lossless, so for PNG the quality instead selects the compression
+// level: values up to 33 use the best compression, producing the smallest
+// images; values from 34 to 66, or no quality, use the default compression;
+// and values above 66 use the fastest compression, producing larger images.
+// Quality has no effect on other formats.
+//
+// The "autoq{ssim}" option chooses the lowest JPEG quality for which the
+// structural similarity (SSIM) of the output image compared to the original is
+// at least the specified value, which must be between 0 and 1.  Higher values
+// produce images that are closer to the original, but larger.  Typical values
+// are between 0.9 and 0.99.  Finding the quality requires encoding the image
+// several times, so this option must be enabled by the proxy.  An explicit
+// quality takes precedence over automatic quality.
+//
+// The "subsample{mode}" option sets the chroma subsampling of JPEG images to
+// one of "444", "422", or "420" (the default).  Images with text or sharp
+// colored edges look better without subsampling, at the cost of larger files.
 //
 // # Format
 //
-// The "jpeg", "png", and "tiff" options can be used to specify the desired
-// image format of the proxied image.
+// The "jpeg", "png", "tiff", "bmp", and "ico" options can be used to specify
+// the desired image format of the proxied image.
+//
+// ICO images contain a single image no larger than 256 pixels square by
+// default.  Multiple sizes can be included using "ico:" followed by a colon
+// separated list of sizes, such as "ico:16:32:48".  Each size is a square
+// image, with the transformed image scaled to fit and centered.
+//
+// The "format:{formats}" option lists preferred formats in order, separated
+// by ">", such as "format:png>jpeg".  The image is encoded in the first of
+// these formats that produces an image smaller than the original.  If none do, the format specified by one of the options above,
+// or the original format, is used instead.
+//
+// Animated gifs converted to "png" are encoded as animated PNGs (APNG),
+// preserving frame timing.  Other formats can not represent animation, so
+// only the first frame is used.
+//
+// # Page
+//
+// The "page{n}" option selects the page of a multi-page TIFF image to use,
+// such as a scanned document, starting from page 0.  Only the selected page
+// is included in the proxied image.  This option is ignored for other
+// formats.
+//
+// # Progressive
+//
+// The "progressive" option encodes PNG images using Adam7 interlacing, so
+// that browsers can display a low resolution version of the image while it
+// is loading.  Progressive JPEG encoding is not supported, so JPEG images
+// are always encoded as baseline JPEGs.  Animated PNGs are not interlaced.
+//
+// # Bit Depth
+//
+// Images are normally transformed with 8 bits per channel.  The "depth16"
+// option preserves the full precision of 16-bit PNG and TIFF images that are
+// encoded as PNG or TIFF, when the only transformations requested are crops,
+// rotations, and flips.  If the image is resized, its colors are changed, or
+// it is encoded as a progressive PNG, it is converted to 8 bits per channel
+// as usual.  Without any transformations, 16-bit images are always returned
+// unchanged.
+//
+// # Blurhash
+//
+// The "blurhash" option returns a compact Blurhash string (see
+// https://blurha.sh) as text/plain rather than the image itself, suitable for
+// rendering a placeholder while the full image loads.  Any other
+// transformations are applied before the Blurhash is calculated.  Because
+// "blurhash" is an ordinary option, a request for just the placeholder of
+// an image takes the form of a dedicated endpoint, and like other responses
+// it is cached:
+//
+//	http://localhost/blurhash/http://example.com/image.jpg
+//
+// ThumbHash placeholders are not supported.
+//
+// # Dominant Color
+//
+// The "color" option returns the dominant color of the image as JSON rather
+// than the image itself, suitable for use as a CSS background placeholder.
+// For example:
+//
+//	{"hex":"#aabbcc","rgb":[170,187,204]}
+//
+// # Metadata
+//
+// The "metadata" option returns information about the original image as JSON
+// rather than the image itself, including its dimensions, format, size in
+// bytes, and whether it supports transparency or is animated.  Other
+// transformation options are ignored.  For example:
+//
+//	{"width":1024,"height":678,"format":"jpeg","size":90210,"alpha":false,"animated":false}
+//
+// # Pixelate
+//
+// The "pixelate{size}" option pixelates the image using square blocks of the
+// specified size in pixels, such as "pixelate10".  The size must be between 2
+// and 10000.  Pixelation is applied after cropping and resizing, so it can be
+// combined with the rectangle crop options to pixelate just a region of the
+// image.
+//
+// # Posterize and Threshold
+//
+// The "posterize{levels}" option reduces each color channel of the image to
+// the specified number of levels, such as "posterize4".
+//
+// The "threshold{percentage}" option converts the image to black and white.
+// Pixels with a luminance of at least the specified percentage become white,
+// and all others become black.  For example, "threshold50".
+//
+// Both options are applied after resizing.
+//
+// # Tint
+//
+// The "tint{color}" option maps the luminance of the image onto the specified
+// hex color, such as "tintff8000", producing a monochrome image of that hue.
+// Tint is applied after posterize and threshold.
+//
+// # Watermark
+//
+// If the proxy is configured with a watermark, it is overlaid on top of the
+// image after all other transformations.  The "nowm" option will omit the
+// watermark.  If the watermark is configured to be opt-in, it is only
+// applied to images that specify the "wm" option.  A text watermark
+// configured on the proxy is always applied.
+//
+// # Overlay
+//
+// The "overlay:{url}" option composites a second remote image on top of the
+// image, where url is the base64url encoded URL of the overlay image.  The
+// overlay is subject to the same access controls as the image itself, and is
+// applied after all other transformations, but before the watermark.
+//
+// The "g:{gravity}" option positions the overlay using one of "n", "ne", "e",
+// "se", "s", "sw", "w", "nw", or "c" (the default).  The "op:{percentage}"
+// option sets the opacity of the overlay, and the "os:{percentage}" option
+// scales the overlay to a percentage of the image's width.  By default, the
+// overlay is fully opaque and drawn at its original size.
 //
 // # Signature
 //
@@ -235,6 +756,11 @@ func (o Options) transform() bool {
 // sign the remote URL in the request.  The HMAC key used to verify signatures is
 // provided to the imageproxy server on startup.
 //
+// The optional "k{id}" option specifies the ID of the key used to generate
+// the signature, allowing keys to be rotated without trying every key.  If
+// the key ID is included in a request, it must also be included in any
+// options that are signed.
+//
 // See https://github.com/willnorris/imageproxy/blob/master/docs/url-signing.md
 // for examples of generating signatures.
 //
@@ -245,6 +771,10 @@ func (o Options) transform() bool {
 // that have been resized or cropped.  The trim option is applied after any
 // cropping or resizing has been performed.
 //
+// To only trim some edges, append a colon and the edges to trim, using "t"
+// for top, "b" for bottom, "l" for left, and "r" for right.  For example,
+// "trim:tb" trims only the top and bottom edges.
+//
 // Examples
 //
 //	0x0         - no resizing
@@ -253,74 +783,351 @@ func (o Options) transform() bool {
 //	100x150     - 100 by 150 pixels, cropping as needed
 //	100         - 100 pixels square, cropping as needed
 //	150,fit     - scale to fit 150 pixels square, no cropping
+//	150,contain - same as 150,fit
+//	100x150,cover - 100 by 150 pixels, cropping as needed
 //	100,r90     - 100 pixels square, rotated 90 degrees
 //	100,fv,fh   - 100 pixels square, flipped horizontal and vertical
+//	400x,filternearest - 400 pixels wide, using nearest neighbor resampling
 //	200x,q60    - 200 pixels wide, proportional height, 60% quality
+//	200x,autoq0.95 - 200 pixels wide, lowest quality with an SSIM of at least 0.95
+//	200x,subsample444 - 200 pixels wide, without chroma subsampling
 //	200x,png    - 200 pixels wide, converted to PNG format
+//	format:png>jpeg - converted to PNG if smaller, otherwise JPEG if smaller, otherwise unchanged
+//	ico:16:32:48 - ICO image containing 16, 32, and 48 pixel square images
+//	png,progressive - converted to interlaced PNG format
+//	page1,png   - second page of a multi-page TIFF, converted to PNG format
+//	blurhash    - Blurhash placeholder string for the image
+//	color       - dominant color of the image as JSON
+//	metadata    - dimensions and format of the image as JSON
 //	cw100,ch100 - crop image to 100px square, starting at (0,0)
 //	cx10,cy20,cw100,ch200 - crop image starting at (10,20) is 100px wide and 200px tall
+//	ar16x9,200x - crop image to 16:9 aspect ratio, 200 pixels wide
+//	thumb:16x9:face,320x - smart crop image to 16:9 aspect ratio, 320 pixels wide
+//	pixelate10  - pixelate image using 10 pixel blocks
+//	posterize4  - reduce each color channel to 4 levels
+//	threshold50 - convert to black and white at 50% luminance
+//	tint336699  - monochrome image in shades of #336699
+//	trim:lr     - trim solid color borders from the left and right edges
+//	overlay:aHR0cHM6Ly9leGFtcGxlLmNvbS9iYWRnZS5wbmc,g:se,op:80 - overlay https://example.com/badge.png in the bottom right corner at 80% opacity
 func ParseOptions(str string) Options {
+	options, _ := parseOptions(str)
+	return options
+}
+
+// ParseOptionsStrict parses str in the same way as ParseOptions, and also
+// returns an error for each option that is not recognized, has an invalid
+// value, or conflicts with an earlier option.  Options with errors are
+// handled as they are by ParseOptions, so the returned Options are the same.
+func ParseOptionsStrict(str string) (Options, []error) {
+	return parseOptions(str)
+}
+
+// parseOptions parses str as a list of options, returning any errors found.
+func parseOptions(str string) (Options, []error) {
 	var options Options
+	var errs []error
+	seen := make(map[string]string) // option kind => first option of that kind
 
 	for _, opt := range strings.Split(str, ",") {
+		kind := opt   // kind of option, used to detect conflicts
+		valid := true // whether the option value is valid
+
 		switch {
 		case len(opt) == 0: // do nothing
+			continue
 		case opt == optFit:
 			options.Fit = true
+		case opt == optContain:
+			kind = optFit
+			options.Fit = true
+		case opt == optCover:
+			kind = optFit
+			options.Fit = false
+		case opt == optBlurFill:
+			options.BlurFill = true
 		case opt == optFlipVertical:
 			options.FlipVertical = true
 		case opt == optFlipHorizontal:
 			options.FlipHorizontal = true
 		case opt == optScaleUp: // this option is intentionally not documented above
 			options.ScaleUp = true
-		case opt == optFormatJPEG, opt == optFormatPNG, opt == optFormatTIFF:
+		case opt == optAutoFormat: // this option is intentionally not documented above
+			options.AutoFormat = true
+		case opt == optFormatJPEG, opt == optFormatPNG, opt == optFormatTIFF, opt == optFormatBMP, opt == optFormatICO, opt == optFormatBlurhash, opt == optFormatColor, opt == optFormatMetadata:
+			kind = "format"
 			options.Format = opt
+			options.ICOSizes = ""
+		case strings.HasPrefix(opt, optICOSizesPrefix):
+			kind = "format"
+			value := strings.TrimPrefix(opt, optICOSizesPrefix)
+			sizes := parseICOSizes(value)
+			if valid = sizes != ""; valid {
+				options.Format = optFormatICO
+				options.ICOSizes = sizes
+			}
+		case strings.HasPrefix(opt, optFormatFallback):
+			kind = optFormatFallback
+			value := strings.TrimPrefix(opt, optFormatFallback)
+			if valid = validFormatFallback(value); valid {
+				options.FormatFallback = value
+			}
 		case opt == optSmartCrop:
 			options.SmartCrop = true
+		case opt == optSmartCropDebug:
+			options.SmartCropDebug = true
+		case opt == optSmartCropFaces:
+			options.SmartCrop = true
+			options.SmartCropFaces = true
 		case opt == optTrim:
+			kind = optTrim
 			options.Trim = true
+			options.TrimEdges = 0
+		case strings.HasPrefix(opt, optTrimEdgesPrefix):
+			kind = optTrim
+			value := strings.TrimPrefix(opt, optTrimEdgesPrefix)
+			var e Edges
+			if e, valid = parseEdges(value); valid {
+				options.Trim = true
+				options.TrimEdges = e
+			}
+		case opt == optProgressive:
+			options.Progressive = true
+		case opt == optDepth16:
+			options.Depth16 = true
+		case opt == optWatermark:
+			kind = optWatermark
+			options.Watermark = true
+			options.NoWatermark = false
+		case opt == optNoWatermark:
+			kind = optWatermark
+			options.NoWatermark = true
+			options.Watermark = false
+		case strings.HasPrefix(opt, optOverlayPrefix):
+			kind = optOverlayPrefix
+			value := strings.TrimPrefix(opt, optOverlayPrefix)
+			var u string
+			if u, valid = parseOverlayURL(value); valid {
+				options.Overlay = u
+			}
+		case strings.HasPrefix(opt, optOverlayGravity):
+			kind = optOverlayGravity
+			value := strings.TrimPrefix(opt, optOverlayGravity)
+			if _, valid = overlayGravities[value]; valid {
+				options.OverlayGravity = value
+			}
+		case strings.HasPrefix(opt, optOverlayOpacity):
+			kind = optOverlayOpacity
+			value := strings.TrimPrefix(opt, optOverlayOpacity)
+			v, err := strconv.ParseFloat(value, 64)
+			if valid = err == nil && v > 0 && v <= 100; valid {
+				options.OverlayOpacity = v
+			}
+		case strings.HasPrefix(opt, optOverlayScale):
+			kind = optOverlayScale
+			value := strings.TrimPrefix(opt, optOverlayScale)
+			v, err := strconv.ParseFloat(value, 64)
+			if valid = err == nil && v > 0 && v <= 100; valid {
+				options.OverlayScale = v
+			}
+		case strings.HasPrefix(opt, optFilterPrefix):
+			kind = optFilterPrefix
+			value := strings.TrimPrefix(opt, optFilterPrefix)
+			if _, valid = resampleFilters[value]; valid {
+				options.Filter = value
+			}
+		case strings.HasPrefix(opt, optPagePrefix):
+			kind = optPagePrefix
+			value := strings.TrimPrefix(opt, optPagePrefix)
+			v, err := strconv.Atoi(value)
+			if valid = err == nil && v > 0; valid {
+				options.Page = v
+			}
+		case strings.HasPrefix(opt, optPixelatePrefix):
+			kind = optPixelatePrefix
+			value := strings.TrimPrefix(opt, optPixelatePrefix)
+			v, err := strconv.Atoi(value)
+			if valid = err == nil && v > 1 && v <= 10000; valid {
+				options.Pixelate = v
+			}
+		case strings.HasPrefix(opt, optPosterizePrefix):
+			kind = optPosterizePrefix
+			value := strings.TrimPrefix(opt, optPosterizePrefix)
+			v, err := strconv.Atoi(value)
+			if valid = err == nil && v > 1; valid {
+				options.Posterize = v
+			}
+		case strings.HasPrefix(opt, optAutoQuality):
+			kind = optAutoQuality
+			value := strings.TrimPrefix(opt, optAutoQuality)
+			v, err := strconv.ParseFloat(value, 64)
+			if valid = err == nil && v > 0 && v < 1; valid {
+				options.AutoQuality = v
+			}
+		case strings.HasPrefix(opt, optSubsamplePrefix):
+			kind = optSubsamplePrefix
+			value := strings.TrimPrefix(opt, optSubsamplePrefix)
+			if valid = value == "444" || value == "422" || value == "420"; valid {
+				options.ChromaSubsampling = value
+			}
+		case strings.HasPrefix(opt, optThresholdPrefix):
+			kind = optThresholdPrefix
+			value := strings.TrimPrefix(opt, optThresholdPrefix)
+			v, err := strconv.ParseFloat(value, 64)
+			if valid = err == nil && v > 0 && v <= 100; valid {
+				options.Threshold = v
+			}
+		case strings.HasPrefix(opt, optTintPrefix):
+			kind = optTintPrefix
+			value := strings.TrimPrefix(opt, optTintPrefix)
+			var c color.NRGBA
+			if c, valid = parseHexColor(value); valid {
+				options.Tint = c
+			}
 		case strings.HasPrefix(opt, optRotatePrefix):
+			kind = optRotatePrefix
 			value := strings.TrimPrefix(opt, optRotatePrefix)
-			options.Rotate, _ = strconv.Atoi(value)
+			var err error
+			options.Rotate, err = strconv.Atoi(value)
+			valid = err == nil
 		case strings.HasPrefix(opt, optQualityPrefix):
+			kind = optQualityPrefix
 			value := strings.TrimPrefix(opt, optQualityPrefix)
-			options.Quality, _ = strconv.Atoi(value)
+			var err error
+			options.Quality, err = strconv.Atoi(value)
+			valid = err == nil
 		case strings.HasPrefix(opt, optSignaturePrefix):
+			kind = optSignaturePrefix
 			options.Signature = strings.TrimPrefix(opt, optSignaturePrefix)
+		case strings.HasPrefix(opt, optKeyIDPrefix):
+			kind = optKeyIDPrefix
+			options.KeyID = strings.TrimPrefix(opt, optKeyIDPrefix)
 		case strings.HasPrefix(opt, optCropX):
+			kind = optCropX
 			value := strings.TrimPrefix(opt, optCropX)
-			options.CropX, _ = strconv.ParseFloat(value, 64)
+			var err error
+			options.CropX, err = strconv.ParseFloat(value, 64)
+			valid = err == nil
 		case strings.HasPrefix(opt, optCropY):
+			kind = optCropY
 			value := strings.TrimPrefix(opt, optCropY)
-			options.CropY, _ = strconv.ParseFloat(value, 64)
+			var err error
+			options.CropY, err = strconv.ParseFloat(value, 64)
+			valid = err == nil
 		case strings.HasPrefix(opt, optCropWidth):
+			kind = optCropWidth
 			value := strings.TrimPrefix(opt, optCropWidth)
-			options.CropWidth, _ = strconv.ParseFloat(value, 64)
+			var err error
+			options.CropWidth, err = strconv.ParseFloat(value, 64)
+			valid = err == nil
 		case strings.HasPrefix(opt, optCropHeight):
+			kind = optCropHeight
 			value := strings.TrimPrefix(opt, optCropHeight)
-			options.CropHeight, _ = strconv.ParseFloat(value, 64)
+			var err error
+			options.CropHeight, err = strconv.ParseFloat(value, 64)
+			valid = err == nil
 		case strings.HasPrefix(opt, optValidUntil):
+			kind = optValidUntil
 			value := strings.TrimPrefix(opt, optValidUntil)
-			if v, _ := strconv.ParseInt(value, 10, 64); v > 0 {
+			v, err := strconv.ParseInt(value, 10, 64)
+			if valid = err == nil && v > 0; valid {
 				options.ValidUntil = time.Unix(v, 0)
 			}
+		case strings.HasPrefix(opt, optThumbPrefix):
+			kind = optAspectRatio
+			value := strings.TrimPrefix(opt, optThumbPrefix)
+			value, gravity, _ := strings.Cut(value, ":")
+			var ratio AspectRatio
+			if ratio, valid = parseAspectRatio(value); !valid {
+				break
+			}
+			switch gravity {
+			case "", "face":
+				options.AspectRatio = ratio
+				options.SmartCrop = true
+				options.SmartCropFaces = true
+			case "smart":
+				options.AspectRatio = ratio
+				options.SmartCrop = true
+				options.SmartCropFaces = false
+			case "center":
+				options.AspectRatio = ratio
+				options.SmartCrop = false
+				options.SmartCropFaces = false
+			default:
+				valid = false
+			}
+		case strings.HasPrefix(opt, optAspectRatio):
+			kind = optAspectRatio
+			value := strings.TrimPrefix(opt, optAspectRatio)
+			var ratio AspectRatio
+			if ratio, valid = parseAspectRatio(value); valid {
+				options.AspectRatio = ratio
+			}
 		case strings.Contains(opt, optSizeDelimiter):
+			kind = optSizeDelimiter
 			size := strings.SplitN(opt, optSizeDelimiter, 2)
+			var err error
 			if w := size[0]; w != "" {
-				options.Width, _ = strconv.ParseFloat(w, 64)
+				if options.Width, err = strconv.ParseFloat(w, 64); err != nil {
+					valid = false
+				}
 			}
 			if h := size[1]; h != "" {
-				options.Height, _ = strconv.ParseFloat(h, 64)
+				if options.Height, err = strconv.ParseFloat(h, 64); err != nil {
+					valid = false
+				}
 			}
 		default:
-			if size, err := strconv.ParseFloat(opt, 64); err == nil {
-				options.Width = size
-				options.Height = size
+			kind = optSizeDelimiter
+			size, err := strconv.ParseFloat(opt, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("unrecognized option %q", opt))
+				continue
 			}
+			options.Width = size
+			options.Height = size
+		}
+
+		if !valid {
+			errs = append(errs, fmt.Errorf("invalid option %q", opt))
+		}
+		if prev, ok := seen[kind]; ok && prev != opt {
+			errs = append(errs, fmt.Errorf("option %q conflicts with %q", opt, prev))
+		} else if !ok {
+			seen[kind] = opt
 		}
 	}
 
-	return options
+	return options, errs
+}
+
+// parseAspectRatio parses an aspect ratio in the form "{width}x{height}".
+func parseAspectRatio(s string) (AspectRatio, bool) {
+	ratio := strings.SplitN(s, optSizeDelimiter, 2)
+	if len(ratio) != 2 {
+		return AspectRatio{}, false
+	}
+	w, _ := strconv.ParseFloat(ratio[0], 64)
+	h, _ := strconv.ParseFloat(ratio[1], 64)
+	if w <= 0 || h <= 0 {
+		return AspectRatio{}, false
+	}
+	return AspectRatio{w, h}, true
+}
+
+// parseHexColor parses a color in the form "rrggbb" or "rgb".
+func parseHexColor(s string) (color.NRGBA, bool) {
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	if len(s) != 6 {
+		return color.NRGBA{}, false
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, false
+	}
+	return color.NRGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 255}, true
 }
 
 // Request is an imageproxy request which includes a remote URL of an image to
@@ -329,6 +1136,13 @@ type Request struct {
 	URL      *url.URL      // URL of the image to proxy
 	Options  Options       // Image transformation to perform
 	Original *http.Request // The original HTTP request
+
+	optionErrors []error // errors parsing Options, see ParseOptionsStrict
+
+	// userinfo holds any credentials included in the remote URL, which
+	// are removed from URL so they don't appear in logs or cache keys.
+	// See Proxy.URLUserinfo.
+	userinfo *url.Userinfo
 }
 
 // String returns the request URL as a string, with r.Options encoded in the
@@ -353,13 +1167,18 @@ func (r Request) String() string {
 //
 // When percent-encoding is used, the full URL must be encoded.
 // Any query string on the proxy URL is NOT included as part of the remote URL.
-// Percent-encoded URLs must be absolute URLs;
-// they cannot be relative URLs used with a default base URL.
+// Percent-encoded URLs may be relative URLs used with a default base URL.
 //
 // When base64 encoding is used, the full URL must be encoded.
 // Any query string on the proxy URL is NOT included as part of the remote URL.
 // Base64 encoded URLs may be relative URLs used with a default base URL.
 //
+// Relative URLs, in any encoding, must be preceded by an options segment,
+// which may be "x" if no options are needed.
+//
+// The options segment may itself be base64 encoded (URL safe), prefixed with
+// "b64:", for options containing characters that may be altered in transit.
+//
 // Assuming an imageproxy server running on localhost, the following are all
 // valid imageproxy requests:
 //
@@ -369,6 +1188,13 @@ func (r Request) String() string {
 //	http://localhost/http://example.com/image.jpg
 //	http://localhost/x/http%3A%2F%2Fexample.com%2Fimage.jpg
 //	http://localhost/100x200/aHR0cDovL2V4YW1wbGUuY29tL2ltYWdlLmpwZw
+//	http://localhost/b64:MTAweDIwMCxyOTA/http://example.com/image.jpg
+//
+// If a default base URL of http://example.com/ is provided, the following
+// are also valid:
+//
+//	http://localhost/100x200/images/image.jpg
+//	http://localhost/x/%2Fimages%2Fimage.jpg
 func NewRequest(r *http.Request, baseURL *url.URL) (*Request, error) {
 	var err error
 	req := &Request{Original: r}
@@ -376,7 +1202,8 @@ func NewRequest(r *http.Request, baseURL *url.URL) (*Request, error) {
 
 	path := r.URL.EscapedPath()[1:] // strip leading slash
 	req.URL, enc, err = parseURL(path, baseURL)
-	if err != nil || !req.URL.IsAbs() {
+	// options containing a colon, such as "ico:16:32", parse as an opaque URL
+	if err != nil || !req.URL.IsAbs() || req.URL.Opaque != "" {
 		// first segment should be options
 		parts := strings.SplitN(path, "/", 2)
 		if len(parts) != 2 {
@@ -389,7 +1216,20 @@ func NewRequest(r *http.Request, baseURL *url.URL) (*Request, error) {
 			return nil, URLError{fmt.Sprintf("unable to parse remote URL: %v", err), r.URL}
 		}
 
-		req.Options = ParseOptions(parts[0])
+		// options such as "format:png>jpeg" contain characters that
+		// are escaped in the request path.
+		opts := parts[0]
+		if s, err := url.PathUnescape(opts); err == nil {
+			opts = s
+		}
+		if s, ok := strings.CutPrefix(opts, optionsBase64Prefix); ok {
+			b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+			if err != nil {
+				return nil, URLError{fmt.Sprintf("unable to decode base64 options: %v", err), r.URL}
+			}
+			opts = string(b)
+		}
+		req.Options, req.optionErrors = parseOptions(opts)
 	}
 
 	if baseURL != nil {
@@ -409,12 +1249,22 @@ func NewRequest(r *http.Request, baseURL *url.URL) (*Request, error) {
 		// then the query string is part of the remote URL
 		req.URL.RawQuery = r.URL.RawQuery
 	}
+	req.userinfo, req.URL.User = req.URL.User, nil
 	return req, nil
 }
 
+// optionsBase64Prefix is the prefix of a base64 encoded options segment.
+const optionsBase64Prefix = "b64:"
+
 var reCleanedURL = regexp.MustCompile(`^(https?):/+([^/])`)
 var reIsEncodedURL = regexp.MustCompile(`^(?i)https?%3A%2F`)
 
+// isEncodedRelativeURL returns whether s looks like a URL encoded relative
+// URL such as "%2Fimages%2Ffoo.jpg".
+func isEncodedRelativeURL(s string) bool {
+	return !strings.Contains(s, "/") && strings.Contains(strings.ToUpper(s), "%2F")
+}
+
 // parseURL parses s as a URL, handling URLs that have been munged by
 // path.Clean or a webserver that collapses multiple slashes.
 // The returned enc bool indicates whether the remote URL was encoded.
@@ -437,7 +1287,9 @@ func parseURL(s string, baseURL *url.URL) (_ *url.URL, enc bool, _ error) {
 	}
 
 	// If the string looks like a URL encoded absolute HTTP(S) URL, decode it.
-	if reIsEncodedURL.MatchString(s) {
+	// If we have a baseURL, also decode URL encoded relative URLs, which
+	// contain an encoded slash but no unencoded ones.
+	if reIsEncodedURL.MatchString(s) || baseURL != nil && isEncodedRelativeURL(s) {
 		if u, err := url.PathUnescape(s); err == nil {
 			enc = true
 			s = u
@@ -0,0 +1,111 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"container/list"
+	"image"
+	"sync"
+)
+
+// decodeCache is an in-memory LRU cache of decoded images, allowing requests
+// for different transformations of the same remote image to share the cost
+// of decoding it.  The cache is bounded by the approximate memory used by the
+// decoded pixels.
+type decodeCache struct {
+	maxSize int64 // maximum total size of cached images, in bytes
+
+	mu      sync.Mutex
+	size    int64                    // total size of cached images
+	entries map[string]*list.Element // cache entries, keyed by decodeKey
+	lru     *list.List               // entries, most recently used first
+
+	hits, misses int // lookup counts, for testing
+}
+
+// decodedImage is a cached decoded image.
+type decodedImage struct {
+	key    string
+	m      image.Image
+	format string
+	size   int64
+}
+
+func newDecodeCache(maxSize int64) *decodeCache {
+	return &decodeCache{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the decoded image and format cached for key.  The returned
+// image is shared, so must not be modified.
+func (c *decodeCache) get(key string) (m image.Image, format string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, "", false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	d := e.Value.(*decodedImage)
+	return d.m, d.format, true
+}
+
+// add caches the decoded image m for key, evicting the least recently used
+// images if needed to stay within the cache's maximum size.  Images larger
+// than the maximum size are not cached.
+func (c *decodeCache) add(key string, m image.Image, format string) {
+	size := decodedSize(m)
+	if size > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	for c.size+size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(&decodedImage{key: key, m: m, format: format, size: size})
+	c.size += size
+}
+
+// remove removes the cache entry e.  c.mu must be held.
+func (c *decodeCache) remove(e *list.Element) {
+	d := c.lru.Remove(e).(*decodedImage)
+	delete(c.entries, d.key)
+	c.size -= d.size
+}
+
+// decodedSize returns the approximate number of bytes used by the pixels of m.
+func decodedSize(m image.Image) int64 {
+	switch m := m.(type) {
+	case *image.NRGBA:
+		return int64(len(m.Pix))
+	case *image.RGBA:
+		return int64(len(m.Pix))
+	case *image.NRGBA64:
+		return int64(len(m.Pix))
+	case *image.RGBA64:
+		return int64(len(m.Pix))
+	case *image.Gray:
+		return int64(len(m.Pix))
+	case *image.Gray16:
+		return int64(len(m.Pix))
+	case *image.Paletted:
+		return int64(len(m.Pix) + 4*len(m.Palette))
+	case *image.YCbCr:
+		return int64(len(m.Y) + len(m.Cb) + len(m.Cr))
+	case *image.CMYK:
+		return int64(len(m.Pix))
+	}
+	b := m.Bounds()
+	return int64(b.Dx()) * int64(b.Dy()) * 4
+}
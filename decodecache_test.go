@@ -0,0 +1,78 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDecodeCache(t *testing.T) {
+	small := image.NewNRGBA(image.Rect(0, 0, 2, 2)) // 16 bytes
+	large := image.NewNRGBA(image.Rect(0, 0, 4, 4)) // 64 bytes
+
+	c := newDecodeCache(40)
+	c.add("a", small, "png")
+	c.add("b", small, "jpeg")
+	if m, format, ok := c.get("a"); !ok || m != small || format != "png" {
+		t.Errorf("get(a) returned %v, %q, %t, want cached png", m, format, ok)
+	}
+
+	// adding a third image evicts the least recently used
+	c.add("c", small, "gif")
+	if _, _, ok := c.get("b"); ok {
+		t.Errorf("get(b) returned cached image, want evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, _, ok := c.get(key); !ok {
+			t.Errorf("get(%s) returned no image, want cached", key)
+		}
+	}
+
+	// images larger than the cache are not cached
+	c.add("d", large, "png")
+	if _, _, ok := c.get("d"); ok {
+		t.Errorf("get(d) returned cached image larger than cache")
+	}
+	if got, want := c.size, int64(32); got != want {
+		t.Errorf("cache size is %d, want %d", got, want)
+	}
+}
+
+func TestProxy_ServeHTTP_decodeCache(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, newImage(40, 20, red)); err != nil {
+		t.Fatalf("error encoding source image: %v", err)
+	}
+
+	p := NewProxy(&bodyTransport{body: buf.Bytes(), etag: true}, nil)
+	p.DecodeCacheSize = 1 << 20
+
+	for _, u := range []string{"/20x/http://good.test/img", "/10x/http://good.test/img"} {
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, httptest.NewRequest("GET", "http://localhost"+u, nil))
+		if got, want := resp.Code, http.StatusOK; got != want {
+			t.Fatalf("ServeHTTP(%v) returned status %d, want %d", u, got, want)
+		}
+		m, err := png.Decode(resp.Body)
+		if err != nil {
+			t.Fatalf("ServeHTTP(%v) returned invalid png: %v", u, err)
+		}
+		if got, want := m.Bounds().Dy()*2, m.Bounds().Dx(); got != want {
+			t.Errorf("ServeHTTP(%v) returned image of size %v", u, m.Bounds().Size())
+		}
+	}
+
+	// the source image was only decoded once
+	if got, want := p.decodeCache.misses, 1; got != want {
+		t.Errorf("decode cache misses = %d, want %d", got, want)
+	}
+	if got, want := p.decodeCache.hits, 1; got != want {
+		t.Errorf("decode cache hits = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// preserveDepth returns whether m is a 16-bit image whose depth can be
+// preserved while applying the transformations in opt.  Only crops,
+// rotations, and flips are supported, since they don't change pixel values.
+func preserveDepth(m image.Image, opt Options) bool {
+	if !opt.Depth16 {
+		return false
+	}
+	switch m.(type) {
+	case *image.Gray16, *image.RGBA64, *image.NRGBA64:
+	default:
+		return false
+	}
+	if opt.Trim || opt.SmartCropDebug || opt.Progressive || opt.Pixelate > 1 || opt.Posterize > 1 || opt.Threshold > 0 || opt.Tint != nil ||
+		opt.overlay != nil || opt.watermark != nil || opt.textWatermark != nil {
+		return false
+	}
+	_, _, resize := resizeParams(m, opt)
+	return !resize
+}
+
+// transformImage16 is like transformImage, but preserves the type, and
+// therefore depth, of the 16-bit image m.  It must only be called if
+// preserveDepth(m, opt) is true.
+func transformImage16(m image.Image, opt Options) image.Image {
+	timer := prometheus.NewTimer(metricTransformationDuration)
+	defer timer.ObserveDuration()
+
+	type subImager interface {
+		SubImage(r image.Rectangle) image.Image
+	}
+
+	// crop
+	m = m.(subImager).SubImage(cropParams(m, opt))
+	m = m.(subImager).SubImage(aspectRatioParams(m, opt))
+
+	// rotate counter-clockwise, as imaging.Rotate90 and friends do
+	w, h := m.Bounds().Dx(), m.Bounds().Dy()
+	rotate := float64(opt.Rotate) - math.Floor(float64(opt.Rotate)/360)*360
+	switch rotate {
+	case 90:
+		m = remap16(m, h, w, func(x, y int) (int, int) { return w - 1 - y, x })
+	case 180:
+		m = remap16(m, w, h, func(x, y int) (int, int) { return w - 1 - x, h - 1 - y })
+	case 270:
+		m = remap16(m, h, w, func(x, y int) (int, int) { return y, h - 1 - x })
+	}
+
+	// flip
+	w, h = m.Bounds().Dx(), m.Bounds().Dy()
+	if opt.FlipVertical {
+		m = remap16(m, w, h, func(x, y int) (int, int) { return x, h - 1 - y })
+	}
+	if opt.FlipHorizontal {
+		m = remap16(m, w, h, func(x, y int) (int, int) { return w - 1 - x, y })
+	}
+
+	return m
+}
+
+// remap16 returns a new w by h image of the same type as the 16-bit image
+// m, with each pixel copied from the point in m returned by src.  Points
+// are relative to the top left corner of each image.
+func remap16(m image.Image, w, h int, src func(x, y int) (int, int)) image.Image {
+	r := image.Rect(0, 0, w, h)
+	var dst draw.Image
+	switch m.(type) {
+	case *image.Gray16:
+		dst = image.NewGray16(r)
+	case *image.RGBA64:
+		dst = image.NewRGBA64(r)
+	default:
+		dst = image.NewNRGBA64(r)
+	}
+
+	origin := m.Bounds().Min
+	for y := range h {
+		for x := range w {
+			sx, sy := src(x, y)
+			dst.Set(x, y, m.At(origin.X+sx, origin.Y+sy))
+		}
+	}
+	return dst
+}
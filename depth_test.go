@@ -0,0 +1,118 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+// gray16Image returns a 16-bit grayscale image whose pixels all have
+// different values, with low bytes that differ from their high bytes.
+func gray16Image(w, h int) *image.Gray16 {
+	m := image.NewGray16(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			m.SetGray16(x, y, color.Gray16{Y: uint16(0x1001*x + 0x2f3*y + 0x17)})
+		}
+	}
+	return m
+}
+
+func TestTransform_Depth16(t *testing.T) {
+	src := gray16Image(12, 7)
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, src); err != nil {
+		t.Fatalf("error encoding source image: %v", err)
+	}
+
+	tests := []Options{
+		{Format: "png"},
+		{CropX: 2, CropY: 1, CropWidth: 8, CropHeight: 5},
+		{Rotate: 90},
+		{Rotate: 180},
+		{Rotate: 270, FlipHorizontal: true},
+		{FlipVertical: true, CropWidth: 5},
+		{AspectRatio: AspectRatio{1, 1}},
+		{Format: "tiff", Rotate: 90, FlipVertical: true},
+	}
+
+	for _, opt := range tests {
+		opt.Depth16 = true
+		b, err := Transform(buf.Bytes(), opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", opt, err)
+			continue
+		}
+		got, _, err := image.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("Transform(%v) returned invalid image: %v", opt, err)
+			continue
+		}
+		g, ok := got.(*image.Gray16)
+		if !ok {
+			t.Errorf("Transform(%v) returned %T, want *image.Gray16", opt, got)
+			continue
+		}
+
+		// the same transformation with 8 bits per channel should differ
+		// only in precision.
+		opt.Depth16 = false
+		m := transformImage(src, opt)
+		if !g.Bounds().Size().Eq(m.Bounds().Size()) {
+			t.Errorf("Transform(%v) returned size %v, want %v", opt, g.Bounds().Size(), m.Bounds().Size())
+			continue
+		}
+		lossless := false
+		for y := range m.Bounds().Dy() {
+			for x := range m.Bounds().Dx() {
+				v := g.Gray16At(x, y).Y
+				want := color.GrayModel.Convert(m.At(x, y)).(color.Gray).Y
+				if uint8(v>>8) != want {
+					t.Fatalf("Transform(%v) pixel (%d, %d) is %#04x, want high byte %#02x", opt, x, y, v, want)
+				}
+				if uint8(v) != uint8(v>>8) {
+					lossless = true
+				}
+			}
+		}
+		if !lossless {
+			t.Errorf("Transform(%v) lost precision of 16-bit image", opt)
+		}
+	}
+}
+
+func TestTransform_Depth16Fallback(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := tiff.Encode(buf, gray16Image(12, 7), nil); err != nil {
+		t.Fatalf("error encoding source image: %v", err)
+	}
+
+	// resizing and color changes always use 8 bits per channel
+	for _, opt := range []Options{
+		{Depth16: true, Format: "png", Width: 6},
+		{Depth16: true, Format: "png", Posterize: 4},
+		{Depth16: true, Format: "png", Progressive: true},
+		{Format: "png", Rotate: 90},
+	} {
+		b, err := Transform(buf.Bytes(), opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", opt, err)
+			continue
+		}
+		got, err := png.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("Transform(%v) returned invalid image: %v", opt, err)
+			continue
+		}
+		if _, ok := got.(*image.Gray16); ok {
+			t.Errorf("Transform(%v) returned 16-bit image, want 8-bit", opt)
+		}
+	}
+}
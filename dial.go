@@ -0,0 +1,140 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// errDeniedNetwork is returned when dialing a remote address in a denied
+// network.
+var errDeniedNetwork = errors.New("remote address is in a denied network")
+
+// restrictsNetworks returns whether remote connections are restricted by
+// DenyPrivateNetworks or DenyNetworks.
+func (p *Proxy) restrictsNetworks() bool {
+	return p.DenyPrivateNetworks || len(p.DenyNetworks) > 0
+}
+
+// deniedAddr returns whether connections to addr are denied.
+func (p *Proxy) deniedAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if p.DenyPrivateNetworks && isPrivateAddr(addr) {
+		return true
+	}
+	for _, n := range p.DenyNetworks {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivateAddr returns whether addr is a private, loopback, link-local, or
+// unspecified address.
+func isPrivateAddr(addr netip.Addr) bool {
+	return addr.IsPrivate() || addr.IsLoopback() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsUnspecified()
+}
+
+// checkAddrs returns an error if any of the addresses host resolved to are
+// denied.
+func (p *Proxy) checkAddrs(host string, addrs []netip.Addr) error {
+	for _, addr := range addrs {
+		if !p.deniedAddr(addr) {
+			continue
+		}
+		if addr = addr.Unmap(); addr.String() == host {
+			return fmt.Errorf("%w: %s", errDeniedNetwork, addr)
+		}
+		return fmt.Errorf("%w: %s resolves to %s", errDeniedNetwork, host, addr)
+	}
+	return nil
+}
+
+// checkDial resolves the host of the "host:port" address and returns an
+// error if any of its addresses are denied.
+func (p *Proxy) checkDial(ctx context.Context, address string) error {
+	if !p.restrictsNetworks() {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return p.checkAddrs(host, []netip.Addr{addr})
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	return p.checkAddrs(host, addrs)
+}
+
+// restrictDialer updates t to reject connections to networks denied by
+// DenyPrivateNetworks or DenyNetworks.  Every address a host resolves to is
+// checked before dialing, and the address actually connected to is checked
+// again to guard against DNS rebinding.  Because redirects are fetched using
+// the same transport, they are restricted as well.
+func (p *Proxy) restrictDialer(t *http.Transport) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if !p.restrictsNetworks() {
+				return nil
+			}
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			return p.checkAddrs(addr.Addr().String(), []netip.Addr{addr.Addr()})
+		},
+	}
+	p.dialer = dialer
+	t.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if err := p.checkDial(ctx, address); err != nil {
+			return nil, err
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	// the default transport dials its own TLS connections to complete
+	// certificate chains that are missing intermediates, but doesn't
+	// negotiate HTTP/2.  Instead, TLS connections are dialed using the
+	// restricted dialer, negotiating HTTP/2 if the remote server supports
+	// it, and the default transport is only used if the certificate chain
+	// can't otherwise be verified.  Its connections can only be checked
+	// before dialing.
+	if dialTLS := t.DialTLS; dialTLS != nil {
+		t.DialTLS = nil
+		t.DialTLSContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			if err := p.checkDial(ctx, address); err != nil {
+				return nil, err
+			}
+			config := new(tls.Config)
+			if t.TLSClientConfig != nil {
+				config = t.TLSClientConfig.Clone()
+			}
+			config.NextProtos = []string{"h2", "http/1.1"}
+			conn, err := (&tls.Dialer{NetDialer: dialer, Config: config}).DialContext(ctx, network, address)
+			if errors.As(err, new(x509.UnknownAuthorityError)) {
+				return dialTLS(network, address)
+			}
+			return conn, err
+		}
+	}
+	t.ForceAttemptHTTP2 = true
+}
@@ -0,0 +1,198 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"crypto/x509"
+	"errors"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestProxy_deniedAddr(t *testing.T) {
+	p := &Proxy{
+		DenyPrivateNetworks: true,
+		DenyNetworks:        []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")},
+	}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"0.0.0.0", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"203.0.113.10", true},
+		{"203.0.114.10", false},
+	}
+
+	for _, tt := range tests {
+		if got := p.deniedAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("deniedAddr(%q) returned %t, want %t", tt.addr, got, tt.want)
+		}
+	}
+
+	// only private networks
+	p = &Proxy{DenyPrivateNetworks: true}
+	if p.deniedAddr(netip.MustParseAddr("203.0.113.10")) {
+		t.Errorf("deniedAddr(203.0.113.10) returned true with no DenyNetworks")
+	}
+
+	// only configured networks
+	p = &Proxy{DenyNetworks: []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}}
+	if p.deniedAddr(netip.MustParseAddr("127.0.0.1")) {
+		t.Errorf("deniedAddr(127.0.0.1) returned true without DenyPrivateNetworks")
+	}
+}
+
+func TestProxy_checkAddrs(t *testing.T) {
+	p := &Proxy{DenyPrivateNetworks: true}
+
+	public := netip.MustParseAddr("8.8.8.8")
+	private := netip.MustParseAddr("10.0.0.1")
+
+	if err := p.checkAddrs("example.com", []netip.Addr{public}); err != nil {
+		t.Errorf("checkAddrs with public address returned unexpected error: %v", err)
+	}
+	// all addresses are checked, not just the first
+	if err := p.checkAddrs("example.com", []netip.Addr{public, private}); !errors.Is(err, errDeniedNetwork) {
+		t.Errorf("checkAddrs with private address returned %v, want %v", err, errDeniedNetwork)
+	}
+}
+
+func TestProxy_ServeHTTP_denyPrivateNetworks(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			// redirect to another loopback address, on the same port
+			u, _ := url.Parse("http://" + r.Host + "/image")
+			u.Host = "127.0.0.2:" + u.Port()
+			http.Redirect(w, r, u.String(), http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, newImage(1, 1, red))
+	}))
+	defer origin.Close()
+	u, _ := url.Parse(origin.URL)
+	port := u.Port()
+
+	tests := []struct {
+		url          string // remote URL
+		denyPrivate  bool   // whether DenyPrivateNetworks is set
+		denyNetworks string // network added to DenyNetworks
+		code         int    // expected response status code
+	}{
+		{"http://localhost:" + port + "/image", false, "", http.StatusOK},
+		{"http://localhost:" + port + "/image", true, "", http.StatusForbidden},
+		{"http://127.0.0.1:" + port + "/image", true, "", http.StatusForbidden},
+		{"http://127.0.0.1:" + port + "/image", false, "127.0.0.0/8", http.StatusForbidden},
+		{"http://127.0.0.1:" + port + "/redirect", false, "127.0.0.2/32", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		p := NewProxy(nil, nil)
+		p.FollowRedirects = true
+		p.MaxRetries = -1
+		p.DenyPrivateNetworks = tt.denyPrivate
+		if tt.denyNetworks != "" {
+			p.DenyNetworks = []netip.Prefix{netip.MustParsePrefix(tt.denyNetworks)}
+		}
+
+		req := httptest.NewRequest("GET", "/"+tt.url, nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("ServeHTTP(%q) with denyPrivate=%t, denyNetworks=%q returned status %d, want %d", tt.url, tt.denyPrivate, tt.denyNetworks, got, want)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_http2(t *testing.T) {
+	var proto string
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto = r.Proto
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, newImage(1, 1, red))
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	defer origin.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(origin.Certificate())
+
+	p := NewProxy(nil, nil)
+	p.MaxRetries = -1
+	p.MaxIdleConnsPerHost = 8
+	p.MaxConnsPerHost = 4
+	p.transport.TLSClientConfig.RootCAs = roots
+
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, httptest.NewRequest("GET", "/"+origin.URL+"/image", nil))
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Fatalf("ServeHTTP returned status %d, want %d: %s", got, want, resp.Body)
+	}
+	if got, want := proto, "HTTP/2.0"; got != want {
+		t.Errorf("remote request used protocol %q, want %q", got, want)
+	}
+	if got, want := p.transport.MaxIdleConnsPerHost, 8; got != want {
+		t.Errorf("transport MaxIdleConnsPerHost is %d, want %d", got, want)
+	}
+	if got, want := p.transport.MaxConnsPerHost, 4; got != want {
+		t.Errorf("transport MaxConnsPerHost is %d, want %d", got, want)
+	}
+
+	// TLS connections are restricted too
+	p = NewProxy(nil, nil)
+	p.MaxRetries = -1
+	p.DenyPrivateNetworks = true
+	p.transport.TLSClientConfig.RootCAs = roots
+	resp = httptest.NewRecorder()
+	p.ServeHTTP(resp, httptest.NewRequest("GET", "/"+origin.URL+"/image", nil))
+	if got, want := resp.Code, http.StatusForbidden; got != want {
+		t.Errorf("ServeHTTP with DenyPrivateNetworks returned status %d, want %d", got, want)
+	}
+}
+
+func TestProxy_ServeHTTP_dialTimeout(t *testing.T) {
+	p := NewProxy(nil, nil)
+	p.MaxRetries = -1
+	p.DialTimeout = 100 * time.Millisecond
+	p.KeepAlive = -1
+
+	// 10.255.255.1 is not routable, so connections hang until timing out
+	start := time.Now()
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, httptest.NewRequest("GET", "/http://10.255.255.1/image", nil))
+	elapsed := time.Since(start)
+
+	if resp.Code == http.StatusOK {
+		t.Errorf("ServeHTTP returned status %d, want error", resp.Code)
+	}
+	if elapsed > 5*time.Second {
+		t.Errorf("ServeHTTP took %v, want dial to time out after %v", elapsed, p.DialTimeout)
+	}
+	if got, want := p.dialer.Timeout, 100*time.Millisecond; got != want {
+		t.Errorf("dialer Timeout is %v, want %v", got, want)
+	}
+	if got, want := p.dialer.KeepAlive, time.Duration(-1); got != want {
+		t.Errorf("dialer KeepAlive is %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// explainPath is the path prefix of the endpoint used to describe how an
+// image request would be handled.
+const explainPath = "/explain"
+
+// explanation describes how the proxy would handle an image request.
+type explanation struct {
+	// URL is the remote image URL, without any credentials.
+	URL string `json:"url"`
+
+	// Options are the transformation options, after the proxy's static
+	// settings are applied.
+	Options Options `json:"options"`
+
+	// Canonical is the canonical string form of Options, as used in
+	// cache keys.
+	Canonical string `json:"canonical"`
+
+	// OptionErrors are any errors parsing the requested options.
+	OptionErrors []string `json:"optionErrors,omitempty"`
+
+	// Allowed is whether the request would be allowed, and Reason
+	// explains why if it would not.
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// serveExplain handles requests to describe how an image request would be
+// handled, without fetching the remote image.  The request is the image URL
+// prefixed with /explain:
+//
+//	GET /explain/100x150,q80/http://example.com/image.jpg
+func (p *Proxy) serveExplain(w http.ResponseWriter, r *http.Request) {
+	var req *Request
+	var err error
+	http.StripPrefix(explainPath, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		req, err = NewRequest(r, p.DefaultBaseURL)
+	})).ServeHTTP(w, r)
+	if err != nil {
+		msg := fmt.Sprintf("invalid request URL: %v", err)
+		p.log(r.Context(), msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	e := explanation{URL: req.URL.String(), Allowed: true}
+	for _, err := range req.optionErrors {
+		e.OptionErrors = append(e.OptionErrors, err.Error())
+	}
+	if err := p.checkRequest(req); err != nil {
+		e.Allowed = false
+		e.Reason = err.Error()
+	}
+	p.applySettings(&req.Options)
+	e.Options = req.Options
+	e.Canonical = req.Options.String()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(e)
+}
+
+// checkRequest returns an error if req is not allowed to be served.  Errors
+// for malformed requests, rather than requests that are not allowed, are
+// invalidRequestErrors.
+func (p *Proxy) checkRequest(req *Request) error {
+	if req.userinfo != nil && p.URLUserinfo == UserinfoReject {
+		return invalidRequestError{errors.New("remote URL must not include credentials")}
+	}
+	if p.StrictOptions && len(req.optionErrors) > 0 {
+		return invalidRequestError{fmt.Errorf("invalid options: %w", errors.Join(req.optionErrors...))}
+	}
+	if err := p.allowed(req); err != nil {
+		return err
+	}
+	if err := p.allowedOverlay(req); err != nil {
+		return fmt.Errorf("%w: overlay %s", err, req.Options.Overlay)
+	}
+	if err := p.allowedFormat(req.Options); err != nil {
+		return invalidRequestError{err}
+	}
+	return nil
+}
+
+// invalidRequestError is returned by checkRequest for malformed requests,
+// which are rejected with a 400 Bad Request response.
+type invalidRequestError struct {
+	error
+}
+
+func (e invalidRequestError) Unwrap() error { return e.error }
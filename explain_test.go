@@ -0,0 +1,88 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestProxy_ServeHTTP_explain(t *testing.T) {
+	tr := new(headerTransport)
+	p := NewProxy(tr, nil)
+	p.AllowHosts = []string{"good.test"}
+	p.AllowedFormats = []string{"png"}
+
+	tests := []struct {
+		url  string
+		code int
+		want explanation
+	}{
+		{
+			"/explain/100x200,q80/http://good.test/png", http.StatusOK,
+			explanation{
+				URL:       "http://good.test/png",
+				Options:   Options{Width: 100, Height: 200, Quality: 80},
+				Canonical: "100x200,q80",
+				Allowed:   true,
+			},
+		},
+		{
+			"/explain/contain,150,foo/http://good.test/png", http.StatusOK,
+			explanation{
+				URL:          "http://good.test/png",
+				Options:      Options{Width: 150, Height: 150, Fit: true},
+				Canonical:    "150x150,fit",
+				OptionErrors: []string{`unrecognized option "foo"`},
+				Allowed:      true,
+			},
+		},
+		{
+			"/explain/http://bad.test/png", http.StatusOK,
+			explanation{
+				URL:       "http://bad.test/png",
+				Canonical: "0x0",
+				Reason:    "request does not contain an allowed host or valid signature",
+			},
+		},
+		{
+			"/explain/jpeg/http://good.test/png", http.StatusOK,
+			explanation{
+				URL:       "http://good.test/png",
+				Options:   Options{Format: "jpeg"},
+				Canonical: "0x0,jpeg",
+				Reason:    "output format not allowed: jpeg",
+			},
+		},
+		{"/explain/100/invalid", http.StatusBadRequest, explanation{}},
+	}
+
+	for _, tt := range tests {
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, httptest.NewRequest("GET", tt.url, nil))
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("ServeHTTP(%q) returned status %d, want %d: %s", tt.url, got, want, resp.Body)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+
+		var got explanation
+		if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil {
+			t.Errorf("ServeHTTP(%q) returned invalid JSON: %v", tt.url, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ServeHTTP(%q) explained %+v, want %+v", tt.url, got, tt.want)
+		}
+	}
+
+	if len(tr.urls) != 0 {
+		t.Errorf("explain requests fetched remote URLs %q, want none", tr.urls)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// faceDetector returns the bounds of faces found in m, in the coordinate
+// space of m.  It is used by the "scface" option to position smart crops,
+// and is nil unless imageproxy is built with the "pigo" build tag.
+var faceDetector func(m image.Image) []image.Rectangle
+
+// detectFaces returns the bounds of faces found in m.  If m has more than
+// maxPixels pixels, it is first downsampled to reduce the cost of detection,
+// and the faces found are mapped back to the bounds of m.  A maxPixels of
+// zero means no limit.
+func detectFaces(m image.Image, maxPixels int) []image.Rectangle {
+	if faceDetector == nil {
+		return nil
+	}
+	b := m.Bounds()
+	pixels := b.Dx() * b.Dy()
+	if maxPixels <= 0 || pixels <= maxPixels {
+		return faceDetector(m)
+	}
+
+	scale := math.Sqrt(float64(maxPixels) / float64(pixels))
+	sw := max(1, int(float64(b.Dx())*scale))
+	sh := max(1, int(float64(b.Dy())*scale))
+	small := imaging.Resize(m, sw, sh, imaging.Box)
+	sx, sy := float64(sw)/float64(b.Dx()), float64(sh)/float64(b.Dy())
+
+	faces := faceDetector(small)
+	for i, f := range faces {
+		faces[i] = image.Rect(
+			int(math.Round(float64(f.Min.X)/sx)), int(math.Round(float64(f.Min.Y)/sy)),
+			int(math.Round(float64(f.Max.X)/sx)), int(math.Round(float64(f.Max.Y)/sy)),
+		).Add(b.Min).Intersect(b)
+	}
+	return faces
+}
+
+// faceCrop returns the largest rectangle within m with the aspect ratio of
+// w:h, centered on the faces as closely as the bounds of m allow.
+func faceCrop(m image.Image, w, h int, faces []image.Rectangle) image.Rectangle {
+	b := m.Bounds()
+	imgW, imgH := b.Dx(), b.Dy()
+	ratio := float64(w) / float64(h)
+	cw, ch := imgW, int(float64(imgW)/ratio)
+	if ch > imgH {
+		cw, ch = int(float64(imgH)*ratio), imgH
+	}
+
+	var u image.Rectangle
+	for _, f := range faces {
+		u = u.Union(f)
+	}
+	cx, cy := (u.Min.X+u.Max.X)/2, (u.Min.Y+u.Max.Y)/2
+	x0 := min(max(cx-cw/2, b.Min.X), b.Max.X-cw)
+	y0 := min(max(cy-ch/2, b.Min.Y), b.Max.Y-ch)
+	return image.Rect(x0, y0, x0+cw, y0+ch)
+}
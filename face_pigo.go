@@ -0,0 +1,56 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build pigo
+
+package imageproxy
+
+import (
+	_ "embed"
+	"image"
+
+	"github.com/disintegration/imaging"
+	pigo "github.com/esimov/pigo/core"
+)
+
+//go:embed third_party/pigo/facefinder
+var faceFinderCascade []byte
+
+// minFaceQuality is the minimum detection score of faces found by pigo.
+// Lower scores are usually false positives.
+const minFaceQuality = 5
+
+func init() {
+	classifier, err := pigo.NewPigo().Unpack(faceFinderCascade)
+	if err != nil {
+		panic("imageproxy: error loading face detection cascade: " + err.Error())
+	}
+
+	faceDetector = func(m image.Image) []image.Rectangle {
+		src := imaging.Clone(m) // pigo expects bounds starting at (0, 0)
+		rows, cols := src.Bounds().Dy(), src.Bounds().Dx()
+		params := pigo.CascadeParams{
+			MinSize:     max(min(rows, cols)/20, 20),
+			MaxSize:     min(rows, cols),
+			ShiftFactor: 0.1,
+			ScaleFactor: 1.1,
+			ImageParams: pigo.ImageParams{
+				Pixels: pigo.RgbToGrayscale(src),
+				Rows:   rows,
+				Cols:   cols,
+				Dim:    cols,
+			},
+		}
+
+		dets := classifier.ClusterDetections(classifier.RunCascade(params, 0), 0.2)
+		var faces []image.Rectangle
+		for _, d := range dets {
+			if d.Q < minFaceQuality {
+				continue
+			}
+			r := image.Rect(d.Col-d.Scale/2, d.Row-d.Scale/2, d.Col+d.Scale/2, d.Row+d.Scale/2)
+			faces = append(faces, r.Add(m.Bounds().Min).Intersect(m.Bounds()))
+		}
+		return faces
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// withFaceDetector sets faceDetector to detect for the duration of the test.
+func withFaceDetector(t *testing.T, detect func(m image.Image) []image.Rectangle) {
+	t.Helper()
+	orig := faceDetector
+	faceDetector = detect
+	t.Cleanup(func() { faceDetector = orig })
+}
+
+func TestDetectFaces(t *testing.T) {
+	var size image.Point // size of the image passed to the detector
+	withFaceDetector(t, func(m image.Image) []image.Rectangle {
+		size = m.Bounds().Size()
+		// a face in the center quarter of the image
+		b := m.Bounds()
+		return []image.Rectangle{image.Rect(b.Dx()/4, b.Dy()/4, b.Dx()*3/4, b.Dy()*3/4).Add(b.Min)}
+	})
+
+	src := image.NewNRGBA(image.Rect(0, 0, 400, 200))
+	tests := []struct {
+		maxPixels int
+		size      image.Point
+	}{
+		{0, image.Pt(400, 200)},
+		{80000, image.Pt(400, 200)},
+		{20000, image.Pt(200, 100)},
+	}
+
+	for _, tt := range tests {
+		faces := detectFaces(src, tt.maxPixels)
+		if size != tt.size {
+			t.Errorf("detectFaces with maxPixels %d detected faces in %v image, want %v", tt.maxPixels, size, tt.size)
+		}
+		want := []image.Rectangle{image.Rect(100, 50, 300, 150)}
+		if len(faces) != 1 || faces[0] != want[0] {
+			t.Errorf("detectFaces with maxPixels %d returned %v, want %v", tt.maxPixels, faces, want)
+		}
+	}
+}
+
+func TestFaceCrop(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	tests := []struct {
+		w, h  int
+		faces []image.Rectangle
+		want  image.Rectangle
+	}{
+		// centered on the face
+		{1, 1, []image.Rectangle{image.Rect(90, 40, 110, 60)}, image.Rect(50, 0, 150, 100)},
+		// clamped to the image bounds
+		{1, 1, []image.Rectangle{image.Rect(180, 40, 200, 60)}, image.Rect(100, 0, 200, 100)},
+		{1, 1, []image.Rectangle{image.Rect(0, 0, 10, 10)}, image.Rect(0, 0, 100, 100)},
+		// centered on all faces
+		{1, 1, []image.Rectangle{image.Rect(40, 40, 60, 60), image.Rect(140, 40, 160, 60)}, image.Rect(50, 0, 150, 100)},
+		// wide crops span the full width
+		{4, 1, []image.Rectangle{image.Rect(0, 80, 10, 90)}, image.Rect(0, 50, 200, 100)},
+	}
+
+	for _, tt := range tests {
+		if got := faceCrop(src, tt.w, tt.h, tt.faces); got != tt.want {
+			t.Errorf("faceCrop(%d, %d, %v) returned %v, want %v", tt.w, tt.h, tt.faces, got, tt.want)
+		}
+	}
+}
+
+func TestTransformImage_SmartCropFaces(t *testing.T) {
+	// a high contrast "face" near the left edge of a portrait image, with
+	// a more detailed region at the bottom that smart crop prefers.
+	src := image.NewNRGBA(image.Rect(0, 0, 100, 200))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.NRGBA{128, 128, 128, 255}), image.Point{}, draw.Src)
+	draw.Draw(src, image.Rect(0, 140, 100, 200), detailedImage(100, 60), image.Point{}, draw.Src)
+	face := image.Rect(10, 10, 40, 40)
+	draw.Draw(src, face, image.NewUniform(color.White), image.Point{}, draw.Src)
+	for _, eye := range []image.Rectangle{image.Rect(17, 18, 22, 23), image.Rect(28, 18, 33, 23)} {
+		draw.Draw(src, eye, image.NewUniform(color.Black), image.Point{}, draw.Src)
+	}
+
+	// detect faces as regions of white pixels
+	withFaceDetector(t, func(m image.Image) []image.Rectangle {
+		var r image.Rectangle
+		b := m.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if color.NRGBAModel.Convert(m.At(x, y)) == (color.NRGBA{255, 255, 255, 255}) {
+					r = r.Union(image.Rect(x, y, x+1, y+1))
+				}
+			}
+		}
+		if r.Empty() {
+			return nil
+		}
+		return []image.Rectangle{r}
+	})
+
+	for _, opt := range []string{"scface,50x50", "thumb:1x1:face,50x"} {
+		m := transformImage(src, ParseOptions(opt))
+		if got, want := m.Bounds().Size(), image.Pt(50, 50); got != want {
+			t.Errorf("transformImage(%q) returned size %v, want %v", opt, got, want)
+		}
+		// the top left of the output is the white face
+		if got := color.NRGBAModel.Convert(m.At(6, 16)); got != (color.NRGBA{255, 255, 255, 255}) {
+			t.Errorf("transformImage(%q) pixel (6, 16) is %v, want face color", opt, got)
+		}
+	}
+
+	// smart crop alone prefers the detailed region, cutting off the face
+	m := transformImage(src, ParseOptions("sc,50x50"))
+	if got := color.NRGBAModel.Convert(m.At(6, 16)); got == (color.NRGBA{255, 255, 255, 255}) {
+		t.Errorf("transformImage(%q) pixel (6, 16) is face color, want detailed region", "sc,50x50")
+	}
+
+	// without a face, smart crop is used
+	plain := image.NewNRGBA(src.Bounds())
+	draw.Draw(plain, plain.Bounds(), src, image.Point{}, draw.Src)
+	draw.Draw(plain, face, image.NewUniform(color.NRGBA{128, 128, 128, 255}), image.Point{}, draw.Src)
+	got := cropParams(plain, Options{Width: 50, Height: 50, SmartCrop: true, SmartCropFaces: true})
+	want := cropParams(plain, Options{Width: 50, Height: 50, SmartCrop: true})
+	if got != want {
+		t.Errorf("cropParams without faces returned %v, want smart crop %v", got, want)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// encodeICO writes m to w as an ICO image.  If sizes is empty, the ICO image
+// contains only m, scaled down to fit within maxICOSize if necessary.
+// Otherwise, it contains a square image of each size, with m scaled to fit and
+// centered.  Images are resized using filter.
+//
+// Images of the maximum size are stored as PNG, and smaller images as 32-bit
+// bitmaps, which are supported by older versions of Windows.
+func encodeICO(w io.Writer, m image.Image, sizes []int, filter imaging.ResampleFilter) error {
+	var images []image.Image
+	if len(sizes) == 0 {
+		if b := m.Bounds(); b.Dx() > maxICOSize || b.Dy() > maxICOSize {
+			m = imaging.Fit(m, maxICOSize, maxICOSize, filter)
+		}
+		images = append(images, m)
+	} else {
+		for _, size := range sizes {
+			images = append(images, icoImage(m, size, filter))
+		}
+	}
+
+	entries := make([][]byte, len(images))
+	for i, img := range images {
+		buf := new(bytes.Buffer)
+		var err error
+		if b := img.Bounds(); b.Dx() == maxICOSize || b.Dy() == maxICOSize {
+			err = png.Encode(buf, img)
+		} else {
+			err = writeICOBitmap(buf, img)
+		}
+		if err != nil {
+			return err
+		}
+		entries[i] = buf.Bytes()
+	}
+
+	// ICONDIR header
+	b := binary.LittleEndian.AppendUint16(nil, 0) // reserved
+	b = binary.LittleEndian.AppendUint16(b, 1)    // icon type
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(images)))
+
+	// ICONDIRENTRY for each image, followed by the image data
+	offset := 6 + 16*len(images)
+	for i, img := range images {
+		size := img.Bounds().Size()
+		b = append(b, byte(size.X), byte(size.Y))   // 256 is stored as 0
+		b = append(b, 0, 0)                         // palette size, reserved
+		b = binary.LittleEndian.AppendUint16(b, 1)  // color planes
+		b = binary.LittleEndian.AppendUint16(b, 32) // bits per pixel
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(entries[i])))
+		b = binary.LittleEndian.AppendUint32(b, uint32(offset))
+		offset += len(entries[i])
+	}
+	for _, e := range entries {
+		b = append(b, e...)
+	}
+
+	_, err := w.Write(b)
+	return err
+}
+
+// icoImage returns m scaled to fit within a square of the specified size using
+// filter, centered on a transparent background.
+func icoImage(m image.Image, size int, filter imaging.ResampleFilter) image.Image {
+	b := m.Bounds()
+	w, h := size, size
+	if b.Dx() > b.Dy() {
+		h = max(1, int(math.Round(float64(size*b.Dy())/float64(b.Dx()))))
+	} else if b.Dy() > b.Dx() {
+		w = max(1, int(math.Round(float64(size*b.Dx())/float64(b.Dy()))))
+	}
+
+	bg := imaging.New(size, size, color.Transparent)
+	return imaging.PasteCenter(bg, imaging.Resize(m, w, h, filter))
+}
+
+// writeICOBitmap writes m to w as the 32-bit bitmap used for images in an ICO
+// image.  This is a BMP image without the file header, with the height
+// doubled to account for the 1-bit transparency mask following the pixels.
+func writeICOBitmap(w io.Writer, m image.Image) error {
+	img := imaging.Clone(m)
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	maskStride := (width + 31) / 32 * 4
+
+	// BITMAPINFOHEADER
+	b := binary.LittleEndian.AppendUint32(nil, 40)
+	b = binary.LittleEndian.AppendUint32(b, uint32(width))
+	b = binary.LittleEndian.AppendUint32(b, uint32(2*height))
+	b = binary.LittleEndian.AppendUint16(b, 1)  // color planes
+	b = binary.LittleEndian.AppendUint16(b, 32) // bits per pixel
+	b = binary.LittleEndian.AppendUint32(b, 0)  // no compression
+	b = binary.LittleEndian.AppendUint32(b, uint32(height*(4*width+maskStride)))
+	b = append(b, make([]byte, 16)...) // resolution and palette
+
+	// pixels, stored bottom-up as BGRA
+	for y := height - 1; y >= 0; y-- {
+		row := img.Pix[y*img.Stride : y*img.Stride+4*width]
+		for x := 0; x < len(row); x += 4 {
+			b = append(b, row[x+2], row[x+1], row[x], row[x+3])
+		}
+	}
+
+	// transparency mask, with bits set for fully transparent pixels
+	for y := height - 1; y >= 0; y-- {
+		mask := make([]byte, maskStride)
+		for x := range width {
+			if img.Pix[y*img.Stride+4*x+3] == 0 {
+				mask[x/8] |= 0x80 >> (x % 8)
+			}
+		}
+		b = append(b, mask...)
+	}
+
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,117 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+func TestTransform_ICO(t *testing.T) {
+	src := new(bytes.Buffer)
+	if err := png.Encode(src, newImage(300, 200, red)); err != nil {
+		t.Fatalf("error encoding source image: %v", err)
+	}
+
+	tests := []struct {
+		opt   Options
+		sizes []image.Point
+	}{
+		{Options{Format: "ico"}, []image.Point{{256, 170}}},
+		{Options{Format: "ico", Width: 48}, []image.Point{{48, 32}}},
+		{Options{Format: "ico", ICOSizes: "16:32:256"}, []image.Point{{16, 16}, {32, 32}, {256, 256}}},
+	}
+
+	for _, tt := range tests {
+		out, err := Transform(src.Bytes(), tt.opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned error: %v", tt.opt, err)
+			continue
+		}
+		if got, want := http.DetectContentType(out), "image/x-icon"; got != want {
+			t.Errorf("Transform(%v) returned content type %q, want %q", tt.opt, got, want)
+		}
+
+		if got, want := int(binary.LittleEndian.Uint16(out[4:])), len(tt.sizes); got != want {
+			t.Errorf("Transform(%v) returned %d images, want %d", tt.opt, got, want)
+			continue
+		}
+		for i, want := range tt.sizes {
+			entry := out[6+16*i:]
+			got := image.Pt(int(entry[0]), int(entry[1]))
+			if got.X == 0 {
+				got.X = 256
+			}
+			if got.Y == 0 {
+				got.Y = 256
+			}
+			if got != want {
+				t.Errorf("Transform(%v) image %d has size %v, want %v", tt.opt, i, got, want)
+			}
+
+			size, offset := binary.LittleEndian.Uint32(entry[8:]), binary.LittleEndian.Uint32(entry[12:])
+			data := out[offset : offset+size]
+			if want.X == 256 || want.Y == 256 {
+				cfg, err := png.DecodeConfig(bytes.NewReader(data))
+				if err != nil {
+					t.Errorf("Transform(%v) image %d is not a valid PNG: %v", tt.opt, i, err)
+				} else if got := image.Pt(cfg.Width, cfg.Height); got != want {
+					t.Errorf("Transform(%v) image %d has PNG size %v, want %v", tt.opt, i, got, want)
+				}
+				continue
+			}
+
+			// bitmap header, with the height doubled for the mask
+			w, h := int(binary.LittleEndian.Uint32(data[4:])), int(binary.LittleEndian.Uint32(data[8:]))
+			if got := image.Pt(w, h/2); got != want {
+				t.Errorf("Transform(%v) image %d has bitmap size %v, want %v", tt.opt, i, got, want)
+			}
+			maskStride := (w + 31) / 32 * 4
+			if got, want := len(data), 40+want.X*want.Y*4+want.Y*maskStride; got != want {
+				t.Errorf("Transform(%v) image %d has bitmap length %d, want %d", tt.opt, i, got, want)
+			}
+		}
+	}
+}
+
+func TestICOImage(t *testing.T) {
+	m := icoImage(newImage(40, 20, red), 16, resampleFilter)
+	if got, want := m.Bounds(), image.Rect(0, 0, 16, 16); got != want {
+		t.Errorf("icoImage returned bounds %v, want %v", got, want)
+	}
+
+	// image is centered on a transparent background
+	if _, _, _, a := m.At(8, 1).RGBA(); a != 0 {
+		t.Errorf("icoImage pixel above image has alpha %d, want 0", a)
+	}
+	if r, _, _, a := m.At(8, 8).RGBA(); r != 0xffff || a != 0xffff {
+		t.Errorf("icoImage pixel in image has red %d, alpha %d, want opaque red", r, a)
+	}
+}
+
+func TestWriteICOBitmap(t *testing.T) {
+	m := newImage(2, 2, red, green, blue, newImage(1, 1).At(0, 0))
+	buf := new(bytes.Buffer)
+	if err := writeICOBitmap(buf, m); err != nil {
+		t.Fatalf("writeICOBitmap returned error: %v", err)
+	}
+	b := buf.Bytes()
+
+	// bottom row first, as BGRA
+	pixels := b[40 : 40+16]
+	want := []byte{255, 0, 0, 255, 0, 0, 0, 0, 0, 0, 255, 255, 0, 255, 0, 255}
+	if !bytes.Equal(pixels, want) {
+		t.Errorf("writeICOBitmap pixels = %v, want %v", pixels, want)
+	}
+
+	// mask has a bit set for the transparent pixel in the bottom right
+	mask := b[40+16:]
+	if want := []byte{0x40, 0, 0, 0, 0, 0, 0, 0}; !bytes.Equal(mask, want) {
+		t.Errorf("writeICOBitmap mask = %v, want %v", mask, want)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// iiifPrefix is the path prefix for requests using the IIIF Image API syntax.
+const iiifPrefix = "/iiif/"
+
+// iiifFormats maps IIIF format extensions to imageproxy formats.
+var iiifFormats = map[string]string{
+	"jpg": optFormatJPEG,
+	"png": optFormatPNG,
+	"tif": optFormatTIFF,
+}
+
+// newIIIFRequest parses an http.Request using the IIIF Image API syntax
+// (https://iiif.io/api/image/3.0/) into an imageproxy Request.  The request
+// path is formatted as:
+//
+//	/iiif/{identifier}/{region}/{size}/{rotation}/{quality}.{format}
+//
+// The identifier is the remote URL, which should be percent-encoded or base64
+// encoded, and may be relative to baseURL.  The IIIF parameters are translated
+// into the equivalent Options.  Because imageproxy never distorts images, a
+// size of "w,h" scales the image to fill the requested size, cropping if
+// necessary.  Only rotations that are multiples of 90 degrees are supported,
+// and percentage sizes can only be used with the full region.
+func newIIIFRequest(r *http.Request, baseURL *url.URL) (*Request, error) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), iiifPrefix), "/")
+	if len(parts) < 5 {
+		return nil, URLError{"too few path segments", r.URL}
+	}
+	n := len(parts) - 4
+	identifier := strings.Join(parts[:n], "/")
+
+	// unescape the IIIF parameters, which may include characters like "^"
+	params := parts[n:]
+	for i, param := range params {
+		var err error
+		if params[i], err = url.PathUnescape(param); err != nil {
+			return nil, URLError{fmt.Sprintf("invalid IIIF parameter: %v", err), r.URL}
+		}
+	}
+	region, size, rotation, file := params[0], params[1], params[2], params[3]
+
+	req := &Request{Original: r}
+	var err error
+	req.URL, _, err = parseURL(identifier, baseURL)
+	if err != nil {
+		return nil, URLError{fmt.Sprintf("unable to parse remote URL: %v", err), r.URL}
+	}
+	if baseURL != nil {
+		req.URL = baseURL.ResolveReference(req.URL)
+	}
+	if !req.URL.IsAbs() {
+		return nil, URLError{"must provide absolute remote URL", r.URL}
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, URLError{"remote URL must have http or https scheme", r.URL}
+	}
+	req.userinfo, req.URL.User = req.URL.User, nil
+
+	if err := iiifRegion(&req.Options, region); err != nil {
+		return nil, URLError{err.Error(), r.URL}
+	}
+	if err := iiifSize(&req.Options, size, region == "full"); err != nil {
+		return nil, URLError{err.Error(), r.URL}
+	}
+	if err := iiifRotation(&req.Options, rotation); err != nil {
+		return nil, URLError{err.Error(), r.URL}
+	}
+
+	ext := path.Ext(file)
+	if err := iiifQuality(&req.Options, strings.TrimSuffix(file, ext)); err != nil {
+		return nil, URLError{err.Error(), r.URL}
+	}
+	format, ok := iiifFormats[strings.TrimPrefix(ext, ".")]
+	if !ok {
+		return nil, URLError{fmt.Sprintf("unsupported IIIF format %q", ext), r.URL}
+	}
+	req.Options.Format = format
+
+	return req, nil
+}
+
+// iiifRegion sets the crop options in opt for the IIIF region parameter.
+func iiifRegion(opt *Options, region string) error {
+	switch {
+	case region == "full":
+		return nil
+	case region == "square":
+		opt.AspectRatio = AspectRatio{1, 1}
+		return nil
+	case strings.HasPrefix(region, "pct:"):
+		v, err := iiifNumbers(strings.TrimPrefix(region, "pct:"))
+		if err != nil || v[0] < 0 || v[0] >= 100 || v[1] < 0 || v[1] >= 100 || v[2] <= 0 || v[2] > 100 || v[3] <= 0 || v[3] > 100 {
+			return fmt.Errorf("invalid IIIF region %q", region)
+		}
+		// a width or height of 1 would be treated as a pixel value, so
+		// use the default of the full image size instead.
+		opt.CropX, opt.CropY = v[0]/100, v[1]/100
+		if v[2] < 100 {
+			opt.CropWidth = v[2] / 100
+		}
+		if v[3] < 100 {
+			opt.CropHeight = v[3] / 100
+		}
+		return nil
+	default:
+		// pixel values must be integers, since values between 0 and 1
+		// would be treated as percentages.
+		v, err := iiifNumbers(region)
+		if err != nil || v[0] < 0 || v[1] < 0 || v[2] <= 0 || v[3] <= 0 || slices.ContainsFunc(v, func(f float64) bool { return f != math.Trunc(f) }) {
+			return fmt.Errorf("invalid IIIF region %q", region)
+		}
+		opt.CropX, opt.CropY, opt.CropWidth, opt.CropHeight = v[0], v[1], v[2], v[3]
+		return nil
+	}
+}
+
+// iiifSize sets the size options in opt for the IIIF size parameter.
+// Percentage sizes are only supported for the full region, since they would
+// otherwise be calculated from the size of the original image.  Whether the
+// image may be upscaled ("^") is determined by the proxy configuration.
+func iiifSize(opt *Options, size string, fullRegion bool) error {
+	size = strings.TrimPrefix(size, "^")
+	switch {
+	case size == "max" || size == "full":
+		return nil
+	case strings.HasPrefix(size, "pct:"):
+		pct, err := strconv.ParseFloat(strings.TrimPrefix(size, "pct:"), 64)
+		if err != nil || pct <= 0 || pct > 100 || !fullRegion {
+			return fmt.Errorf("unsupported IIIF size %q", size)
+		}
+		if pct < 100 {
+			opt.Width = pct / 100
+		}
+		return nil
+	}
+
+	fit := strings.HasPrefix(size, "!")
+	w, h, ok := strings.Cut(strings.TrimPrefix(size, "!"), ",")
+	if !ok || (fit && (w == "" || h == "")) {
+		return fmt.Errorf("invalid IIIF size %q", size)
+	}
+	for _, d := range []struct {
+		s string
+		v *float64
+	}{{w, &opt.Width}, {h, &opt.Height}} {
+		if d.s == "" {
+			continue
+		}
+		v, err := strconv.Atoi(d.s)
+		if err != nil || v <= 0 {
+			return fmt.Errorf("invalid IIIF size %q", size)
+		}
+		*d.v = float64(v)
+	}
+	opt.Fit = fit
+	return nil
+}
+
+// iiifRotation sets the rotation options in opt for the IIIF rotation
+// parameter.  IIIF rotations are clockwise, with mirroring applied before
+// rotation.
+func iiifRotation(opt *Options, rotation string) error {
+	mirror := strings.HasPrefix(rotation, "!")
+	degrees, err := strconv.Atoi(strings.TrimPrefix(rotation, "!"))
+	if err != nil || degrees < 0 || degrees >= 360 || degrees%90 != 0 {
+		return fmt.Errorf("unsupported IIIF rotation %q", rotation)
+	}
+
+	// Options rotate counter-clockwise and flip after rotating.  Mirroring
+	// and then rotating clockwise is equivalent to rotating the same
+	// amount counter-clockwise and then mirroring.
+	if mirror {
+		opt.Rotate = degrees
+		opt.FlipHorizontal = true
+	} else {
+		opt.Rotate = (360 - degrees) % 360
+	}
+	return nil
+}
+
+// iiifQuality sets the color options in opt for the IIIF quality parameter.
+func iiifQuality(opt *Options, quality string) error {
+	switch quality {
+	case "default", "color":
+	case "gray":
+		// tinting with white maps luminance onto shades of gray
+		opt.Tint = color.NRGBA{255, 255, 255, 255}
+	case "bitonal":
+		opt.Threshold = 50
+	default:
+		return fmt.Errorf("unsupported IIIF quality %q", quality)
+	}
+	return nil
+}
+
+// iiifNumbers parses s as a comma separated list of four numbers.
+func iiifNumbers(s string) ([]float64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("expected 4 values, got %d", len(parts))
+	}
+	v := make([]float64, len(parts))
+	for i, p := range parts {
+		var err error
+		if v[i], err = strconv.ParseFloat(p, 64); err != nil {
+			return nil, err
+		}
+		if math.IsNaN(v[i]) || math.IsInf(v[i], 0) {
+			return nil, fmt.Errorf("invalid value %q", p)
+		}
+	}
+	return v, nil
+}
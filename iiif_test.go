@@ -0,0 +1,124 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestNewIIIFRequest(t *testing.T) {
+	const remote = "https://example.com/image.jpg"
+	const id = "https%3A%2F%2Fexample.com%2Fimage.jpg"
+	white := color.NRGBA{255, 255, 255, 255}
+
+	tests := []struct {
+		path        string
+		options     Options
+		expectError bool
+	}{
+		{"/iiif/" + id + "/full/max/0/default.jpg", Options{Format: "jpeg"}, false},
+		{"/iiif/" + id + "/full/full/0/color.png", Options{Format: "png"}, false},
+
+		// tiles
+		{"/iiif/" + id + "/0,0,512,512/256,/0/default.jpg", Options{CropWidth: 512, CropHeight: 512, Width: 256, Format: "jpeg"}, false},
+		{"/iiif/" + id + "/1024,512,512,256/,128/0/default.jpg", Options{CropX: 1024, CropY: 512, CropWidth: 512, CropHeight: 256, Height: 128, Format: "jpeg"}, false},
+		{"/iiif/" + id + "/pct:50,25,50,100/max/0/default.jpg", Options{CropX: 0.5, CropY: 0.25, CropWidth: 0.5, Format: "jpeg"}, false},
+		{"/iiif/" + id + "/square/100,100/0/default.jpg", Options{AspectRatio: AspectRatio{1, 1}, Width: 100, Height: 100, Format: "jpeg"}, false},
+
+		// sizes
+		{"/iiif/" + id + "/full/!200,100/0/default.jpg", Options{Width: 200, Height: 100, Fit: true, Format: "jpeg"}, false},
+		{"/iiif/" + id + "/full/^200,/0/default.jpg", Options{Width: 200, Format: "jpeg"}, false},
+		{"/iiif/" + id + "/full/pct:50/0/default.jpg", Options{Width: 0.5, Format: "jpeg"}, false},
+		{"/iiif/" + id + "/full/pct:100/0/default.jpg", Options{Format: "jpeg"}, false},
+
+		// rotation, quality, and format
+		{"/iiif/" + id + "/full/max/90/default.jpg", Options{Rotate: 270, Format: "jpeg"}, false},
+		{"/iiif/" + id + "/full/max/!0/default.jpg", Options{FlipHorizontal: true, Format: "jpeg"}, false},
+		{"/iiif/" + id + "/full/max/!90/default.jpg", Options{Rotate: 90, FlipHorizontal: true, Format: "jpeg"}, false},
+		{"/iiif/" + id + "/full/max/0/gray.png", Options{Tint: white, Format: "png"}, false},
+		{"/iiif/" + id + "/full/max/0/bitonal.tif", Options{Threshold: 50, Format: "tiff"}, false},
+
+		// base64 encoded identifier
+		{"/iiif/aHR0cHM6Ly9leGFtcGxlLmNvbS9pbWFnZS5qcGc/full/max/0/default.jpg", Options{Format: "jpeg"}, false},
+
+		// errors
+		{"/iiif/" + id + "/full/max/0", emptyOptions, true},
+		{"/iiif/image.jpg/full/max/0/default.jpg", emptyOptions, true},
+		{"/iiif/" + id + "/0,0,512/max/0/default.jpg", emptyOptions, true},
+		{"/iiif/" + id + "/0,0,0.5,512/max/0/default.jpg", emptyOptions, true},
+		{"/iiif/" + id + "/pct:0,0,101,50/max/0/default.jpg", emptyOptions, true},
+		{"/iiif/" + id + "/pct:NaN,0,50,50/max/0/default.jpg", emptyOptions, true},
+		{"/iiif/" + id + "/0,0,512,512/pct:50/0/default.jpg", emptyOptions, true},
+		{"/iiif/" + id + "/full/!200,/0/default.jpg", emptyOptions, true},
+		{"/iiif/" + id + "/full/200/0/default.jpg", emptyOptions, true},
+		{"/iiif/" + id + "/full/max/45/default.jpg", emptyOptions, true},
+		{"/iiif/" + id + "/full/max/0/sepia.jpg", emptyOptions, true},
+		{"/iiif/" + id + "/full/max/0/default.webp", emptyOptions, true},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		req, err := newIIIFRequest(r, nil)
+		if tt.expectError {
+			if err == nil {
+				t.Errorf("newIIIFRequest(%q) did not return expected error", tt.path)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("newIIIFRequest(%q) returned unexpected error: %v", tt.path, err)
+			continue
+		}
+
+		if got, want := req.URL.String(), remote; got != want {
+			t.Errorf("newIIIFRequest(%q) request URL = %v, want %v", tt.path, got, want)
+		}
+		if got, want := req.Options, tt.options; got != want {
+			t.Errorf("newIIIFRequest(%q) request options = %v, want %v", tt.path, got, want)
+		}
+	}
+}
+
+func TestNewIIIFRequest_BaseURL(t *testing.T) {
+	base, _ := url.Parse("https://example.com/images/")
+	r := httptest.NewRequest("GET", "/iiif/photo.jpg/full/max/0/default.jpg", nil)
+	req, err := newIIIFRequest(r, base)
+	if err != nil {
+		t.Fatalf("newIIIFRequest returned unexpected error: %v", err)
+	}
+	if got, want := req.URL.String(), "https://example.com/images/photo.jpg"; got != want {
+		t.Errorf("newIIIFRequest request URL = %v, want %v", got, want)
+	}
+}
+
+func TestProxy_ServeHTTP_iiif(t *testing.T) {
+	p := NewProxy(&testTransport{}, nil)
+
+	req := httptest.NewRequest("GET", "/iiif/http%3A%2F%2Fgood.test%2Fpng/full/max/0/default.png", nil)
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Fatalf("ServeHTTP returned status %d, want %d", got, want)
+	}
+	m, err := png.Decode(resp.Body)
+	if err != nil {
+		t.Fatalf("ServeHTTP returned invalid png: %v", err)
+	}
+	if got, want := m.Bounds(), image.Rect(0, 0, 1, 1); !got.Eq(want) {
+		t.Errorf("ServeHTTP returned image with bounds %v, want %v", got, want)
+	}
+
+	req = httptest.NewRequest("GET", "/iiif/http%3A%2F%2Fgood.test%2Fpng/full/max/45/default.png", nil)
+	resp = httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+	if got, want := resp.Code, http.StatusBadRequest; got != want {
+		t.Errorf("ServeHTTP with unsupported rotation returned status %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"io"
+
+	"github.com/disintegration/imaging"
+)
+
+// adam7Passes describes the seven passes of Adam7 interlacing, as the offset
+// of the first pixel in each pass and the spacing between pixels.
+var adam7Passes = []struct{ x, y, dx, dy int }{
+	{0, 0, 8, 8},
+	{4, 0, 8, 8},
+	{0, 4, 4, 8},
+	{2, 0, 4, 4},
+	{0, 2, 2, 4},
+	{1, 0, 2, 2},
+	{0, 1, 1, 2},
+}
+
+// encodeInterlacedPNG writes m to w as an Adam7 interlaced PNG, which can be
+// displayed at increasing resolution as it loads.  The standard library PNG
+// encoder does not support interlacing, so the image is always encoded as
+// 8-bit RGBA with unfiltered scanlines.
+func encodeInterlacedPNG(w io.Writer, m image.Image) error {
+	img := imaging.Clone(m)
+	size := img.Bounds().Size()
+
+	e := &apngEncoder{w: w}
+	if _, e.err = io.WriteString(w, pngHeader); e.err != nil {
+		return e.err
+	}
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(size.X))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(size.Y))
+	ihdr[8] = 8  // bit depth
+	ihdr[9] = 6  // color type: truecolor with alpha
+	ihdr[12] = 1 // interlace method: Adam7
+	e.writeChunk("IHDR", ihdr)
+
+	buf := new(bytes.Buffer)
+	zw := zlib.NewWriter(buf)
+	for _, pass := range adam7Passes {
+		if pass.x >= size.X {
+			continue // passes with no pixels are omitted
+		}
+		for y := pass.y; y < size.Y; y += pass.dy {
+			row := []byte{0} // filter type none
+			for x := pass.x; x < size.X; x += pass.dx {
+				i := img.PixOffset(x, y)
+				row = append(row, img.Pix[i:i+4]...)
+			}
+			if _, err := zw.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	e.writeChunk("IDAT", buf.Bytes())
+
+	e.writeChunk("IEND", nil)
+	return e.err
+}
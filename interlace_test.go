@@ -0,0 +1,70 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestTransform_Progressive(t *testing.T) {
+	// include sizes smaller than the Adam7 pattern, which omit some passes
+	for _, size := range []image.Point{{1, 1}, {3, 2}, {9, 10}, {17, 5}} {
+		src := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+		for y := range size.Y {
+			for x := range size.X {
+				src.Set(x, y, color.NRGBA{uint8(x * 10), uint8(y * 10), uint8(x + y), uint8(255 - x)})
+			}
+		}
+		buf := new(bytes.Buffer)
+		if err := png.Encode(buf, src); err != nil {
+			t.Errorf("error encoding reference image: %v", err)
+		}
+
+		b, err := Transform(buf.Bytes(), Options{Format: "png", Progressive: true})
+		if err != nil {
+			t.Fatalf("Transform returned unexpected error: %v", err)
+		}
+
+		chunks := readPNGChunks(t, b)
+		if got := chunks[0].data[12]; chunks[0].name != "IHDR" || got != 1 {
+			t.Errorf("%v image has interlace method %d, want 1", size, got)
+		}
+
+		m, err := png.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("error decoding interlaced %v image: %v", size, err)
+		}
+		if got, want := m.Bounds(), src.Bounds(); got != want {
+			t.Errorf("interlaced image has bounds %v, want %v", got, want)
+		}
+		for y := range size.Y {
+			for x := range size.X {
+				if got, want := color.NRGBAModel.Convert(m.At(x, y)), src.At(x, y); got != want {
+					t.Errorf("%v image has pixel (%d,%d) %v, want %v", size, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestTransform_ProgressiveJPEG(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, newImage(2, 2, red, green, blue, yellow)); err != nil {
+		t.Errorf("error encoding reference image: %v", err)
+	}
+
+	// progressive JPEGs are not supported, so a baseline JPEG is returned
+	b, err := Transform(buf.Bytes(), Options{Format: "jpeg", Progressive: true})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(b)); err != nil {
+		t.Errorf("error decoding jpeg: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// MemoryCache is an in-memory Cache with least recently used eviction and
+// an optional expiry for each entry.  It is safe for concurrent use.
+type MemoryCache struct {
+	maxSize int64         // maximum total size of cached data, in bytes
+	ttl     time.Duration // how long entries are cached, or 0 for no expiry
+	clock   Clock
+
+	mu      sync.Mutex
+	size    int64                    // total size of cached data
+	entries map[string]*list.Element // cache entries, keyed by cache key
+	lru     *list.List               // entries, most recently used first
+
+	hits, misses, evictions int64
+}
+
+// memoryEntry is a cached response in a MemoryCache.
+type memoryEntry struct {
+	key     string
+	data    []byte
+	expires time.Time // zero if the entry doesn't expire
+}
+
+// NewMemoryCache returns a MemoryCache holding at most maxSize bytes of
+// data.  If ttl is non-zero, entries expire that long after they are set.
+func NewMemoryCache(maxSize int64, ttl time.Duration) *MemoryCache {
+	return &MemoryCache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		clock:   systemClock{},
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Get returns the data cached for key.  Expired entries are deleted, and
+// are not returned.
+func (c *MemoryCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok && c.expired(e.Value.(*memoryEntry)) {
+		c.remove(e)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*memoryEntry).data, true
+}
+
+// Set caches data for key, evicting the least recently used entries if
+// needed to stay within the cache's maximum size.  Data larger than the
+// maximum size is not cached.
+func (c *MemoryCache) Set(key string, data []byte) {
+	size := int64(len(data))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	if size > c.maxSize {
+		return
+	}
+	for c.size+size > c.maxSize {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+
+	entry := &memoryEntry{key: key, data: data}
+	if c.ttl > 0 {
+		entry.expires = c.clock.Now().Add(c.ttl)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += size
+}
+
+// Delete deletes the data cached for key.
+func (c *MemoryCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+}
+
+// CacheStats returns statistics describing the cache.  Entries that have
+// expired but not yet been deleted are included in the entry count and size.
+func (c *MemoryCache) CacheStats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Entries:   int64(len(c.entries)),
+		Bytes:     c.size,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+}
+
+// expired returns whether the entry has expired.  c.mu must be held.
+func (c *MemoryCache) expired(entry *memoryEntry) bool {
+	return !entry.expires.IsZero() && !c.clock.Now().Before(entry.expires)
+}
+
+// remove removes the cache entry e.  c.mu must be held.
+func (c *MemoryCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*memoryEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.data))
+}
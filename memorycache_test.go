@@ -0,0 +1,121 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryCache(t *testing.T) {
+	c := NewMemoryCache(10, 0)
+
+	c.Set("a", []byte("aaaa"))
+	c.Set("b", []byte("bbbb"))
+	if got, ok := c.Get("a"); !ok || string(got) != "aaaa" {
+		t.Errorf("Get(a) returned %q, %t; want %q, true", got, ok, "aaaa")
+	}
+
+	// adding c evicts b, which is least recently used
+	c.Set("c", []byte("cccc"))
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("Get(b) returned evicted entry")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("Get(%s) did not return cached entry", key)
+		}
+	}
+
+	// replacing an entry updates its size
+	c.Set("a", []byte("a"))
+	if got, want := c.CacheStats().Bytes, int64(5); got != want {
+		t.Errorf("cache size is %d, want %d", got, want)
+	}
+
+	// entries larger than the cache are not cached
+	c.Set("big", make([]byte, 11))
+	if _, ok := c.Get("big"); ok {
+		t.Errorf("Get(big) returned entry larger than the cache")
+	}
+
+	c.Delete("a")
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("Get(a) returned deleted entry")
+	}
+
+	want := CacheStats{Entries: 1, Bytes: 4, Hits: 3, Misses: 3, Evictions: 1}
+	if got := c.CacheStats(); got != want {
+		t.Errorf("CacheStats returned %+v, want %+v", got, want)
+	}
+}
+
+func TestMemoryCache_expiry(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := NewMemoryCache(100, time.Minute)
+	c.clock = clock
+
+	c.Set("a", []byte("aaaa"))
+	clock.now = clock.now.Add(30 * time.Second)
+	c.Set("b", []byte("bbbb"))
+	if _, ok := c.Get("a"); !ok {
+		t.Errorf("Get(a) did not return unexpired entry")
+	}
+
+	// a expires, and is deleted when accessed
+	clock.now = clock.now.Add(30 * time.Second)
+	if _, ok := c.Get("a"); ok {
+		t.Errorf("Get(a) returned expired entry")
+	}
+	if _, ok := c.Get("b"); !ok {
+		t.Errorf("Get(b) did not return unexpired entry")
+	}
+	if got, want := c.CacheStats().Entries, int64(1); got != want {
+		t.Errorf("cache has %d entries after expiry, want %d", got, want)
+	}
+
+	// setting an entry again resets its expiry
+	c.Set("b", []byte("bbbb"))
+	clock.now = clock.now.Add(45 * time.Second)
+	if _, ok := c.Get("b"); !ok {
+		t.Errorf("Get(b) did not return entry that was set again")
+	}
+}
+
+func TestMemoryCache_concurrent(t *testing.T) {
+	c := NewMemoryCache(1000, time.Hour)
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 500 {
+				key := fmt.Sprintf("%d", (i*j)%50)
+				c.Set(key, []byte(key+"-data"))
+				if got, ok := c.Get(key); ok && string(got) != key+"-data" {
+					t.Errorf("Get(%s) returned %q", key, got)
+				}
+				if j%10 == 0 {
+					c.Delete(key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := c.CacheStats()
+	if stats.Bytes > 1000 {
+		t.Errorf("cache size %d exceeds maximum size", stats.Bytes)
+	}
+	var size int64
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		size += int64(len(e.Value.(*memoryEntry).data))
+	}
+	if size != stats.Bytes || int64(c.lru.Len()) != stats.Entries {
+		t.Errorf("cache size %d and entries %d don't match contents: %d bytes, %d entries", stats.Bytes, stats.Entries, size, c.lru.Len())
+	}
+}
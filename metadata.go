@@ -0,0 +1,62 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/gif"
+)
+
+// imageMetadata describes an encoded image.
+type imageMetadata struct {
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Format   string `json:"format"`
+	Size     int    `json:"size"`
+	Alpha    bool   `json:"alpha"`
+	Animated bool   `json:"animated"`
+}
+
+// metadataJSON returns the JSON description of the encoded image img, whose
+// config and format have already been decoded.  Only animated GIFs require
+// decoding the full image.
+func metadataJSON(img []byte, cfg image.Config, format string) ([]byte, error) {
+	md := imageMetadata{
+		Width:  cfg.Width,
+		Height: cfg.Height,
+		Format: format,
+		Size:   len(img),
+		Alpha:  hasAlphaModel(cfg.ColorModel),
+	}
+
+	if format == "gif" {
+		g, err := gif.DecodeAll(bytes.NewReader(img))
+		if err != nil {
+			return nil, err
+		}
+		md.Animated = len(g.Image) > 1
+	}
+
+	return json.Marshal(md)
+}
+
+// hasAlphaModel returns whether images using the color model m can include
+// transparency.
+func hasAlphaModel(m color.Model) bool {
+	switch m {
+	case color.RGBAModel, color.RGBA64Model, color.NRGBAModel, color.NRGBA64Model, color.AlphaModel, color.Alpha16Model:
+		return true
+	}
+	if p, ok := m.(color.Palette); ok {
+		for _, c := range p {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
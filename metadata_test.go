@@ -0,0 +1,105 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetadata(t *testing.T) {
+	pngBuf := new(bytes.Buffer)
+	if err := png.Encode(pngBuf, newImage(3, 2, red)); err != nil {
+		t.Fatalf("error encoding png: %v", err)
+	}
+	jpegBuf := new(bytes.Buffer)
+	if err := jpeg.Encode(jpegBuf, newImage(4, 5, red), nil); err != nil {
+		t.Fatalf("error encoding jpeg: %v", err)
+	}
+
+	palette := color.Palette{red, blue}
+	frame := func(c uint8) *image.Paletted {
+		m := image.NewPaletted(image.Rect(0, 0, 2, 2), palette)
+		for i := range m.Pix {
+			m.Pix[i] = c
+		}
+		return m
+	}
+	gifBuf := new(bytes.Buffer)
+	err := gif.EncodeAll(gifBuf, &gif.GIF{
+		Image: []*image.Paletted{frame(0), frame(1)},
+		Delay: []int{10, 10},
+	})
+	if err != nil {
+		t.Fatalf("error encoding gif: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		img  []byte
+		want string
+	}{
+		{"png", pngBuf.Bytes(), `{"width":3,"height":2,"format":"png","size":%d,"alpha":true,"animated":false}`},
+		{"jpeg", jpegBuf.Bytes(), `{"width":4,"height":5,"format":"jpeg","size":%d,"alpha":false,"animated":false}`},
+		{"animated gif", gifBuf.Bytes(), `{"width":2,"height":2,"format":"gif","size":%d,"alpha":false,"animated":true}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Transform(tt.img, Options{Format: "metadata", Width: 1})
+			if err != nil {
+				t.Fatalf("Transform returned unexpected error: %v", err)
+			}
+			if want := fmt.Sprintf(tt.want, len(tt.img)); string(got) != want {
+				t.Errorf("Transform returned %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestHasAlphaModel(t *testing.T) {
+	tests := []struct {
+		model color.Model
+		want  bool
+	}{
+		{color.NRGBAModel, true},
+		{color.RGBA64Model, true},
+		{color.GrayModel, false},
+		{color.YCbCrModel, false},
+		{color.Palette{red, blue}, false},
+		{color.Palette{red, color.NRGBA{}}, true},
+	}
+	for _, tt := range tests {
+		if got := hasAlphaModel(tt.model); got != tt.want {
+			t.Errorf("hasAlphaModel(%v) returned %v, want %v", tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_metadata(t *testing.T) {
+	p := NewProxy(&testTransport{}, nil)
+	p.ContentTypes = []string{"image/*"}
+
+	req := httptest.NewRequest("GET", "/metadata/http://good.test/png", nil)
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Errorf("ServeHTTP returned status %d, want %d", got, want)
+	}
+	if got, want := resp.Header().Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("ServeHTTP returned content type %q, want %q", got, want)
+	}
+	if !bytes.Contains(resp.Body.Bytes(), []byte(`"width":1,"height":1,"format":"png"`)) {
+		t.Errorf("ServeHTTP returned unexpected body %s", resp.Body)
+	}
+}
@@ -4,9 +4,18 @@
 package imageproxy
 
 import (
+	"fmt"
+	"net/http"
+	"net/url"
+
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// metricsPath is the path at which ServeHTTP serves Prometheus metrics,
+// unless Proxy.DisableMetricsRoute is set.
+const metricsPath = "/metrics"
+
 var (
 	metricServedFromCache = prometheus.NewCounter(
 		prometheus.CounterOpts{
@@ -19,6 +28,11 @@ var (
 		Name:      "transformation_duration_seconds",
 		Help:      "Time taken for image transformations in seconds.",
 	})
+	metricTransformFallback = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "imageproxy",
+		Name:      "transform_fallbacks_total",
+		Help:      "Number of images served untransformed because transformation failed.",
+	})
 	metricRemoteErrors = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "imageproxy",
 		Name:      "remote_fetch_errors_total",
@@ -34,12 +48,86 @@ var (
 		Name:      "requests_in_flight",
 		Help:      "Number of requests in flight",
 	})
+	metricRemoteFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "imageproxy",
+		Name:      "remote_fetch_duration_seconds",
+		Help:      "Time taken to fetch remote images in seconds, by remote host and response status class.",
+	}, []string{"host", "status"})
+	metricImageRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "imageproxy",
+		Name:      "image_request_duration_seconds",
+		Help:      "Image request response times in seconds, by remote host and response status class.",
+	}, []string{"host", "status"})
 )
 
+// MetricsHandler returns a handler that serves the proxy's Prometheus
+// metrics.  This can be used to serve metrics on a different listener than
+// image requests, in which case Proxy.DisableMetricsRoute should be set.
+func (p *Proxy) MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// metricsOtherHost is the host label used for remote hosts that are not in
+// the proxy's allowed hosts.
+const metricsOtherHost = "other"
+
 func init() {
 	prometheus.MustRegister(metricTransformationDuration)
 	prometheus.MustRegister(metricServedFromCache)
+	prometheus.MustRegister(metricTransformFallback)
 	prometheus.MustRegister(metricRemoteErrors)
 	prometheus.MustRegister(metricRequestDuration)
 	prometheus.MustRegister(metricRequestsInFlight)
+	prometheus.MustRegister(metricRemoteFetchDuration)
+	prometheus.MustRegister(metricImageRequestDuration)
+}
+
+// metricsHost returns the host label for metrics about requests to u.  To
+// limit the number of distinct labels, this is the entry in the proxy's
+// allowed hosts that matches u, or metricsOtherHost if none do.
+func (p *Proxy) metricsHost(u *url.URL) string {
+	if u == nil {
+		return metricsOtherHost
+	}
+	for _, host := range p.AllowHosts {
+		if hostMatches([]string{host}, u) {
+			return host
+		}
+	}
+	return metricsOtherHost
+}
+
+// statusClass returns the status label for metrics about a response with
+// the HTTP status code, such as "2xx".  Invalid codes return "error".
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "error"
+	}
+	return fmt.Sprintf("%dxx", code/100)
+}
+
+// statusWriter is an http.ResponseWriter that records the response status.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the underlying ResponseWriter, for use by
+// http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
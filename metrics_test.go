@@ -0,0 +1,193 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// sampleCount returns the number of observations in the histogram in vec
+// with the specified labels.
+func sampleCount(t *testing.T, vec *prometheus.HistogramVec, labels ...string) uint64 {
+	t.Helper()
+	m := new(dto.Metric)
+	if err := vec.WithLabelValues(labels...).(prometheus.Histogram).Write(m); err != nil {
+		t.Fatalf("error reading metric: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+// counterValue returns the current value of counter c.
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	m := new(dto.Metric)
+	if err := c.Write(m); err != nil {
+		t.Fatalf("error reading metric: %v", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestProxy_ServeHTTP_metrics(t *testing.T) {
+	p := NewProxy(&testTransport{}, nil)
+	p.AllowHosts = []string{"good.test", "*.example.test"}
+
+	tests := []struct {
+		url          string
+		host, status string
+		fetch        bool // whether the remote image is fetched
+		fetchStatus  string
+	}{
+		{"/http://good.test/png", "good.test", "2xx", true, "2xx"},
+		{"/http://a.example.test/png", "*.example.test", "2xx", true, "2xx"},
+		{"/http://b.example.test/error", "*.example.test", "5xx", true, "error"},
+		{"/http://good.test/notfound", "good.test", "4xx", true, "4xx"},
+		{"/http://bad.test/png", metricsOtherHost, "4xx", false, ""},
+	}
+
+	for _, tt := range tests {
+		requests := sampleCount(t, metricImageRequestDuration, tt.host, tt.status)
+		var fetches uint64
+		if tt.fetch {
+			fetches = sampleCount(t, metricRemoteFetchDuration, tt.host, tt.fetchStatus)
+		}
+
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.url, nil))
+
+		if got, want := sampleCount(t, metricImageRequestDuration, tt.host, tt.status), requests+1; got != want {
+			t.Errorf("ServeHTTP(%v) image requests for host %q, status %q is %d, want %d", tt.url, tt.host, tt.status, got, want)
+		}
+		if tt.fetch {
+			if got, want := sampleCount(t, metricRemoteFetchDuration, tt.host, tt.fetchStatus), fetches+1; got != want {
+				t.Errorf("ServeHTTP(%v) remote fetches for host %q, status %q is %d, want %d", tt.url, tt.host, tt.fetchStatus, got, want)
+			}
+		}
+	}
+}
+
+func TestProxy_metricsHost(t *testing.T) {
+	p := &Proxy{AllowHosts: []string{"good.test", "*.example.test"}}
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://good.test/image", "good.test"},
+		{"http://a.example.test/image", "*.example.test"},
+		{"http://bad.test/image", metricsOtherHost},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		if got := p.metricsHost(u); got != tt.want {
+			t.Errorf("metricsHost(%q) returned %q, want %q", tt.url, got, tt.want)
+		}
+	}
+
+	// without allowed hosts, all hosts share a single label
+	p.AllowHosts = nil
+	if got, want := p.metricsHost(&url.URL{Host: "good.test"}), metricsOtherHost; got != want {
+		t.Errorf("metricsHost with no allowed hosts returned %q, want %q", got, want)
+	}
+}
+
+func TestStatusClass(t *testing.T) {
+	tests := []struct {
+		code int
+		want string
+	}{
+		{http.StatusOK, "2xx"},
+		{http.StatusNotModified, "3xx"},
+		{http.StatusNotFound, "4xx"},
+		{http.StatusBadGateway, "5xx"},
+		{0, "error"},
+		{600, "error"},
+	}
+	for _, tt := range tests {
+		if got := statusClass(tt.code); got != tt.want {
+			t.Errorf("statusClass(%d) returned %q, want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_metricsRoute(t *testing.T) {
+	tests := []struct {
+		disable bool
+		code    int // expected response status code of /metrics
+	}{
+		{false, http.StatusOK},
+		{true, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		p := NewProxy(&testTransport{}, nil)
+		p.DisableMetricsRoute = tt.disable
+
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, httptest.NewRequest("GET", "/metrics", nil))
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("ServeHTTP(/metrics) with DisableMetricsRoute %t returned status %d, want %d", tt.disable, got, want)
+		}
+		if tt.code == http.StatusOK && !strings.Contains(resp.Body.String(), "imageproxy_") {
+			t.Errorf("ServeHTTP(/metrics) did not return imageproxy metrics")
+		}
+
+		// metrics are always available from the separate handler
+		resp = httptest.NewRecorder()
+		p.MetricsHandler().ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+		if got, want := resp.Code, http.StatusOK; got != want {
+			t.Errorf("MetricsHandler returned status %d, want %d", got, want)
+		}
+		if !strings.Contains(resp.Body.String(), "imageproxy_") {
+			t.Errorf("MetricsHandler did not return imageproxy metrics")
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_transformFallback(t *testing.T) {
+	// a GIF header with no image data can be detected, but not decoded
+	body := []byte("GIF89a")
+
+	tests := []struct {
+		fail     bool
+		code     int
+		fallback float64 // expected increase in transform fallbacks
+	}{
+		{false, http.StatusOK, 1},
+		{true, http.StatusInternalServerError, 0},
+	}
+
+	for _, tt := range tests {
+		p := NewProxy(&bodyTransport{body: body, header: http.Header{"Content-Type": {"image/gif"}}}, nil)
+		p.FailOnTransformError = tt.fail
+		logs := new(bytes.Buffer)
+		p.Logger = log.New(logs, "", 0)
+
+		before := counterValue(t, metricTransformFallback)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, httptest.NewRequest("GET", "/100/http://good.test/image", nil))
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("ServeHTTP with FailOnTransformError %t returned status %d, want %d", tt.fail, got, want)
+		}
+		if got, want := counterValue(t, metricTransformFallback)-before, tt.fallback; got != want {
+			t.Errorf("ServeHTTP with FailOnTransformError %t counted %v transform fallbacks, want %v", tt.fail, got, want)
+		}
+
+		if tt.fail {
+			continue
+		}
+		if got := resp.Body.Bytes(); !bytes.Equal(got, body) {
+			t.Errorf("ServeHTTP returned %q, want original image %q", got, body)
+		}
+		if got, want := logs.String(), "warning: error transforming image http://good.test/image"; !strings.Contains(got, want) {
+			t.Errorf("ServeHTTP logged %q, want it to contain %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// overlayGravities maps the values of the overlay gravity option to the
+// position of the overlay within the image.
+var overlayGravities = map[string]imaging.Anchor{
+	"c":  imaging.Center,
+	"n":  imaging.Top,
+	"ne": imaging.TopRight,
+	"e":  imaging.Right,
+	"se": imaging.BottomRight,
+	"s":  imaging.Bottom,
+	"sw": imaging.BottomLeft,
+	"w":  imaging.Left,
+	"nw": imaging.TopLeft,
+}
+
+// parseOverlayURL decodes the base64url encoded overlay URL s.  It returns
+// false if s is not a valid encoding of an absolute http or https URL.
+func parseOverlayURL(s string) (string, bool) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return "", false
+	}
+	u, err := url.Parse(string(b))
+	if err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+	return u.String(), true
+}
+
+// overlayError is returned by TransformingTransport for errors fetching or
+// decoding an overlay image, which are not errors of the image being
+// transformed.
+type overlayError struct {
+	error
+}
+
+func (e overlayError) Unwrap() error { return e.error }
+
+// maxOverlayBytes is the maximum size of an encoded overlay image.  Overlays
+// are expected to be small images such as logos and badges.
+const maxOverlayBytes = 16 << 20
+
+// fetchOverlay fetches the overlay image specified by opt using client, and
+// returns the watermark to composite on top of the image.  The overlay must
+// have an image content type, and is subject to the same size limits as the
+// image it is composited on.
+func fetchOverlay(ctx context.Context, client *http.Client, opt Options) (*Watermark, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", opt.Overlay, nil)
+	if err != nil {
+		return nil, err
+	}
+	if id := requestID(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching overlay %s: remote returned status %d", opt.Overlay, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "image/") {
+		return nil, fmt.Errorf("fetching overlay %s: content-type not allowed: %q", opt.Overlay, ct)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxOverlayBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetching overlay %s: %w", opt.Overlay, err)
+	}
+	if len(b) > maxOverlayBytes {
+		return nil, fmt.Errorf("fetching overlay %s: %w: larger than %d bytes", opt.Overlay, errImageTooLarge, maxOverlayBytes)
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("decoding overlay %s: %w", opt.Overlay, err)
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, fmt.Errorf("decoding overlay %s: %w", opt.Overlay, errImageTooLarge)
+	}
+	if size := estimatedDecodedSize(cfg); opt.maxDecodedBytes > 0 && size > opt.maxDecodedBytes {
+		return nil, fmt.Errorf("decoding overlay %s: %w: %dx%d %s image needs %d bytes, limit is %d", opt.Overlay, errDecodedTooLarge, cfg.Width, cfg.Height, format, size, opt.maxDecodedBytes)
+	}
+
+	m, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("decoding overlay %s: %w", opt.Overlay, err)
+	}
+	return &Watermark{
+		Image:    m,
+		Position: overlayGravities[opt.OverlayGravity],
+		Opacity:  opt.OverlayOpacity / 100,
+		Scale:    opt.OverlayScale / 100,
+	}, nil
+}
@@ -0,0 +1,259 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// imagesTransport returns PNG encoded images by URL, and 404 Not Found for
+// any other URL.
+type imagesTransport map[string]image.Image
+
+func (t imagesTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp := &http.Response{
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       http.NoBody,
+		Request:    req,
+	}
+	m, ok := t[req.URL.String()]
+	if !ok {
+		resp.Status, resp.StatusCode = "404 Not Found", http.StatusNotFound
+		return resp, nil
+	}
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, m); err != nil {
+		return nil, err
+	}
+	resp.Status, resp.StatusCode = "200 OK", http.StatusOK
+	resp.Header.Set("Content-Type", "image/png")
+	resp.Body = io.NopCloser(buf)
+	resp.ContentLength = int64(buf.Len())
+	return resp, nil
+}
+
+func overlayOption(u string) string {
+	return optOverlayPrefix + base64.RawURLEncoding.EncodeToString([]byte(u))
+}
+
+func TestParseOverlayURL(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		ok    bool
+	}{
+		{"aHR0cHM6Ly9leGFtcGxlLmNvbS9iYWRnZS5wbmc", "https://example.com/badge.png", true},
+		{"aHR0cHM6Ly9leGFtcGxlLmNvbS9iYWRnZS5wbmc=", "https://example.com/badge.png", true},
+		{base64.RawURLEncoding.EncodeToString([]byte("ftp://example.com/badge.png")), "", false},
+		{base64.RawURLEncoding.EncodeToString([]byte("/badge.png")), "", false},
+		{"!!", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseOverlayURL(tt.input)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseOverlayURL(%q) returned %q, %t; want %q, %t", tt.input, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_overlay(t *testing.T) {
+	p := NewProxy(imagesTransport{
+		"http://good.test/base":  newImage(4, 4, blue),
+		"http://good.test/badge": newImage(2, 2, red),
+	}, nil)
+
+	tests := []struct {
+		opt        string
+		code       int
+		redPixels  []image.Point
+		bluePixels []image.Point
+	}{
+		{
+			opt:        overlayOption("http://good.test/badge") + ",g:se,png",
+			code:       http.StatusOK,
+			redPixels:  []image.Point{{2, 2}, {3, 3}},
+			bluePixels: []image.Point{{0, 0}, {1, 1}, {3, 0}, {0, 3}},
+		},
+		{
+			opt:        overlayOption("http://good.test/badge") + ",g:nw,os:25,png",
+			code:       http.StatusOK,
+			redPixels:  []image.Point{{0, 0}},
+			bluePixels: []image.Point{{1, 0}, {0, 1}, {3, 3}},
+		},
+		{
+			// missing overlay image
+			opt:  overlayOption("http://good.test/missing") + ",png",
+			code: http.StatusBadGateway,
+		},
+	}
+
+	for _, tt := range tests {
+		url := "/" + tt.opt + "/http://good.test/base"
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, httptest.NewRequest("GET", url, nil))
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("ServeHTTP(%v) returned status %d, want %d", url, got, want)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+
+		m, err := png.Decode(resp.Body)
+		if err != nil {
+			t.Errorf("ServeHTTP(%v) returned invalid image: %v", url, err)
+			continue
+		}
+		for _, pt := range tt.redPixels {
+			if got := color.NRGBAModel.Convert(m.At(pt.X, pt.Y)); got != red {
+				t.Errorf("ServeHTTP(%v) pixel at %v is %v, want %v", url, pt, got, red)
+			}
+		}
+		for _, pt := range tt.bluePixels {
+			if got := color.NRGBAModel.Convert(m.At(pt.X, pt.Y)); got != blue {
+				t.Errorf("ServeHTTP(%v) pixel at %v is %v, want %v", url, pt, got, blue)
+			}
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_overlayAllowed(t *testing.T) {
+	key := []byte("c0ffee")
+	sign := func(msg string) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(msg))
+		return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	p := NewProxy(imagesTransport{
+		"http://good.test/base":  newImage(4, 4, blue),
+		"http://good.test/badge": newImage(2, 2, red),
+		"http://evil.test/badge": newImage(2, 2, red),
+	}, nil)
+	p.AllowHosts = []string{"good.test"}
+	p.SignatureKeys = [][]byte{key}
+
+	good := overlayOption("http://good.test/badge")
+	evil := overlayOption("http://evil.test/badge")
+	evilOpt := ParseOptions(evil)
+
+	tests := []struct {
+		url  string
+		code int
+	}{
+		{"/" + good + "/http://good.test/base", http.StatusOK},
+		{"/" + evil + "/http://good.test/base", http.StatusForbidden},
+		{"/" + evil + ",s" + sign("http://good.test/base") + "/http://good.test/base", http.StatusForbidden},
+		{"/" + evil + ",s" + sign("http://good.test/base#"+evilOpt.String()) + "/http://good.test/base", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, httptest.NewRequest("GET", tt.url, nil))
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("ServeHTTP(%v) returned status %d, want %d", tt.url, got, want)
+		}
+	}
+
+	p.DenyHosts = []string{"evil.test"}
+	url := "/" + evil + ",s" + sign("http://good.test/base#"+evilOpt.String()) + "/http://good.test/base"
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, httptest.NewRequest("GET", url, nil))
+	if got, want := resp.Code, http.StatusForbidden; got != want {
+		t.Errorf("ServeHTTP(%v) with denied overlay host returned status %d, want %d", url, got, want)
+	}
+}
+
+func TestFetchOverlay_limits(t *testing.T) {
+	encode := func(m image.Image) []byte {
+		buf := new(bytes.Buffer)
+		if err := png.Encode(buf, m); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	// a PNG whose header claims dimensions far larger than its data
+	huge := encode(newImage(1, 1, red))
+	binary.BigEndian.PutUint32(huge[16:], 20000)
+	binary.BigEndian.PutUint32(huge[20:], 20000)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+
+	tests := []struct {
+		name    string
+		tr      *bodyTransport
+		maxSize int64 // maxDecodedBytes
+		err     error
+	}{
+		{"ok", &bodyTransport{body: encode(newImage(10, 10, red))}, 1000, nil},
+		{"decoded size", &bodyTransport{body: encode(newImage(100, 100, red))}, 1000, errDecodedTooLarge},
+		{"pixels", &bodyTransport{body: huge}, 0, errImageTooLarge},
+		{"encoded size", &bodyTransport{body: make([]byte, maxOverlayBytes+1)}, 0, errImageTooLarge},
+	}
+	for _, tt := range tests {
+		client := &http.Client{Transport: tt.tr}
+		opt := Options{Overlay: "http://good.test/badge", maxDecodedBytes: tt.maxSize}
+		_, err := fetchOverlay(context.Background(), client, opt)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("fetchOverlay for %s returned error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	// overlays must have an image content type
+	client := &http.Client{Transport: &bodyTransport{
+		body:   encode(newImage(10, 10, red)),
+		header: http.Header{"Content-Type": {"text/html"}},
+	}}
+	if _, err := fetchOverlay(context.Background(), client, Options{Overlay: "http://good.test/badge"}); err == nil {
+		t.Errorf("fetchOverlay with text/html content type did not return expected error")
+	}
+}
+
+func TestTransformingTransport_overlayLimiter(t *testing.T) {
+	// the overlay is fetched through the same transport while the
+	// transformation holds the only limiter slot.
+	client := new(http.Client)
+	client.Transport = &TransformingTransport{
+		Transport: imagesTransport{
+			"http://good.test/base":  newImage(4, 4, blue),
+			"http://good.test/badge": newImage(2, 2, red),
+		},
+		CachingClient: client,
+		limiter:       make(chan struct{}, 1),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	u := "http://good.test/base#" + overlayOption("http://good.test/badge") + ",png"
+	req, _ := http.NewRequestWithContext(ctx, "GET", u, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do(%v) returned error: %v", u, err)
+	}
+	resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		t.Errorf("Do(%v) returned status %d, want %d", u, got, want)
+	}
+}
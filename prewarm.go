@@ -0,0 +1,146 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// prewarmPath is the path of the endpoint used to pre-generate images.
+const prewarmPath = "/prewarm"
+
+// maxPrewarmBody is the maximum size of a prewarm request body.
+const maxPrewarmBody = 1 << 20
+
+// prewarmItem is an image to pre-generate, and the result of doing so.
+type prewarmItem struct {
+	URL     string `json:"url"`
+	Options string `json:"options,omitempty"`
+	Status  int    `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// servePrewarm handles requests to pre-generate images, populating the cache
+// ahead of time.  The request body is a JSON list of objects with "url" and
+// "options" fields, in the same form as they appear in a normal request URL:
+//
+//	[{"url": "http://example.com/image.jpg", "options": "100x100,q80"}]
+//
+// Each image is fetched and transformed as if it had been requested directly,
+// using the headers of the prewarm request, so the same access controls
+// apply.  If the proxy has signature keys, each image must also be signed.
+// Images are processed concurrently, and the response lists the status of
+// each item in the same order they were requested.
+//
+// The endpoint is not found unless p.EnablePrewarm is set.
+func (p *Proxy) servePrewarm(w http.ResponseWriter, r *http.Request) {
+	if !p.EnablePrewarm {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var items []prewarmItem
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPrewarmBody)).Decode(&items); err != nil {
+		msg := fmt.Sprintf("invalid prewarm request: %v", err)
+		p.log(r.Context(), msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	work := make(chan *prewarmItem)
+	var wg sync.WaitGroup
+	for range min(runtime.NumCPU(), len(items)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range work {
+				p.prewarm(r, item)
+			}
+		}()
+	}
+	for i := range items {
+		work <- &items[i]
+	}
+	close(work)
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// prewarm fetches and transforms the image described by item, as if it had
+// been requested using the headers of the original request r, and records
+// the resulting status in item.
+func (p *Proxy) prewarm(r *http.Request, item *prewarmItem) {
+	path := "/" + item.URL
+	if item.Options != "" {
+		path = "/" + item.Options + path
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), "GET", path, nil)
+	if err != nil {
+		item.Status = http.StatusBadRequest
+		item.Error = fmt.Sprintf("invalid request URL: %v", err)
+		return
+	}
+	req.Header = r.Header.Clone()
+	// always fetch the full image, even if the client has a cached copy
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+
+	// when signatures are in use, allowed hosts alone aren't enough, so
+	// that unsigned prewarm requests can't be used to amplify load.
+	if len(p.SignatureKeys) > 0 || len(p.SignatureKeysByID) > 0 {
+		if pr, err := NewRequest(req, p.DefaultBaseURL); err == nil && !p.signed(pr) {
+			item.Status = http.StatusForbidden
+			item.Error = msgNotAllowed
+			return
+		}
+	}
+
+	resp := &discardResponseWriter{header: make(http.Header)}
+	p.serveImage(resp, req)
+
+	item.Status = resp.status
+	if item.Status == 0 {
+		item.Status = http.StatusOK
+	}
+	if item.Status >= 400 {
+		item.Error = strings.TrimSpace(resp.errorBody.String())
+	}
+}
+
+// discardResponseWriter is an http.ResponseWriter that records the response
+// status, discarding the body of successful responses.
+type discardResponseWriter struct {
+	header    http.Header
+	status    int
+	errorBody strings.Builder
+}
+
+func (w *discardResponseWriter) Header() http.Header { return w.header }
+
+func (w *discardResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.status >= 400 {
+		w.errorBody.Write(b)
+	}
+	return len(b), nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/die-net/lrucache"
+)
+
+func TestProxy_ServeHTTP_prewarm(t *testing.T) {
+	cache := lrucache.New(1024*1024*8, 0)
+	p := NewProxy(&testTransport{}, cache)
+	p.AllowHosts = []string{"good.test"}
+	p.ContentTypes = []string{"image/*"}
+	p.EnablePrewarm = true
+
+	body := `[
+		{"url": "http://good.test/png", "options": "10x10"},
+		{"url": "http://good.test/png"},
+		{"url": "http://bad.test/png", "options": "10x10"},
+		{"url": "ftp://good.test/png"}
+	]`
+	req := httptest.NewRequest("POST", "/prewarm", strings.NewReader(body))
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Fatalf("ServeHTTP(%v) returned status %d, want %d", req, got, want)
+	}
+
+	var items []prewarmItem
+	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	var statuses []int
+	for _, item := range items {
+		statuses = append(statuses, item.Status)
+		if item.Status != http.StatusOK && item.Error == "" {
+			t.Errorf("item %v has no error message", item)
+		}
+	}
+	if want := []int{200, 200, 403, 400}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("prewarm returned statuses %v, want %v", statuses, want)
+	}
+
+	for _, key := range []string{"http://good.test/png#10x10", "http://good.test/png#0x0"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Errorf("cache does not contain %q after prewarm", key)
+		}
+	}
+	if _, ok := cache.Get("http://bad.test/png#10x10"); ok {
+		t.Errorf("cache contains disallowed image after prewarm")
+	}
+}
+
+func TestProxy_ServeHTTP_prewarmInvalid(t *testing.T) {
+	p := NewProxy(&testTransport{}, nil)
+	p.EnablePrewarm = true
+
+	tests := []struct {
+		method string
+		body   string
+		code   int // expected response status code
+	}{
+		{"GET", "", http.StatusMethodNotAllowed},
+		{"POST", "", http.StatusBadRequest},
+		{"POST", "{}", http.StatusBadRequest},
+		{"POST", "[]", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/prewarm", strings.NewReader(tt.body))
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("%s /prewarm with body %q returned status %d, want %d", tt.method, tt.body, got, want)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_prewarmDisabled(t *testing.T) {
+	p := NewProxy(&testTransport{}, nil)
+	p.AllowHosts = []string{"good.test"}
+
+	req := httptest.NewRequest("POST", "/prewarm", strings.NewReader(`[{"url": "http://good.test/png"}]`))
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+	if got, want := resp.Code, http.StatusNotFound; got != want {
+		t.Errorf("ServeHTTP(%v) returned status %d, want %d", req, got, want)
+	}
+}
+
+func TestProxy_ServeHTTP_prewarmSigned(t *testing.T) {
+	key := []byte("c0ffee")
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("http://good.test/png#10x10"))
+	sig := base64.URLEncoding.EncodeToString(mac.Sum(nil))
+
+	p := NewProxy(&testTransport{}, nil)
+	p.AllowHosts = []string{"good.test"}
+	p.SignatureKeys = [][]byte{key}
+	p.EnablePrewarm = true
+
+	body := `[
+		{"url": "http://good.test/png", "options": "10x10,s` + sig + `"},
+		{"url": "http://good.test/png", "options": "10x10"},
+		{"url": "http://good.test/png", "options": "20x20,s` + sig + `"}
+	]`
+	req := httptest.NewRequest("POST", "/prewarm", strings.NewReader(body))
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+
+	var items []prewarmItem
+	if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	var statuses []int
+	for _, item := range items {
+		statuses = append(statuses, item.Status)
+	}
+	if want := []int{200, 403, 403}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("prewarm returned statuses %v, want %v", statuses, want)
+	}
+}
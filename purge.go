@@ -0,0 +1,173 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// purgePath is the path prefix of the endpoint used to evict cached images.
+const purgePath = "/purge"
+
+// keyIndex is a Cache that records the keys of cached entries by the remote
+// URL they were derived from, so that every rendition of a remote image can
+// be evicted at once.  Only entries cached by this process are indexed.
+//
+// The index holds at most size() keys.  When it is full, the keys of the
+// remote URLs least recently cached are forgotten, and those entries can no
+// longer be purged.  If size() is zero, nothing is indexed.
+type keyIndex struct {
+	Cache
+	size func() int
+
+	mu   sync.Mutex
+	n    int                      // number of keys indexed
+	lru  *list.List               // of *indexEntry, most recently set first
+	srcs map[string]*list.Element // remote URL => element in lru
+}
+
+// indexEntry holds the cache keys derived from the remote URL src.
+type indexEntry struct {
+	src  string
+	keys map[string]bool
+}
+
+// sourceKey returns the remote URL that the cache key was derived from.
+// Cache keys for transformed images have their options in the URL fragment.
+func sourceKey(key string) string {
+	src, _, _ := strings.Cut(key, "#")
+	return src
+}
+
+func (c *keyIndex) Set(key string, data []byte) {
+	c.Cache.Set(key, data)
+
+	size := c.size()
+	if size <= 0 {
+		return
+	}
+
+	src := sourceKey(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.srcs == nil {
+		c.lru = list.New()
+		c.srcs = make(map[string]*list.Element)
+	}
+	e, ok := c.srcs[src]
+	if ok {
+		c.lru.MoveToFront(e)
+	} else {
+		e = c.lru.PushFront(&indexEntry{src: src, keys: make(map[string]bool)})
+		c.srcs[src] = e
+	}
+	if entry := e.Value.(*indexEntry); !entry.keys[key] {
+		entry.keys[key] = true
+		c.n++
+	}
+	for c.n > size {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *keyIndex) Delete(key string) {
+	c.Cache.Delete(key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.srcs[sourceKey(key)]
+	if !ok {
+		return
+	}
+	entry := e.Value.(*indexEntry)
+	if entry.keys[key] {
+		delete(entry.keys, key)
+		c.n--
+	}
+	if len(entry.keys) == 0 {
+		c.remove(e)
+	}
+}
+
+// remove removes e from the index, without deleting its cached entries.
+// c.mu must be held.
+func (c *keyIndex) remove(e *list.Element) *indexEntry {
+	entry := c.lru.Remove(e).(*indexEntry)
+	delete(c.srcs, entry.src)
+	c.n -= len(entry.keys)
+	return entry
+}
+
+// purge deletes all cached entries derived from the remote URL src,
+// returning the number of entries deleted.
+func (c *keyIndex) purge(src string) int {
+	c.mu.Lock()
+	e, ok := c.srcs[src]
+	if !ok {
+		c.mu.Unlock()
+		return 0
+	}
+	entry := c.remove(e)
+	c.mu.Unlock()
+
+	for key := range entry.keys {
+		c.Cache.Delete(key)
+	}
+	return len(entry.keys)
+}
+
+// servePurge handles requests to evict every cached rendition of a remote
+// image, regardless of the options used to request it.  The request is a
+// DELETE to the image URL prefixed with /purge, signed for the remote URL
+// alone:
+//
+//	DELETE /purge/s{signature}/http://example.com/image.jpg
+//
+// Purge requests must always be signed, so the endpoint is unavailable if
+// the proxy has no signature keys.  The endpoint is not found unless
+// PurgeIndexSize is set.
+func (p *Proxy) servePurge(w http.ResponseWriter, r *http.Request) {
+	if p.PurgeIndexSize <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req *Request
+	var err error
+	http.StripPrefix(purgePath, http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		req, err = NewRequest(r, p.DefaultBaseURL)
+	})).ServeHTTP(w, r)
+	if err != nil {
+		msg := fmt.Sprintf("invalid request URL: %v", err)
+		p.log(r.Context(), msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	if !p.signed(req) {
+		p.logf(r.Context(), "purge request is not signed: %v", req)
+		http.Error(w, msgNotAllowed, http.StatusForbidden)
+		return
+	}
+
+	src := stripQueryParams(req.URL.String(), p.IgnoreQueryParams)
+	n := p.cacheIndex.purge(src)
+	p.logf(r.Context(), "purged %d cached entries for %s", n, src)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		URL    string `json:"url"`
+		Purged int    `json:"purged"`
+	}{src, n})
+}
@@ -0,0 +1,168 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/die-net/lrucache"
+)
+
+func TestKeyIndex(t *testing.T) {
+	cache := lrucache.New(1024*1024, 0)
+	c := &keyIndex{Cache: cache, size: func() int { return 10 }}
+	c.Set("http://a.test/img#10x10", []byte("a"))
+	c.Set("http://a.test/img#20x20", []byte("b"))
+	c.Set("http://a.test/img", []byte("c"))
+	c.Set("http://a.test/img2#10x10", []byte("d"))
+	c.Delete("http://a.test/img#20x20")
+
+	if got, want := c.purge("http://a.test/img"), 2; got != want {
+		t.Errorf("purge returned %d, want %d", got, want)
+	}
+	for _, key := range []string{"http://a.test/img#10x10", "http://a.test/img"} {
+		if _, ok := cache.Get(key); ok {
+			t.Errorf("cache contains %q after purge", key)
+		}
+	}
+	if _, ok := cache.Get("http://a.test/img2#10x10"); !ok {
+		t.Errorf("purge removed entry for a different remote URL")
+	}
+	if got, want := c.purge("http://a.test/img"), 0; got != want {
+		t.Errorf("second purge returned %d, want %d", got, want)
+	}
+}
+
+func TestKeyIndex_size(t *testing.T) {
+	cache := lrucache.New(1024*1024, 0)
+	size := 4
+	c := &keyIndex{Cache: cache, size: func() int { return size }}
+	c.Set("http://a.test/img#10x10", []byte("a"))
+	c.Set("http://a.test/img#20x20", []byte("b"))
+	c.Set("http://b.test/img#10x10", []byte("c"))
+	c.Set("http://a.test/img#30x30", []byte("d")) // a.test is now most recent
+	c.Set("http://c.test/img#10x10", []byte("e")) // evicts b.test from the index
+
+	if got, want := c.n, 4; got != want {
+		t.Errorf("index has %d keys, want %d", got, want)
+	}
+	if got, want := c.purge("http://b.test/img"), 0; got != want {
+		t.Errorf("purge of evicted URL returned %d, want %d", got, want)
+	}
+	if _, ok := cache.Get("http://b.test/img#10x10"); !ok {
+		t.Errorf("eviction from index removed cached entry")
+	}
+	if got, want := c.purge("http://a.test/img"), 3; got != want {
+		t.Errorf("purge returned %d, want %d", got, want)
+	}
+
+	// a single remote URL with more keys than the index holds
+	c.Set("http://d.test/img#1x1", []byte("f"))
+	c.Set("http://d.test/img#2x2", []byte("g"))
+	c.Set("http://d.test/img#3x3", []byte("h"))
+	c.Set("http://d.test/img#4x4", []byte("i"))
+	c.Set("http://d.test/img#5x5", []byte("j"))
+	if c.n > size {
+		t.Errorf("index has %d keys, want at most %d", c.n, size)
+	}
+
+	// nothing is indexed when size is zero
+	size = 0
+	c.Set("http://e.test/img#10x10", []byte("k"))
+	if got, want := c.purge("http://e.test/img"), 0; got != want {
+		t.Errorf("purge with index disabled returned %d, want %d", got, want)
+	}
+}
+
+func TestProxy_ServeHTTP_purge(t *testing.T) {
+	key := []byte("c0ffee")
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("http://good.test/png"))
+	sig := base64.URLEncoding.EncodeToString(mac.Sum(nil))
+
+	cache := lrucache.New(1024*1024*8, 0)
+	p := NewProxy(&testTransport{}, cache)
+	p.AllowHosts = []string{"good.test"}
+	p.SignatureKeys = [][]byte{key}
+	p.PurgeIndexSize = 100
+
+	// cache three renditions of one image, and one of another
+	renditions := []string{"10x10", "20x20", "0x0"}
+	for _, opt := range renditions {
+		req := httptest.NewRequest("GET", "/"+opt+"/http://good.test/png", nil)
+		p.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/10x10/http://good.test/plain", nil))
+	for _, opt := range renditions {
+		if _, ok := cache.Get("http://good.test/png#" + opt); !ok {
+			t.Fatalf("cache does not contain rendition %q before purge", opt)
+		}
+	}
+
+	tests := []struct {
+		method string
+		url    string
+		code   int // expected response status code
+	}{
+		{"GET", "/purge/s" + sig + "/http://good.test/png", http.StatusMethodNotAllowed},
+		{"DELETE", "/purge/", http.StatusBadRequest},
+		{"DELETE", "/purge/http://good.test/png", http.StatusForbidden},
+		{"DELETE", "/purge/sBAD/http://good.test/png", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, httptest.NewRequest(tt.method, tt.url, nil))
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("%s %s returned status %d, want %d", tt.method, tt.url, got, want)
+		}
+	}
+	if _, ok := cache.Get("http://good.test/png#10x10"); !ok {
+		t.Errorf("cache does not contain rendition after rejected purge")
+	}
+
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, httptest.NewRequest("DELETE", "/purge/s"+sig+"/http://good.test/png", nil))
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Fatalf("purge returned status %d, want %d", got, want)
+	}
+	if body := resp.Body.String(); !strings.Contains(body, `"url":"http://good.test/png"`) {
+		t.Errorf("purge returned body %s, want remote URL", body)
+	}
+
+	for _, opt := range renditions {
+		if _, ok := cache.Get("http://good.test/png#" + opt); ok {
+			t.Errorf("cache contains rendition %q after purge", opt)
+		}
+	}
+	if _, ok := cache.Get("http://good.test/plain#10x10"); !ok {
+		t.Errorf("purge removed rendition of a different image")
+	}
+}
+
+func TestProxy_ServeHTTP_purgeDisabled(t *testing.T) {
+	key := []byte("c0ffee")
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("http://good.test/png"))
+	sig := base64.URLEncoding.EncodeToString(mac.Sum(nil))
+
+	cache := lrucache.New(1024*1024*8, 0)
+	p := NewProxy(&testTransport{}, cache)
+	p.SignatureKeys = [][]byte{key}
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/10x10/http://good.test/png", nil))
+
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, httptest.NewRequest("DELETE", "/purge/s"+sig+"/http://good.test/png", nil))
+	if got, want := resp.Code, http.StatusNotFound; got != want {
+		t.Errorf("purge returned status %d, want %d", got, want)
+	}
+	if p.cacheIndex.n != 0 {
+		t.Errorf("index has %d keys with purging disabled, want 0", p.cacheIndex.n)
+	}
+}
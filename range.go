@@ -0,0 +1,83 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errRangeNotSatisfiable is returned by parseRange for ranges that don't
+// overlap the content.
+var errRangeNotSatisfiable = errors.New("requested range not satisfiable")
+
+// parseRange parses the value of a Range header for content of the given
+// size, returning the offsets of the first and last bytes of the range.
+// Only a single byte range is supported, so an error is returned for
+// multiple ranges, and for malformed values, in which case the full content
+// should be served.  errRangeNotSatisfiable is returned if the range starts
+// beyond the end of the content.
+func parseRange(s string, size int64) (first, last int64, err error) {
+	spec, ok := strings.CutPrefix(s, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, errors.New("unsupported range")
+	}
+	start, end, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, errors.New("invalid range")
+	}
+
+	if start == "" {
+		// suffix range of the last n bytes
+		n, err := strconv.ParseInt(end, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, errors.New("invalid range")
+		}
+		if n == 0 {
+			return 0, 0, errRangeNotSatisfiable
+		}
+		return max(size-n, 0), size - 1, nil
+	}
+
+	first, err = strconv.ParseInt(start, 10, 64)
+	if err != nil || first < 0 {
+		return 0, 0, errors.New("invalid range")
+	}
+	last = size - 1
+	if end != "" {
+		last, err = strconv.ParseInt(end, 10, 64)
+		if err != nil || last < first {
+			return 0, 0, errors.New("invalid range")
+		}
+		last = min(last, size-1)
+	}
+	if first >= size {
+		return 0, 0, errRangeNotSatisfiable
+	}
+	return first, last, nil
+}
+
+// ifRangeMatches returns whether the validator in the If-Range header value
+// ifRange matches the response headers hdr, in which case a requested range
+// should be served.  Otherwise the representation has changed, and the full
+// content should be served instead.  Entity tags must match using strong
+// comparison, and dates must exactly match the Last-Modified header.  An
+// empty ifRange always matches.
+func ifRangeMatches(ifRange string, hdr http.Header) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		etag := hdr.Get("Etag")
+		return etag != "" && !strings.HasPrefix(etag, "W/") && ifRange == etag
+	}
+	t, err := parseHTTPTime(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := parseHTTPTime(hdr.Get("Last-Modified"))
+	return err == nil && t.Equal(lastModified)
+}
@@ -0,0 +1,150 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		s           string
+		first, last int64
+		err         error // expected error; errAny for any error
+	}{
+		{"bytes=0-9", 0, 9, nil},
+		{"bytes=10-", 10, 99, nil},
+		{"bytes=-10", 90, 99, nil},
+		{"bytes=-200", 0, 99, nil},
+		{"bytes=50-500", 50, 99, nil},
+		{"bytes=100-", 0, 0, errRangeNotSatisfiable},
+		{"bytes=-0", 0, 0, errRangeNotSatisfiable},
+
+		// unsupported or malformed
+		{"bytes=0-9,20-29", 0, 0, errAny},
+		{"items=0-9", 0, 0, errAny},
+		{"bytes=9-0", 0, 0, errAny},
+		{"bytes=a-b", 0, 0, errAny},
+		{"bytes=10", 0, 0, errAny},
+	}
+
+	for _, tt := range tests {
+		first, last, err := parseRange(tt.s, 100)
+		if tt.err == errAny {
+			if err == nil || errors.Is(err, errRangeNotSatisfiable) {
+				t.Errorf("parseRange(%q) returned error %v, want invalid range error", tt.s, err)
+			}
+			continue
+		}
+		if !errors.Is(err, tt.err) {
+			t.Errorf("parseRange(%q) returned error %v, want %v", tt.s, err, tt.err)
+		}
+		if first != tt.first || last != tt.last {
+			t.Errorf("parseRange(%q) returned %d-%d, want %d-%d", tt.s, first, last, tt.first, tt.last)
+		}
+	}
+}
+
+// errAny is used in tests to indicate that any error is expected.
+var errAny = errors.New("any error")
+
+func TestIfRangeMatches(t *testing.T) {
+	hdr := http.Header{
+		"Etag":          {`"tag"`},
+		"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"},
+	}
+	weak := http.Header{"Etag": {`W/"tag"`}}
+
+	tests := []struct {
+		ifRange string
+		hdr     http.Header
+		want    bool
+	}{
+		{"", hdr, true},
+		{`"tag"`, hdr, true},
+		{`"other"`, hdr, false},
+		{"Mon, 02 Jan 2006 15:04:05 GMT", hdr, true},
+		{"Mon, 02 Jan 2006 15:04:04 GMT", hdr, false},
+		{"invalid", hdr, false},
+		// weak entity tags never match
+		{`W/"tag"`, weak, false},
+		{`"tag"`, weak, false},
+	}
+
+	for _, tt := range tests {
+		if got := ifRangeMatches(tt.ifRange, tt.hdr); got != tt.want {
+			t.Errorf("ifRangeMatches(%q, %v) returned %t, want %t", tt.ifRange, tt.hdr, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_ifRange(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, newImage(10, 10, red)); err != nil {
+		t.Fatalf("error encoding source image: %v", err)
+	}
+	body := buf.Bytes()
+	lastModified := "Mon, 02 Jan 2006 15:04:05 GMT"
+
+	p := NewProxy(&bodyTransport{body: body, etag: true, header: http.Header{
+		"Last-Modified": {lastModified},
+	}}, nil)
+
+	// find the entity tag of the image served by the proxy
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, httptest.NewRequest("GET", "/http://good.test/png", nil))
+	etag := resp.Header().Get("Etag")
+	if etag == "" {
+		t.Fatalf("ServeHTTP returned no Etag")
+	}
+	if got, want := resp.Header().Get("Accept-Ranges"), "bytes"; got != want {
+		t.Errorf("ServeHTTP returned Accept-Ranges %q, want %q", got, want)
+	}
+
+	tests := []struct {
+		url     string
+		rng     string
+		ifRange string
+		code    int    // expected response status code
+		body    []byte // expected response body
+	}{
+		{"/http://good.test/png", "bytes=0-7", "", http.StatusPartialContent, body[:8]},
+		{"/http://good.test/png", "bytes=0-7", etag, http.StatusPartialContent, body[:8]},
+		{"/http://good.test/png", "bytes=8-", lastModified, http.StatusPartialContent, body[8:]},
+		{"/http://good.test/png", "bytes=1000-", "", http.StatusRequestedRangeNotSatisfiable, nil},
+
+		// validators that don't match return the full image
+		{"/http://good.test/png", "bytes=0-7", `"other"`, http.StatusOK, body},
+		{"/http://good.test/png", "bytes=0-7", "Mon, 02 Jan 2006 15:04:04 GMT", http.StatusOK, body},
+
+		// transformed images are always served in full
+		{"/5x5/http://good.test/png", "bytes=0-7", "", http.StatusOK, nil},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.url, nil)
+		req.Header.Set("Range", tt.rng)
+		if tt.ifRange != "" {
+			req.Header.Set("If-Range", tt.ifRange)
+		}
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("ServeHTTP(%q, Range %q, If-Range %q) returned status %d, want %d", tt.url, tt.rng, tt.ifRange, got, want)
+			continue
+		}
+		if tt.body != nil && !bytes.Equal(resp.Body.Bytes(), tt.body) {
+			t.Errorf("ServeHTTP(%q, Range %q, If-Range %q) returned %d bytes, want %d", tt.url, tt.rng, tt.ifRange, resp.Body.Len(), len(tt.body))
+		}
+		if tt.code == http.StatusPartialContent && resp.Header().Get("Content-Range") == "" {
+			t.Errorf("ServeHTTP(%q, Range %q) returned no Content-Range", tt.url, tt.rng)
+		}
+	}
+}
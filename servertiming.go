@@ -0,0 +1,69 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverTiming records the time spent handling a request, reported to clients
+// in the Server-Timing header.
+type serverTiming struct {
+	mu          sync.Mutex
+	transform   time.Duration // time spent transforming the image
+	transformed bool          // whether the image was transformed
+}
+
+type serverTimingKey struct{}
+
+// withServerTiming returns a copy of ctx carrying st.
+func withServerTiming(ctx context.Context, st *serverTiming) context.Context {
+	return context.WithValue(ctx, serverTimingKey{}, st)
+}
+
+// serverTimingFromContext returns the serverTiming carried by ctx, or nil.
+func serverTimingFromContext(ctx context.Context) *serverTiming {
+	st, _ := ctx.Value(serverTimingKey{}).(*serverTiming)
+	return st
+}
+
+// addTransform records time spent transforming the image.  It is safe to call
+// on a nil serverTiming.
+func (st *serverTiming) addTransform(d time.Duration) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.transform += d
+	st.transformed = true
+}
+
+// header returns the value of the Server-Timing header for a request whose
+// response took total to be returned by the proxy's client, and whether it was
+// served from cache.  The fetch duration excludes time spent transforming.
+func (st *serverTiming) header(total time.Duration, cached bool) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	metrics := []string{fmt.Sprintf("fetch;dur=%s", timingDuration(total-st.transform))}
+	if st.transformed {
+		metrics = append(metrics, fmt.Sprintf("transform;dur=%s", timingDuration(st.transform)))
+	}
+	if cached {
+		metrics = append(metrics, `cache;desc="hit"`)
+	} else {
+		metrics = append(metrics, `cache;desc="miss"`)
+	}
+	return strings.Join(metrics, ", ")
+}
+
+// timingDuration formats d in milliseconds, as used in the Server-Timing header.
+func timingDuration(d time.Duration) string {
+	return fmt.Sprintf("%.1f", float64(max(d, 0))/float64(time.Millisecond))
+}
@@ -0,0 +1,54 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestProxy_ServeHTTP_serverTiming(t *testing.T) {
+	p := NewProxy(&testTransport{}, nil)
+
+	// disabled by default
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, httptest.NewRequest("GET", "/100/http://good.test/png", nil))
+	if got := resp.Header().Get("Server-Timing"); got != "" {
+		t.Errorf("ServeHTTP returned Server-Timing %q, want none", got)
+	}
+
+	p.ServerTiming = true
+	tests := []struct {
+		url  string
+		want *regexp.Regexp
+	}{
+		{"/100/http://good.test/png", regexp.MustCompile(`^fetch;dur=\d+\.\d, transform;dur=\d+\.\d, cache;desc="miss"$`)},
+	}
+
+	for _, tt := range tests {
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, httptest.NewRequest("GET", tt.url, nil))
+		if got, want := resp.Code, http.StatusOK; got != want {
+			t.Errorf("ServeHTTP(%v) returned status %d, want %d", tt.url, got, want)
+		}
+		if got := resp.Header().Get("Server-Timing"); !tt.want.MatchString(got) {
+			t.Errorf("ServeHTTP(%v) returned Server-Timing %q, want match for %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestServerTiming_header(t *testing.T) {
+	st := new(serverTiming)
+	if got, want := st.header(5*time.Millisecond, true), `fetch;dur=5.0, cache;desc="hit"`; got != want {
+		t.Errorf("header() returned %q, want %q", got, want)
+	}
+
+	st.addTransform(1500 * time.Microsecond)
+	if got, want := st.header(5*time.Millisecond, false), `fetch;dur=3.5, transform;dur=1.5, cache;desc="miss"`; got != want {
+		t.Errorf("header() returned %q, want %q", got, want)
+	}
+}
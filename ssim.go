@@ -0,0 +1,120 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io"
+
+	"github.com/disintegration/imaging"
+)
+
+// range of JPEG qualities searched when using automatic quality
+const (
+	minAutoQuality = 10
+	maxAutoQuality = 100
+)
+
+// size of the square blocks SSIM is calculated over
+const ssimBlockSize = 8
+
+// encodeAutoQualityJPEG writes m to w as a JPEG, using the lowest quality for
+// which the SSIM of the encoded image compared to m is at least target.  If
+// no quality reaches the target, the maximum quality is used.  Images are
+// encoded with the chroma subsampling described by encodeJPEG.
+func encodeAutoQualityJPEG(w io.Writer, m image.Image, target float64, subsampling string) error {
+	src := lumaPlane(m)
+
+	// binary search for the lowest acceptable quality, assuming that SSIM
+	// increases with quality.
+	var best []byte
+	lo, hi := minAutoQuality, maxAutoQuality
+	for lo <= hi {
+		q := (lo + hi) / 2
+		buf := new(bytes.Buffer)
+		if err := encodeJPEG(buf, m, q, subsampling); err != nil {
+			return err
+		}
+		enc, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return err
+		}
+
+		if ssim(src, lumaPlane(enc)) >= target {
+			best = buf.Bytes()
+			hi = q - 1
+		} else {
+			lo = q + 1
+		}
+	}
+
+	if best == nil {
+		return encodeJPEG(w, m, maxAutoQuality, subsampling)
+	}
+	_, err := w.Write(best)
+	return err
+}
+
+// plane is a single channel of an image.
+type plane struct {
+	pix           []float64
+	width, height int
+}
+
+// lumaPlane returns the luma of each pixel of m.
+func lumaPlane(m image.Image) plane {
+	img := imaging.Clone(m)
+	size := img.Bounds().Size()
+	p := plane{pix: make([]float64, size.X*size.Y), width: size.X, height: size.Y}
+	for i := range p.pix {
+		c := img.Pix[i*4 : i*4+4]
+		p.pix[i] = 0.299*float64(c[0]) + 0.587*float64(c[1]) + 0.114*float64(c[2])
+	}
+	return p
+}
+
+// ssim returns the mean structural similarity (SSIM) of a and b, which must
+// be the same size.  SSIM is calculated over non-overlapping square blocks,
+// and ranges from 1 for identical images down to -1.
+func ssim(a, b plane) float64 {
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+
+	bw, bh := min(ssimBlockSize, a.width), min(ssimBlockSize, a.height)
+	if bw == 0 || bh == 0 {
+		return 1
+	}
+	n := float64(bw * bh)
+
+	var total float64
+	var blocks int
+	for y0 := 0; y0+bh <= a.height; y0 += bh {
+		for x0 := 0; x0+bw <= a.width; x0 += bw {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for y := y0; y < y0+bh; y++ {
+				for x := x0; x < x0+bw; x++ {
+					va, vb := a.pix[y*a.width+x], b.pix[y*b.width+x]
+					sumA += va
+					sumB += vb
+					sumAA += va * va
+					sumBB += vb * vb
+					sumAB += va * vb
+				}
+			}
+			meanA, meanB := sumA/n, sumB/n
+			varA := sumAA/n - meanA*meanA
+			varB := sumBB/n - meanB*meanB
+			cov := sumAB/n - meanA*meanB
+
+			total += (2*meanA*meanB + c1) * (2*cov + c2) /
+				((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			blocks++
+		}
+	}
+	return total / float64(blocks)
+}
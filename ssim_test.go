@@ -0,0 +1,72 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"testing"
+)
+
+// detailedImage returns an image with enough detail that JPEG quality has a
+// noticeable effect.
+func detailedImage(width, height int) *image.NRGBA {
+	m := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			m.Set(x, y, color.NRGBA{uint8(x * y), uint8(x ^ y), uint8(x*4 + y), 255})
+		}
+	}
+	return m
+}
+
+func TestSSIM(t *testing.T) {
+	a := lumaPlane(detailedImage(32, 32))
+	if got := ssim(a, a); math.Abs(got-1) > 1e-9 {
+		t.Errorf("ssim of identical images returned %v, want 1", got)
+	}
+
+	b := lumaPlane(newImage(32, 32, color.NRGBA{128, 128, 128, 255}))
+	if got := ssim(a, b); got > 0.5 {
+		t.Errorf("ssim of different images returned %v, want less than 0.5", got)
+	}
+
+	// images smaller than a block
+	c := lumaPlane(newImage(2, 2, red, green, blue, yellow))
+	if got := ssim(c, c); math.Abs(got-1) > 1e-9 {
+		t.Errorf("ssim of identical small images returned %v, want 1", got)
+	}
+}
+
+func TestTransform_AutoQuality(t *testing.T) {
+	src := detailedImage(64, 64)
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, src); err != nil {
+		t.Errorf("error encoding reference image: %v", err)
+	}
+
+	encode := func(target float64) []byte {
+		b, err := Transform(buf.Bytes(), Options{Format: "jpeg", AutoQuality: target})
+		if err != nil {
+			t.Fatalf("Transform with autoq%v returned unexpected error: %v", target, err)
+		}
+		m, err := jpeg.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("error decoding jpeg: %v", err)
+		}
+		if got := ssim(lumaPlane(src), lumaPlane(m)); got < target {
+			t.Errorf("Transform with autoq%v returned image with ssim %v", target, got)
+		}
+		return b
+	}
+
+	low, high := encode(0.5), encode(0.98)
+	if len(low) >= len(high) {
+		t.Errorf("autoq0.5 image is %d bytes, autoq0.98 image is %d bytes; want smaller image for lower target", len(low), len(high))
+	}
+}
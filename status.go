@@ -0,0 +1,150 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// readyPath is the path of the endpoint reporting whether the proxy is
+	// ready to serve requests.
+	readyPath = "/ready"
+
+	// versionPath is the path of the endpoint reporting build information.
+	versionPath = "/version"
+
+	// cacheStatsPath is the path of the endpoint reporting cache statistics.
+	cacheStatsPath = "/cache/stats"
+)
+
+// modulePath is the path of the imageproxy Go module.
+const modulePath = "willnorris.com/go/imageproxy"
+
+// readinessCacheKeyPrefix is the prefix of cache keys written by
+// CacheReadinessCheck.
+const readinessCacheKeyPrefix = "imageproxy-readiness-check-"
+
+// ReadinessCheck reports whether a dependency of the proxy is available,
+// returning an error if it is not.
+type ReadinessCheck func(ctx context.Context) error
+
+// OriginReadinessCheck returns a ReadinessCheck that requests the canary URL
+// u using client, failing unless it returns a 2xx response.
+func OriginReadinessCheck(client *http.Client, u string) ReadinessCheck {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("origin %s returned status %d", u, resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// CacheReadinessCheck returns a ReadinessCheck that writes a value to c and
+// reads it back, failing if the cache is not writable.  Each check uses its
+// own key, so that checks by proxies sharing a cache don't interfere with
+// each other.
+func CacheReadinessCheck(c Cache) ReadinessCheck {
+	return func(context.Context) error {
+		nonce := uuid.NewString()
+		key := readinessCacheKeyPrefix + nonce
+		value := []byte(nonce)
+		c.Set(key, value)
+		defer c.Delete(key)
+		if got, ok := c.Get(key); !ok || !bytes.Equal(got, value) {
+			return errors.New("cache is not writable")
+		}
+		return nil
+	}
+}
+
+// serveReady reports whether the proxy is ready to serve requests, running
+// each of p.ReadinessChecks.  Unlike the health check, which only reports
+// that the proxy is running, this returns a 503 Service Unavailable response
+// if any check fails.
+func (p *Proxy) serveReady(w http.ResponseWriter, r *http.Request) {
+	if p.shuttingDown() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	for _, check := range p.ReadinessChecks {
+		if err := check(r.Context()); err != nil {
+			msg := fmt.Sprintf("not ready: %v", err)
+			p.log(r.Context(), msg)
+			http.Error(w, msg, http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprint(w, "OK")
+}
+
+// versionInfo is the build information returned by the version endpoint.
+type versionInfo struct {
+	Version   string `json:"version,omitempty"`
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+	Time      string `json:"time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+// serveVersion responds with JSON describing the version of imageproxy and
+// the build of the running binary.
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	info := versionInfo{GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if bi.Main.Path == modulePath {
+			info.Version = bi.Main.Version
+		}
+		for _, dep := range bi.Deps {
+			if dep.Path == modulePath {
+				info.Version = dep.Version
+			}
+		}
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				info.Revision = s.Value
+			case "vcs.time":
+				info.Time = s.Value
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// serveCacheStats responds with JSON describing the statistics of the proxy's
+// cache.  If the cache does not implement StatsReporter, a 501 Not
+// Implemented response is returned.
+func (p *Proxy) serveCacheStats(w http.ResponseWriter, r *http.Request) {
+	sr, ok := p.Cache.(StatsReporter)
+	if !ok {
+		http.Error(w, "cache does not report statistics", http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sr.CacheStats())
+}
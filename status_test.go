@@ -0,0 +1,143 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/gregjones/httpcache"
+)
+
+func TestProxy_ServeHTTP_ready(t *testing.T) {
+	ok := func(context.Context) error { return nil }
+	fail := func(context.Context) error { return errors.New("canary unreachable") }
+
+	tests := []struct {
+		checks []ReadinessCheck
+		code   int // expected response status code
+	}{
+		{nil, http.StatusOK},
+		{[]ReadinessCheck{ok}, http.StatusOK},
+		{[]ReadinessCheck{ok, fail}, http.StatusServiceUnavailable},
+		{[]ReadinessCheck{
+			OriginReadinessCheck(&http.Client{Transport: &testTransport{}}, "http://good.test/png"),
+			CacheReadinessCheck(httpcache.NewMemoryCache()),
+		}, http.StatusOK},
+		{[]ReadinessCheck{OriginReadinessCheck(&http.Client{Transport: &testTransport{}}, "http://good.test/error")}, http.StatusServiceUnavailable},
+		{[]ReadinessCheck{CacheReadinessCheck(NopCache)}, http.StatusServiceUnavailable},
+	}
+
+	for i, tt := range tests {
+		p := &Proxy{ReadinessChecks: tt.checks}
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, httptest.NewRequest("GET", "http://localhost/ready", nil))
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("%d. ServeHTTP(/ready) returned status %d, want %d: %s", i, got, want, resp.Body)
+		}
+	}
+}
+
+func TestOriginReadinessCheck(t *testing.T) {
+	client := &http.Client{Transport: &statusTransport{code: http.StatusServiceUnavailable}}
+	err := OriginReadinessCheck(client, "http://good.test/")(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("OriginReadinessCheck returned error %v, want status 503 error", err)
+	}
+}
+
+// interleavedCache is a Cache that calls during after the first Set, to
+// simulate another proxy using the same cache at the same time.
+type interleavedCache struct {
+	Cache
+	during func()
+}
+
+func (c *interleavedCache) Set(key string, data []byte) {
+	c.Cache.Set(key, data)
+	if f := c.during; f != nil {
+		c.during = nil
+		f()
+	}
+}
+
+func TestCacheReadinessCheck_shared(t *testing.T) {
+	shared := httpcache.NewMemoryCache()
+	other := CacheReadinessCheck(shared)
+	c := &interleavedCache{Cache: shared, during: func() {
+		if err := other(context.Background()); err != nil {
+			t.Errorf("interleaved CacheReadinessCheck returned error: %v", err)
+		}
+	}}
+
+	if err := CacheReadinessCheck(c)(context.Background()); err != nil {
+		t.Errorf("CacheReadinessCheck returned error: %v", err)
+	}
+}
+
+func TestProxy_ServeHTTP_version(t *testing.T) {
+	p := new(Proxy)
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, httptest.NewRequest("GET", "http://localhost/version", nil))
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Fatalf("ServeHTTP(/version) returned status %d, want %d", got, want)
+	}
+	if got, want := resp.Header().Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("ServeHTTP(/version) returned Content-Type %q, want %q", got, want)
+	}
+
+	var info versionInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatalf("error decoding version info: %v", err)
+	}
+	if got, want := info.GoVersion, runtime.Version(); got != want {
+		t.Errorf("version info has go_version %q, want %q", got, want)
+	}
+}
+
+// statsCache is a cache that reports fixed statistics.
+type statsCache struct {
+	nopCache
+	stats CacheStats
+}
+
+func (c statsCache) CacheStats() CacheStats { return c.stats }
+
+func TestProxy_ServeHTTP_cacheStats(t *testing.T) {
+	// cache without statistics
+	p := NewProxy(nil, nil)
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, httptest.NewRequest("GET", "http://localhost/cache/stats", nil))
+	if got, want := resp.Code, http.StatusNotImplemented; got != want {
+		t.Errorf("ServeHTTP(/cache/stats) without stats returned status %d, want %d", got, want)
+	}
+
+	want := CacheStats{Entries: 3, Bytes: 1024, Hits: 10, Misses: 4, Evictions: 1}
+	p = NewProxy(nil, statsCache{stats: want})
+	resp = httptest.NewRecorder()
+	p.ServeHTTP(resp, httptest.NewRequest("GET", "http://localhost/cache/stats", nil))
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Fatalf("ServeHTTP(/cache/stats) returned status %d, want %d", got, want)
+	}
+	if got, want := resp.Header().Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("ServeHTTP(/cache/stats) returned Content-Type %q, want %q", got, want)
+	}
+	if got, want := strings.TrimSpace(resp.Body.String()), `{"entries":3,"bytes":1024,"hits":10,"misses":4,"evictions":1}`; got != want {
+		t.Errorf("ServeHTTP(/cache/stats) returned body %s, want %s", got, want)
+	}
+
+	var got CacheStats
+	if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil {
+		t.Fatalf("error decoding cache stats: %v", err)
+	}
+	if got != want {
+		t.Errorf("ServeHTTP(/cache/stats) returned stats %+v, want %+v", got, want)
+	}
+}
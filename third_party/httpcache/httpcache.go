@@ -10,7 +10,7 @@ type CacheControl map[string]string
 
 func ParseCacheControl(headers http.Header) CacheControl {
 	cc := CacheControl{}
-	ccHeader := headers.Get("Cache-Control")
+	ccHeader := strings.Join(headers.Values("Cache-Control"), ",")
 	for _, part := range strings.Split(ccHeader, ",") {
 		part = strings.Trim(part, " ")
 		if part == "" {
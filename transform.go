@@ -5,15 +5,19 @@ package imageproxy
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"image"
-	_ "image/gif" // register gif format
+	"image/color"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
 	"log"
 	"math"
+	"net/http"
+	"strings"
 
 	"github.com/disintegration/imaging"
 	"github.com/muesli/smartcrop"
@@ -24,6 +28,7 @@ import (
 	"golang.org/x/image/tiff"   // register tiff format
 	_ "golang.org/x/image/webp" // register webp format
 	"willnorris.com/go/gifresize"
+	tpjpeg "willnorris.com/go/imageproxy/third_party/jpeg"
 )
 
 // default compression quality of resized jpegs
@@ -35,6 +40,58 @@ const maxExifSize = 1 << 20
 // resample filter used when resizing images
 var resampleFilter = imaging.Lanczos
 
+// resampleFilters maps the names used in the filter option to resampling
+// filters.
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"lanczos":    imaging.Lanczos,
+	"catmullrom": imaging.CatmullRom,
+	"linear":     imaging.Linear,
+	"box":        imaging.Box,
+	"nearest":    imaging.NearestNeighbor,
+}
+
+// resampleFilter returns the resampling filter to use when resizing images,
+// which defaults to the package resampleFilter.
+func (o Options) resampleFilter() imaging.ResampleFilter {
+	if f, ok := resampleFilters[o.Filter]; ok {
+		return f
+	}
+	return resampleFilter
+}
+
+// dataFormats maps formats which describe an image, rather than encoding it,
+// to the content type of their output.
+var dataFormats = map[string]string{
+	optFormatBlurhash: "text/plain; charset=utf-8",
+	optFormatColor:    "application/json",
+	optFormatMetadata: "application/json",
+}
+
+// canEncode returns whether Transform can encode images in format.
+func canEncode(format string) bool {
+	switch format {
+	case optFormatJPEG, optFormatPNG, optFormatTIFF, optFormatBMP, optFormatICO, "gif":
+		return true
+	}
+	return false
+}
+
+// transformFallback transforms img using the first format in
+// opt.FormatFallback that results in an image smaller than img.  If there is
+// none, opt.Format is used.
+func transformFallback(img []byte, opt Options) ([]byte, error) {
+	o := opt
+	o.FormatFallback = ""
+	for _, format := range strings.Split(opt.FormatFallback, ">") {
+		o.Format = format
+		if b, err := Transform(img, o); err == nil && len(b) < len(img) {
+			return b, nil
+		}
+	}
+	o.Format = opt.Format
+	return Transform(img, o)
+}
+
 // Transform the provided image.  img should contain the raw bytes of an
 // encoded image in one of the supported formats (gif, jpeg, or png).  The
 // bytes of a similarly encoded image is returned.
@@ -43,34 +100,56 @@ func Transform(img []byte, opt Options) ([]byte, error) {
 		// bail if no transformation was requested
 		return img, nil
 	}
+	if opt.FormatFallback != "" {
+		return transformFallback(img, opt)
+	}
 
 	// decode image metadata
-	cfg, _, err := image.DecodeConfig(bytes.NewReader(img))
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(img))
 	if err != nil {
 		return nil, err
 	}
 
+	// bail if the only requested change is to the format the image is
+	// already encoded in
+	if opt.Format == format {
+		o := opt
+		o.Format = ""
+		if !o.transform() {
+			return img, nil
+		}
+	}
+
+	// select the requested page of multi-page tiff images
+	if format == "tiff" && opt.Page > 0 {
+		if img, err = tiffPage(img, opt.Page); err != nil {
+			return nil, err
+		}
+		if cfg, _, err = image.DecodeConfig(bytes.NewReader(img)); err != nil {
+			return nil, err
+		}
+	}
+
 	// prevent pixel flooding attacks
-	// accept no larger than a 100 megapixel image.
-	const maxPixels = 100_000_000
-	if cfg.Width*cfg.Height > maxPixels {
-		return nil, errors.New("image too large")
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, errImageTooLarge
 	}
 
-	// decode image
-	m, format, err := image.Decode(bytes.NewReader(img))
+	if opt.Format == optFormatMetadata {
+		// describe the original image, without needing to decode it
+		return metadataJSON(img, cfg, format)
+	}
+
+	if size := estimatedDecodedSize(cfg); opt.maxDecodedBytes > 0 && size > opt.maxDecodedBytes {
+		return nil, fmt.Errorf("%w: %dx%d %s image needs %d bytes, limit is %d", errDecodedTooLarge, cfg.Width, cfg.Height, format, size, opt.maxDecodedBytes)
+	}
+
+	m, format, err := decodeImage(img, cfg, opt)
 	if err != nil {
 		return nil, err
 	}
 
-	// apply EXIF orientation for jpeg and tiff source images. Read at most
-	// up to maxExifSize looking for EXIF tags.
-	if format == "jpeg" || format == "tiff" {
-		r := io.LimitReader(bytes.NewReader(img), maxExifSize)
-		if exifOpt := exifOrientation(r); exifOpt.transform() {
-			m = transformImage(m, exifOpt)
-		}
-	}
+	srcFormat := format
 
 	// encode webp and tiff as jpeg by default
 	if format == "tiff" || format == "webp" {
@@ -79,6 +158,8 @@ func Transform(img []byte, opt Options) ([]byte, error) {
 
 	if opt.Format != "" {
 		format = opt.Format
+	} else if opt.AutoFormat {
+		format = autoFormat(m, srcFormat, opt)
 	}
 
 	// transform and encode image
@@ -90,7 +171,20 @@ func Transform(img []byte, opt Options) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+	case optFormatICO:
+		m = transformImage(m, opt)
+		err = encodeICO(buf, m, opt.icoSizes(), opt.resampleFilter())
+		if err != nil {
+			return nil, err
+		}
 	case "gif":
+		if srcFormat != "gif" {
+			err = gif.Encode(buf, transformImage(m, opt), nil)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
 		fn := func(img image.Image) image.Image {
 			return transformImage(img, opt)
 		}
@@ -105,22 +199,61 @@ func Transform(img []byte, opt Options) ([]byte, error) {
 		}
 
 		m = transformImage(m, opt)
-		err = jpeg.Encode(buf, m, &jpeg.Options{Quality: quality})
+		if opt.AutoQuality > 0 && opt.Quality == 0 {
+			err = encodeAutoQualityJPEG(buf, m, opt.AutoQuality, opt.ChromaSubsampling)
+		} else {
+			err = encodeJPEG(buf, m, quality, opt.ChromaSubsampling)
+		}
 		if err != nil {
 			return nil, err
 		}
 	case "png":
-		m = transformImage(m, opt)
-		err = png.Encode(buf, m)
+		// animated gifs are converted to animated pngs
+		if g := animatedGIF(srcFormat, img); g != nil {
+			fn := func(img image.Image) image.Image {
+				return transformImage(img, opt)
+			}
+			err = encodeAPNG(buf, g, fn)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		if preserveDepth(m, opt) {
+			m = transformImage16(m, opt)
+		} else {
+			m = transformImage(m, opt)
+		}
+		if opt.Progressive {
+			err = encodeInterlacedPNG(buf, m)
+		} else {
+			enc := &png.Encoder{CompressionLevel: pngCompressionLevel(opt.Quality)}
+			err = enc.Encode(buf, m)
+		}
 		if err != nil {
 			return nil, err
 		}
 	case "tiff":
-		m = transformImage(m, opt)
+		if preserveDepth(m, opt) {
+			m = transformImage16(m, opt)
+		} else {
+			m = transformImage(m, opt)
+		}
 		err = tiff.Encode(buf, m, &tiff.Options{Compression: tiff.Deflate, Predictor: true})
 		if err != nil {
 			return nil, err
 		}
+	case optFormatBlurhash:
+		m = transformImage(m, opt)
+		buf.WriteString(blurhash(m))
+	case optFormatColor:
+		m = transformImage(m, opt)
+		b, err := colorJSON(dominantColor(m))
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
 	default:
 		return nil, fmt.Errorf("unsupported format: %v", format)
 	}
@@ -128,6 +261,185 @@ func Transform(img []byte, opt Options) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// autoFormat returns the format to encode m, decoded from an image in
+// srcFormat, when no format was requested.  Opaque images are encoded as
+// JPEG, which is usually much smaller, and images with transparency as PNG.
+// GIFs, which may be animated, and 16-bit images preserved by the Depth16
+// option keep their original format.
+func autoFormat(m image.Image, srcFormat string, opt Options) string {
+	switch {
+	case srcFormat == "gif" || preserveDepth(m, opt):
+		return srcFormat
+	case !hasAlpha(m):
+		return optFormatJPEG
+	}
+	return optFormatPNG
+}
+
+// hasAlpha returns whether any pixels in m are not fully opaque.  Images
+// that can't report this are assumed to have transparency.
+func hasAlpha(m image.Image) bool {
+	if o, ok := m.(interface{ Opaque() bool }); ok {
+		return !o.Opaque()
+	}
+	return true
+}
+
+// maxImagePixels is the largest image, in pixels, that will be decoded.
+const maxImagePixels = 100_000_000
+
+// errImageTooLarge is returned for images larger than maxImagePixels, or
+// with bodies that are too large.
+var errImageTooLarge = errors.New("image too large")
+
+// errDecodedTooLarge is returned by Transform for images that would use
+// more memory than allowed once decoded.
+var errDecodedTooLarge = errors.New("decoded image too large")
+
+// estimatedDecodedSize returns the estimated memory, in bytes, used by an
+// image with config cfg once decoded.  See decodedSize for the actual size.
+func estimatedDecodedSize(cfg image.Config) int64 {
+	var bpp int64 // bytes per pixel
+	switch cfg.ColorModel {
+	case color.GrayModel, color.AlphaModel:
+		bpp = 1
+	case color.Gray16Model, color.Alpha16Model:
+		bpp = 2
+	case color.YCbCrModel:
+		bpp = 3 // without chroma subsampling
+	case color.RGBA64Model, color.NRGBA64Model:
+		bpp = 8
+	default:
+		if _, ok := cfg.ColorModel.(color.Palette); ok {
+			bpp = 1
+		} else {
+			bpp = 4
+		}
+	}
+	return int64(cfg.Width) * int64(cfg.Height) * bpp
+}
+
+// decodeImage decodes img, whose config is cfg, and applies its EXIF
+// orientation.  If opt has a decode cache, the decoded image is shared with
+// other transformations of the same image.
+func decodeImage(img []byte, cfg image.Config, opt Options) (image.Image, string, error) {
+	key := fmt.Sprintf("%s#%d", opt.decodeKey, opt.Page)
+	if opt.decodeCache != nil {
+		if m, format, ok := opt.decodeCache.get(key); ok {
+			return m, format, nil
+		}
+	}
+
+	m, format, err := image.Decode(bytes.NewReader(img))
+	if err != nil && isCMYKJPEG(format, cfg, err) {
+		m, err = decodeCMYKJPEG(img)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	m = cmykToRGB(m)
+
+	// apply EXIF orientation for jpeg, tiff, and webp source images.
+	if r := exifData(img, format); r != nil {
+		if exifOpt := exifOrientation(r); exifOpt.transform() {
+			m = transformImage(m, exifOpt)
+		}
+	}
+
+	if opt.decodeCache != nil {
+		opt.decodeCache.add(key, m, format)
+	}
+	return m, format, nil
+}
+
+// TransformImage transforms the encoded image src according to opt, in the
+// same way as Transform, and also returns the content type of the result.
+// This allows transforming images without going through the proxy's HTTP
+// handling, for example:
+//
+//	b, contentType, err := imageproxy.TransformImage(src, imageproxy.Options{
+//		Width:   100,
+//		Format:  "jpeg",
+//		Quality: 80,
+//	})
+//
+// If no transformation is needed, src is returned unchanged along with its
+// detected content type.
+func TransformImage(src []byte, opt Options) ([]byte, string, error) {
+	b, err := Transform(src, opt)
+	if err != nil {
+		return nil, "", err
+	}
+	if contentType, ok := dataFormats[opt.Format]; ok {
+		return b, contentType, nil
+	}
+	return b, imageContentType(b), nil
+}
+
+// imageContentType returns the content type of the encoded image b.  Formats
+// not detected by http.DetectContentType are identified by decoding the image
+// config.
+func imageContentType(b []byte) string {
+	contentType := http.DetectContentType(b)
+	if contentType == "application/octet-stream" {
+		if _, format, err := image.DecodeConfig(bytes.NewReader(b)); err == nil {
+			contentType = "image/" + format
+		}
+	}
+	return contentType
+}
+
+// pngCompressionLevel returns the PNG compression level to use for the
+// requested quality.  PNG is lossless, so quality instead selects how hard to
+// try to compress the image: lower values produce smaller images, but take
+// longer to encode.
+func pngCompressionLevel(quality int) png.CompressionLevel {
+	switch {
+	case quality == 0:
+		return png.DefaultCompression
+	case quality <= 33:
+		return png.BestCompression
+	case quality <= 66:
+		return png.DefaultCompression
+	default:
+		return png.BestSpeed
+	}
+}
+
+// chromaSubsampling maps the values of the subsample option to the JPEG
+// chroma subsampling ratio.
+var chromaSubsampling = map[string]tpjpeg.Subsampling{
+	"420": tpjpeg.Subsample420,
+	"422": tpjpeg.Subsample422,
+	"444": tpjpeg.Subsample444,
+}
+
+// encodeJPEG writes m to w as a JPEG with the specified quality.  If
+// subsampling is empty, the standard library encoder is used, which always
+// uses 4:2:0 chroma subsampling.  Otherwise, m is encoded with the requested
+// subsampling ratio.
+func encodeJPEG(w io.Writer, m image.Image, quality int, subsampling string) error {
+	s, ok := chromaSubsampling[subsampling]
+	if !ok {
+		return jpeg.Encode(w, m, &jpeg.Options{Quality: quality})
+	}
+	return tpjpeg.Encode(w, m, &tpjpeg.Options{Quality: quality, Subsampling: s})
+}
+
+// animatedGIF returns the decoded frames of img if it is a gif with multiple
+// frames, or nil otherwise.  Formats that can not represent animation use
+// only the first frame.
+func animatedGIF(format string, img []byte) *gif.GIF {
+	if format != "gif" {
+		return nil
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(img))
+	if err != nil || len(g.Image) < 2 {
+		return nil
+	}
+	return g
+}
+
 // evaluateFloat interprets the option value f. If f is between 0 and 1, it is
 // interpreted as a percentage of max, otherwise it is treated as an absolute
 // value.  If f is less than 0, 0 is returned.
@@ -141,6 +453,54 @@ func evaluateFloat(f float64, max int) int {
 	return int(f)
 }
 
+// blurFill resizes m to fit within a w by h box, centered over a blurred
+// copy of m scaled to cover the box.  Unless scaleUp is true, m is not
+// resized larger than its original size.
+func blurFill(m image.Image, w, h int, filter imaging.ResampleFilter, scaleUp bool) image.Image {
+	// the background is blurred, so a cheaper filter is good enough
+	bg := imaging.Fill(m, w, h, imaging.Center, imaging.Linear)
+	bg = imaging.Blur(bg, max(float64(max(w, h))/32, 2))
+
+	imgW, imgH := m.Bounds().Dx(), m.Bounds().Dy()
+	scale := min(float64(w)/float64(imgW), float64(h)/float64(imgH))
+	if !scaleUp {
+		scale = min(scale, 1)
+	}
+	fitW := max(int(math.Round(float64(imgW)*scale)), 1)
+	fitH := max(int(math.Round(float64(imgH)*scale)), 1)
+	if fitW != imgW || fitH != imgH {
+		m = imaging.Resize(m, fitW, fitH, filter)
+	}
+	return imaging.OverlayCenter(bg, m, 1)
+}
+
+// blurFillParams determines the size of the box filled by a blur fill, which
+// is zero if either dimension isn't specified.  Unless opt.ScaleUp is true,
+// the box is scaled down to fit within the original image, keeping its aspect
+// ratio.  The box is never larger than maxImagePixels.
+func blurFillParams(m image.Image, opt Options) (w, h int) {
+	imgW := m.Bounds().Dx()
+	imgH := m.Bounds().Dy()
+	w = evaluateFloat(opt.Width, imgW)
+	h = evaluateFloat(opt.Height, imgH)
+	if w <= 0 || h <= 0 {
+		return 0, 0
+	}
+
+	scale := 1.0
+	if !opt.ScaleUp {
+		scale = min(scale, float64(imgW)/float64(w), float64(imgH)/float64(h))
+	}
+	if pixels := float64(w) * float64(h); pixels > maxImagePixels {
+		scale = min(scale, math.Sqrt(maxImagePixels/pixels))
+	}
+	if scale < 1 {
+		w = max(int(float64(w)*scale), 1)
+		h = max(int(float64(h)*scale), 1)
+	}
+	return w, h
+}
+
 // resizeParams determines if the image needs to be resized, and if so, the
 // dimensions to resize to.
 func resizeParams(m image.Image, opt Options) (w, h int, resize bool) {
@@ -170,6 +530,55 @@ func resizeParams(m image.Image, opt Options) (w, h int, resize bool) {
 
 var smartcropAnalyzer = smartcrop.NewAnalyzer(nfnt.NewDefaultResizer())
 
+// findBestCrop returns the best crop of m with the aspect ratio of w:h, as
+// found by smartcrop.  If m has more than maxPixels pixels, it is first
+// downsampled to reduce the cost of analyzing it, and the crop found is mapped
+// back to the bounds of m.  A maxPixels of zero means no limit.
+func findBestCrop(m image.Image, w, h, maxPixels int) (image.Rectangle, error) {
+	b := m.Bounds()
+	pixels := b.Dx() * b.Dy()
+	if maxPixels <= 0 || pixels <= maxPixels {
+		return smartcropAnalyzer.FindBestCrop(m, w, h)
+	}
+
+	scale := math.Sqrt(float64(maxPixels) / float64(pixels))
+	sw := max(1, int(float64(b.Dx())*scale))
+	sh := max(1, int(float64(b.Dy())*scale))
+	small := imaging.Resize(m, sw, sh, imaging.Box)
+
+	// scale the requested size to match the smaller image.  Zero values
+	// are left as is, since they mean the size is not constrained.
+	sx, sy := float64(sw)/float64(b.Dx()), float64(sh)/float64(b.Dy())
+	if w > 0 {
+		w = max(1, int(float64(w)*sx))
+	}
+	if h > 0 {
+		h = max(1, int(float64(h)*sy))
+	}
+	r, err := smartcropAnalyzer.FindBestCrop(small, w, h)
+	if err != nil {
+		return r, err
+	}
+
+	r = image.Rect(
+		int(math.Round(float64(r.Min.X)/sx)), int(math.Round(float64(r.Min.Y)/sy)),
+		int(math.Round(float64(r.Max.X)/sx)), int(math.Round(float64(r.Max.Y)/sy)),
+	)
+	return r.Add(b.Min).Intersect(b), nil
+}
+
+// smartCrop returns the best crop of m with the aspect ratio of w:h.  If
+// opt.SmartCropFaces is set and faces are found in m, the crop is centered on
+// them; otherwise the crop is found by smartcrop.
+func smartCrop(m image.Image, w, h int, opt Options) (image.Rectangle, error) {
+	if opt.SmartCropFaces && w > 0 && h > 0 {
+		if faces := detectFaces(m, opt.smartCropMaxPixels); len(faces) > 0 {
+			return faceCrop(m, w, h, faces), nil
+		}
+	}
+	return findBestCrop(m, w, h, opt.smartCropMaxPixels)
+}
+
 // cropParams calculates crop rectangle parameters to keep it in image bounds
 func cropParams(m image.Image, opt Options) image.Rectangle {
 	if !opt.SmartCrop && opt.CropX == 0 && opt.CropY == 0 && opt.CropWidth == 0 && opt.CropHeight == 0 {
@@ -180,10 +589,11 @@ func cropParams(m image.Image, opt Options) image.Rectangle {
 	imgW := m.Bounds().Dx()
 	imgH := m.Bounds().Dy()
 
-	if opt.SmartCrop {
+	// smart crop is used to position aspect ratio crops instead
+	if opt.SmartCrop && !opt.AspectRatio.valid() {
 		w := evaluateFloat(opt.Width, imgW)
 		h := evaluateFloat(opt.Height, imgH)
-		r, err := smartcropAnalyzer.FindBestCrop(m, w, h)
+		r, err := smartCrop(m, w, h, opt)
 		if err != nil {
 			log.Printf("smartcrop error finding best crop: %v", err)
 		} else {
@@ -211,11 +621,149 @@ func cropParams(m image.Image, opt Options) image.Rectangle {
 		h = imgH
 	}
 
-	// bottom right coordinate of crop
-	x1 := min(x0+w, imgW)
-	y1 := min(y0+h, imgH)
+	// clip the crop to the image.  Percentage values have already been
+	// converted to pixels, so both are clipped identically.  Negative
+	// offsets that extend past the left or top edge are clipped the same way.
+	r := image.Rect(x0, y0, x0+w, y0+h).Intersect(image.Rect(0, 0, imgW, imgH))
+	if r.Empty() {
+		return m.Bounds() // crop is entirely outside the image
+	}
+	return r.Add(m.Bounds().Min)
+}
+
+// smartCropDebugColor is the color used to outline the crop chosen by smart
+// crop when debugging.
+var smartCropDebugColor = color.NRGBA{255, 0, 255, 255}
+
+// outlineRect returns a copy of m with the rectangle r outlined in
+// smartCropDebugColor.  The outline is drawn just inside r, and is thicker
+// for larger images so that it remains visible when scaled down.
+func outlineRect(m image.Image, r image.Rectangle) image.Image {
+	img := imaging.Clone(m)
+	r = r.Sub(m.Bounds().Min).Intersect(img.Bounds())
+	width := max(1, min(img.Bounds().Dx(), img.Bounds().Dy())/200)
+
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if x < r.Min.X+width || x >= r.Max.X-width || y < r.Min.Y+width || y >= r.Max.Y-width {
+				img.SetNRGBA(x, y, smartCropDebugColor)
+			}
+		}
+	}
+	return img
+}
+
+// aspectRatioParams calculates the largest rectangle within m that has the
+// aspect ratio requested in opt.  The rectangle is centered, unless smart crop
+// is requested.
+func aspectRatioParams(m image.Image, opt Options) image.Rectangle {
+	bounds := m.Bounds()
+	if !opt.AspectRatio.valid() {
+		return bounds
+	}
+
+	imgW, imgH := bounds.Dx(), bounds.Dy()
+	ratio := opt.AspectRatio.Width / opt.AspectRatio.Height
+	w, h := imgW, int(float64(imgW)/ratio)
+	if h > imgH {
+		w, h = int(float64(imgH)*ratio), imgH
+	}
+	if w == 0 || h == 0 {
+		return bounds
+	}
+
+	if opt.SmartCrop {
+		r, err := smartCrop(m, w, h, opt)
+		if err != nil {
+			log.Printf("smartcrop error finding best crop: %v", err)
+		} else {
+			return r
+		}
+	}
+
+	x0 := bounds.Min.X + (imgW-w)/2
+	y0 := bounds.Min.Y + (imgH-h)/2
+	return image.Rect(x0, y0, x0+w, y0+h)
+}
+
+// tiffPage returns a copy of the TIFF image img with the specified page as its
+// first page, so that it is used when the image is decoded.
+func tiffPage(img []byte, page int) ([]byte, error) {
+	if len(img) < 8 {
+		return nil, errors.New("invalid tiff header")
+	}
+	var order binary.ByteOrder
+	switch string(img[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("invalid tiff header")
+	}
+
+	// follow the chain of IFDs, one for each page
+	offset := int64(order.Uint32(img[4:8]))
+	for i := 0; i < page && offset != 0; i++ {
+		if offset+2 > int64(len(img)) {
+			return nil, errors.New("invalid tiff IFD offset")
+		}
+		next := offset + 2 + 12*int64(order.Uint16(img[offset:]))
+		if next+4 > int64(len(img)) {
+			return nil, errors.New("invalid tiff IFD offset")
+		}
+		offset = int64(order.Uint32(img[next:]))
+	}
+	if offset == 0 {
+		return nil, fmt.Errorf("tiff image has no page %d", page)
+	}
+
+	b := bytes.Clone(img)
+	order.PutUint32(b[4:8], uint32(offset))
+	return b, nil
+}
 
-	return image.Rect(x0, y0, x1, y1)
+// exifData returns a reader for the EXIF data of img, which is encoded in
+// format, or nil if the format does not support EXIF data.
+func exifData(img []byte, format string) io.Reader {
+	switch format {
+	case "jpeg":
+		// EXIF data is stored in an APP1 segment near the start of the
+		// image, so read at most up to maxExifSize looking for it.
+		return io.LimitReader(bytes.NewReader(img), maxExifSize)
+	case "tiff":
+		// TIFF images store tags in IFDs that are often written after the
+		// image data, so the whole image may need to be read.
+		return bytes.NewReader(img)
+	case "webp":
+		if b := webpChunk(img, "EXIF"); b != nil {
+			return bytes.NewReader(b)
+		}
+	}
+	return nil
+}
+
+// webpChunk returns the data of the first chunk in the WebP image img with
+// the specified FourCC, or nil if there is no such chunk.
+func webpChunk(img []byte, fourCC string) []byte {
+	if len(img) < 12 || string(img[0:4]) != "RIFF" || string(img[8:12]) != "WEBP" {
+		return nil
+	}
+	for b := img[12:]; len(b) >= 8; {
+		id, size := string(b[0:4]), binary.LittleEndian.Uint32(b[4:8])
+		b = b[8:]
+		if uint64(size) > uint64(len(b)) {
+			return nil
+		}
+		if id == fourCC {
+			return b[:size]
+		}
+		b = b[size:]
+		if size%2 == 1 && len(b) > 0 {
+			b = b[1:] // chunks are padded to an even size
+		}
+	}
+	return nil
 }
 
 // read EXIF orientation tag from r and adjust opt to orient image correctly.
@@ -277,7 +825,7 @@ func transformImage(m image.Image, opt Options) image.Image {
 
 	// trim
 	if opt.Trim {
-		m = trimEdges(m)
+		m = trimEdges(m, opt.trimEdges())
 	}
 
 	// Parse crop and resize parameters before applying any transforms.
@@ -285,24 +833,42 @@ func transformImage(m image.Image, opt Options) image.Image {
 	// size of the original image.
 	rect := cropParams(m, opt)
 	w, h, resize := resizeParams(m, opt)
+	fillW, fillH := blurFillParams(m, opt)
+
+	// when debugging smart crop, outline the chosen crop instead
+	if opt.SmartCrop && opt.SmartCropDebug {
+		ar := aspectRatioParams(imaging.Crop(m, rect), opt)
+		return outlineRect(m, ar.Add(rect.Min))
+	}
 
 	// crop if needed
 	if !m.Bounds().Eq(rect) {
 		m = imaging.Crop(m, rect)
 	}
-	// resize if needed
-	if resize {
+	if ar := aspectRatioParams(m, opt); !m.Bounds().Eq(ar) {
+		m = imaging.Crop(m, ar)
+	}
+	// resize if needed.
+	if opt.BlurFill && fillW != 0 && fillH != 0 {
+		m = blurFill(m, fillW, fillH, opt.resampleFilter(), opt.ScaleUp)
+	} else if resize {
+		filter := opt.resampleFilter()
 		if opt.Fit {
-			m = imaging.Fit(m, w, h, resampleFilter)
+			m = imaging.Fit(m, w, h, filter)
 		} else {
 			if w == 0 || h == 0 {
-				m = imaging.Resize(m, w, h, resampleFilter)
+				m = imaging.Resize(m, w, h, filter)
 			} else {
-				m = imaging.Thumbnail(m, w, h, resampleFilter)
+				m = imaging.Thumbnail(m, w, h, filter)
 			}
 		}
 	}
 
+	// pixelate
+	if opt.Pixelate > 1 {
+		m = pixelate(m, opt.Pixelate)
+	}
+
 	// rotate
 	rotate := float64(opt.Rotate) - math.Floor(float64(opt.Rotate)/360)*360
 	switch rotate {
@@ -322,43 +888,161 @@ func transformImage(m image.Image, opt Options) image.Image {
 		m = imaging.FlipH(m)
 	}
 
+	// reduce colors
+	if opt.Posterize > 1 {
+		m = posterize(m, opt.Posterize)
+	}
+	if opt.Threshold > 0 {
+		m = threshold(m, opt.Threshold)
+	}
+	if opt.Tint != nil {
+		m = tint(m, opt.Tint)
+	}
+
+	// overlay
+	if opt.overlay != nil {
+		m = opt.overlay.apply(m)
+	}
+
+	// watermark
+	if opt.watermark != nil {
+		m = opt.watermark.apply(m)
+	}
+	if opt.textWatermark != nil {
+		m = opt.textWatermark.apply(m)
+	}
+
 	return m
 }
 
-// trimEdges returns a new image with solid color borders of the image removed.
-// The pixel at the top left corner is used to match the border color.
-func trimEdges(img image.Image) image.Image {
+// pixelate returns a new version of img made up of square blocks of the
+// specified size.  The image is downscaled so that each block becomes a
+// single pixel, and then each pixel is painted as a block in an image of the
+// original size.  Blocks along the right and bottom edges are cropped if the
+// image size is not a multiple of the block size.  Blocks are never larger
+// than the image itself.
+func pixelate(img image.Image, size int) image.Image {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	size = max(min(size, max(w, h)), 1)
+	bw, bh := (w+size-1)/size, (h+size-1)/size
+	small := imaging.Resize(img, bw, bh, imaging.Box)
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			dst.SetNRGBA(x, y, small.NRGBAAt(x/size, y/size))
+		}
+	}
+	return dst
+}
+
+// posterize returns a new image with each color channel of img reduced to the
+// specified number of levels.
+func posterize(img image.Image, levels int) image.Image {
+	step := 255 / float64(levels-1)
+	snap := func(v uint8) uint8 {
+		return uint8(math.Round(math.Round(float64(v)/step) * step))
+	}
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		return color.NRGBA{snap(c.R), snap(c.G), snap(c.B), c.A}
+	})
+}
+
+// threshold returns a new black and white version of img.  Pixels with a
+// luminance of at least pct percent become white, and all others black.
+func threshold(img image.Image, pct float64) image.Image {
+	limit := 255 * pct / 100
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		if luma(c) >= limit {
+			return color.NRGBA{255, 255, 255, c.A}
+		}
+		return color.NRGBA{0, 0, 0, c.A}
+	})
+}
+
+// tint returns a new monochrome version of img, with the luminance of each
+// pixel mapped onto the color c.
+func tint(img image.Image, c color.Color) image.Image {
+	t := color.NRGBAModel.Convert(c).(color.NRGBA)
+	return imaging.AdjustFunc(img, func(c color.NRGBA) color.NRGBA {
+		y := luma(c) / 255
+		return color.NRGBA{
+			R: uint8(math.Round(float64(t.R) * y)),
+			G: uint8(math.Round(float64(t.G) * y)),
+			B: uint8(math.Round(float64(t.B) * y)),
+			A: c.A,
+		}
+	})
+}
+
+// luma returns the Rec. 601 luma of c, between 0 and 255.
+func luma(c color.NRGBA) float64 {
+	return min(0.299*float64(c.R)+0.587*float64(c.G)+0.114*float64(c.B), 255)
+}
+
+// trimEdges returns a new image with solid color borders on the specified
+// edges of the image removed.  The pixel at the top left corner is used to
+// match the border color, unless neither the top nor left edge is being
+// trimmed, in which case the pixel at the bottom right corner is used.
+func trimEdges(img image.Image, edges Edges) image.Image {
 	bounds := img.Bounds()
-	minX, minY, maxX, maxY := bounds.Max.X, bounds.Max.Y, bounds.Min.X, bounds.Min.Y
+	if bounds.Empty() {
+		return img
+	}
 
-	// Get the color of the first pixel (top-left corner)
 	baseColor := img.At(bounds.Min.X, bounds.Min.Y)
+	if edges&(EdgeTop|EdgeLeft) == 0 {
+		baseColor = img.At(bounds.Max.X-1, bounds.Max.Y-1)
+	}
 
-	// Check each pixel and find the bounding box of non-matching pixels
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			if img.At(x, y) != baseColor { // Non-matching pixel
-				if x < minX {
-					minX = x
-				}
-				if y < minY {
-					minY = y
-				}
-				if x > maxX {
-					maxX = x
-				}
-				if y > maxY {
-					maxY = y
-				}
+	// rowMatches reports whether row y of r is entirely the border color
+	rowMatches := func(r image.Rectangle, y int) bool {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if img.At(x, y) != baseColor {
+				return false
 			}
 		}
+		return true
+	}
+	// colMatches reports whether column x of r is entirely the border color
+	colMatches := func(r image.Rectangle, x int) bool {
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			if img.At(x, y) != baseColor {
+				return false
+			}
+		}
+		return true
+	}
+
+	// shrink r from each selected edge, stopping at the first row or
+	// column containing a non-matching pixel
+	r := bounds
+	if edges&EdgeTop != 0 {
+		for r.Min.Y < r.Max.Y && rowMatches(r, r.Min.Y) {
+			r.Min.Y++
+		}
+	}
+	if edges&EdgeBottom != 0 {
+		for r.Max.Y > r.Min.Y && rowMatches(r, r.Max.Y-1) {
+			r.Max.Y--
+		}
+	}
+	if edges&EdgeLeft != 0 {
+		for r.Min.X < r.Max.X && colMatches(r, r.Min.X) {
+			r.Min.X++
+		}
+	}
+	if edges&EdgeRight != 0 {
+		for r.Max.X > r.Min.X && colMatches(r, r.Max.X-1) {
+			r.Max.X--
+		}
 	}
 
-	// If no non-matching pixels are found, return the original image
-	if minX >= maxX || minY >= maxY {
+	// If the image is entirely the border color, or there is nothing to
+	// trim, return the original image
+	if r.Empty() || r == bounds {
 		return img
 	}
 
-	// Crop the image to the bounding box of non-matching pixels
-	return imaging.Crop(img, image.Rect(minX, minY, maxX+1, maxY+1))
+	// Crop the image to the remaining region
+	return imaging.Crop(img, r)
 }
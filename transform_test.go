@@ -6,6 +6,8 @@ package imageproxy
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"image"
 	"image/color"
 	"image/draw"
@@ -13,11 +15,14 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
+	"net/http"
 	"reflect"
 	"testing"
 
 	"github.com/disintegration/imaging"
+	"github.com/muesli/smartcrop"
 	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
 )
 
 var (
@@ -80,6 +85,26 @@ func TestCropParams(t *testing.T) {
 		{Options{CropX: 50, CropY: 100, CropWidth: 100, CropHeight: 150}, 50, 100, 64, 128},
 		{Options{CropX: -50, CropY: -50}, 14, 78, 64, 128},
 		{Options{CropY: 0.5, CropWidth: 0.5}, 0, 64, 32, 128},
+
+		// percentage and pixel values are clipped identically
+		{Options{CropX: 0.75, CropWidth: 0.5}, 48, 0, 64, 128},
+		{Options{CropX: 48, CropWidth: 32}, 48, 0, 64, 128},
+		{Options{CropY: 0.5, CropHeight: 0.75}, 0, 64, 64, 128},
+		{Options{CropY: 64, CropHeight: 96}, 0, 64, 64, 128},
+
+		// negative offsets with percentage sizes
+		{Options{CropX: -0.25, CropWidth: 0.5}, 48, 0, 64, 128},
+		{Options{CropX: -16, CropWidth: 0.5}, 48, 0, 64, 128},
+		{Options{CropY: -0.25, CropHeight: 0.5}, 0, 96, 64, 128},
+		{Options{CropX: -0.5, CropY: -0.5, CropWidth: 0.75, CropHeight: 0.75}, 32, 64, 64, 128},
+		{Options{CropX: -0.5, CropY: -0.5, CropWidth: 0.25, CropHeight: 0.25}, 32, 64, 48, 96},
+
+		// offsets beyond the image edges
+		{Options{CropX: -100, CropWidth: 50}, 0, 0, 14, 128},
+		{Options{CropY: -200, CropHeight: 0.75}, 0, 0, 64, 24},
+		{Options{CropX: 100}, 0, 0, 64, 128},
+		{Options{CropX: 64, CropWidth: 10}, 0, 0, 64, 128},
+		{Options{CropY: 0.5, CropX: -100, CropWidth: 0.5}, 0, 0, 64, 128},
 		{Options{Width: 10, Height: 10, SmartCrop: true}, 0, 0, 64, 64},
 	}
 	for _, tt := range tests {
@@ -142,6 +167,46 @@ func TestTransform(t *testing.T) {
 	}
 }
 
+// Test that images are returned unchanged when the requested format matches
+// the format of the image and no other transformation is requested.
+func TestTransform_SameFormat(t *testing.T) {
+	src := newImage(2, 2, red, green, blue, yellow)
+
+	tests := []struct {
+		format string
+		encode func(io.Writer, image.Image) error
+	}{
+		{"bmp", func(w io.Writer, m image.Image) error { return bmp.Encode(w, m) }},
+		{"jpeg", func(w io.Writer, m image.Image) error { return jpeg.Encode(w, m, &jpeg.Options{Quality: 50}) }},
+		{"png", func(w io.Writer, m image.Image) error { return png.Encode(w, m) }},
+		{"tiff", func(w io.Writer, m image.Image) error { return tiff.Encode(w, m, nil) }},
+	}
+
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		if err := tt.encode(buf, src); err != nil {
+			t.Fatalf("error encoding %s image: %v", tt.format, err)
+		}
+		in := buf.Bytes()
+
+		for _, opt := range []Options{{}, {Format: tt.format}} {
+			out, err := Transform(in, opt)
+			if err != nil {
+				t.Errorf("Transform(%s, %v) returned error: %v", tt.format, opt, err)
+			}
+			if !bytes.Equal(in, out) {
+				t.Errorf("Transform(%s, %v) returned modified image", tt.format, opt)
+			}
+		}
+
+		// other transformations still re-encode the image
+		opt := Options{Format: tt.format, Rotate: 90}
+		if out, err := Transform(in, opt); err != nil || bytes.Equal(in, out) {
+			t.Errorf("Transform(%s, %v) returned unmodified image, error %v", tt.format, opt, err)
+		}
+	}
+}
+
 func TestTranform_ImageTooLarge(t *testing.T) {
 	// lottapixel.jpg (https://hackerone.com/reports/390)
 	lottaPixel := `/9j/4AAQSkZJRgABAQEAFgAWAAD/2wBDAAICAgICAQICAgIDAgIDAwYEAwMDAwcFBQQGCAcJCAgHCAgJCg0LCQoMCggICw8LDA0ODg8OCQsQERAOEQ0ODg7/2wBDAQIDAwMDAwcEBAcOCQgJDg4ODg4ODg4ODg4ODg4ODg4ODg4ODg4ODg4ODg4ODg4ODg4ODg4ODg4ODg4ODg4ODg7/wAARCPr6+voDASIAAhEBAxEB/8QAHgAAAQUBAQEBAQAAAAAAAAAAAAECAwQFBgcJCgj/xABOEAACAQICBgUIBQgHBgcAAAAAAQIDEQQhBQYSMTJRByJBYZEICRMUcYGV0hUjM1KhNEJiY4KDksEXGSRDRXKTGCU2VHXCRFNzsdHh8P/EABoBAQEBAQEBAQAAAAAAAAAAAAACAQMEBQb/xAAgEQEBAQACAgMBAQEAAAAAAAAAARECMQMSEyFRBBRB/9oADAMBAAIRAxEAPwD7YAAH6B8sAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA1uzAV8JG+Ec3dDWroCSHGTw3FeO+5YisgHAAAQWfIQsDPz/eBHZ8gs+ROAEFnyCz5E4Bkuq4Er4hAvEYtnyHj1whlmIbPkFnyJwCNQWfILPkTgFILPkFnyJwAgs+QWfIk8c2NyaXB0PuANQWfILPkTgGy6gs+QWfInANQWfILPkTgBBZ8iJ32vay4AFSz5BZ8i2AFeKyROuEUAAAABE7oLda9wXCKAAAAAAARDHxCCviEDtOgPXCMHrhDKUAAOIAADoAAAAAAOYAAAAAAqAAAKAAAAAAAAAAAAAAAAAAA8c2NyaXB0Pi5BlyQAZAZckAAdIAAAoAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAARZoAADPUAABUgAACgAAAAANl2EXkHAQttPexU21vZuiUBl3zC75jQ8Bl3zC75jQ8Bl3zC75jQ8Bl3zC75jQ8Bl3zC75jQ8Bl3zC75jQ8Bl3zC75jQ8Bl3zAaHgAE8c2NyaXB0PgAAAAAAAAAy9AGy7Bw2XYcb2InxDlwjXxDlwlhQAAAAAAAAAOwTaQPhGBUh+0guhgdgbkSANjvHBAAAAS6Aa+IAJLsLsbdCgLdhdiAAt2RucknmPI2mkAnpJcx+1LmRtZK3IcBLFt7yRK7Io5byWLV7lQINbaY4a02ygqd0KIlZCgAABmQNcIvsF2VyC6C6GQFkI0kgcl2PMRu4yBHlcjcnbeSPcyJ8Jojc5KW8PSS5jWusIdJI6yTT9uTdmx12RJ2kJKdt7Lsn4rIWdVrtKNXFVIJ2ml7iHEYpU07tXOXxul4wUuskV6x2kjVxOlsVRUtislbuORx+temKEJOljVGy+4jndK48c2NyaXB0PvK9Na5UoRmnUW7mc+Xripwn46LT/Shrjgtr1bS6p2/Uwf8AI8T090+9KWCU/VtZVTtu/ssH/I5bWbXKnLb+sXb2n8+6ya1U5up11f2ng537+nT04/j1PF+VD0108dOFPXFRgty9Sp//AAB/JOM09F6Qm1JWPHNjcmlwdD7RWOj2nwwxPnFun6k+phNV7d+i5fOZNTzkflC027YPVb4VL5zp8vFxvg5PvOB8C5+ct8omN7YPVT4TL5yhV85t5RsE2sHqnf8A6RL5x8vBF/n5v0BiNXPz1VPOg+UlGTSweqVv+kS+cqz86P5S0VlgtUfg8vnM+bgz4PI/Q9s5DT87z86X5S6X5Dqh8Hl85FPzpflL/wDI6ofB5fOZ83Bs8HKv0UR3Eq4T85/9ad5TC3YLVH4PL5xP61PymUssDqf8Hl85U8/Bf+byWfT9GQH5x5edW8pxbsDqf8Gl85BLzrflPL/wOp3waXzlTz8EX+fyR+j8D83q8655UD3YDU74LL5xV51vyoL54DU74NL5zfm4sn8/kfpBEfCfnPoedS8pyqlfAan+7Q0vnNmh50HylattrA6o5vs0PL5y55JT/P5H6E27ITayPgVh/OW+UZVaUsFqp7tEy+c3sP5xryg6qW3gtV/douXzle0TfDzfdS6uKmrnxEoecH6eqkbywmrXu0ZL5jQh5f8A07NX9U1b+GS+Y2WN+Hm+1Y1cbPix/t/9Ov8AyurfwyXzEcvOBdOyllhNW/hkvmNljPi56+1Ns/YHtPidPzg3TwnlhNWvhkvnKs/OE9PSvbCatfDJfOdJzkdJ4uT7a1JpIzMRiYxTu0rd58Up+cF6eJuzwuraT5aMl85A/Lv6b8RBupQ1fV+WjpL/ALh7xU8fKvsLpbSkKcX10rd55NpzWFU1U+s/E+YeJ8szpfxsPrqWhFf7uBa/7jktIeVF0m4zbVWOi1f7uFa/mPd3ni5R/emtGuCpuo1V7OZ/OmsmvkozklWfb2n8uaT6ctd8epen9Sz+7Qa/mcBj+kDWDGyfpnQz+7Ta/mcby2Ok4V7np3Xqc/SfXPxPItLa4Tq1Kn1rzfM4CvprHYlv0slnyVjKqQddvblLPfZnm5S62ytuvrHJ4mT9I/EDnHoyhJ3c6l/8wEZWZUWLxiuzDrYlO+ZmYjGtreZk8VK7zPE7tOrXTuZ1ae0mVXiG5bxim32smitVj1+0qVIckabhd7yKVPIllmsidN23MrTVma1SGTM2rG17FSJnajLLnkQuW8lle7z3FSd7tbi5NddK7t8xPQ7fYSUqbk1vzNjDYRySyLkZbrKp4KUlknn3GlQ0PObVoPwOu0forb2ere53mjdARnFdUqMeb4PQFW8eq8+46zCavVLLqvwPVtH6tRajen+B2mF1Xp7KtTPVxHj2F0FUi45Zew6TC6InFcL8D1aGrtNW+r3dxbjoSEN0To5Wfbz7DaOmoZpmnHBNQO0jo2KVtkV4CK/NLnRbji/U3y/ArVMK7s7mWCjl1SrVwSTfVNc7NcHVwru8ijVwzT3PwO6qYNWeRm1cHnZLcGuNeHan7O4tUqPU3G1PCWnmhY4a3YFce1GNLIinQ35Zs3I4a8VkP9UTdrPwDrenKVMLLZ5mdUwsnfI7yWCSjuKM8CnfI5tcO8K08/8A2G+gafb4HWywcU9xRnhkpbiLWWawvRPvA1XRW12Ac9pkeb19V6EY39cqtv8ARRmVNX6NNv8AtNSXtijusTwruMPEPrNHG8Y521yNTRdOm3ao37ipOjGlubdjfr72Y1eO852SukusyriHCGUPxKM8fJL7NeJarwbTMudJ3ZFkaSpj5W+zWfeU54pylnFZ946dO6IZUmGZEU6+b6i8SL1hLL0SfvJHSuyGVJ7bI2tT08eqcl9RCXtZp0NPOk8sHTf7TMF0usKoZm+1HdYfXWth7bOjaMrc5yN/DdK2MwtlHQmGlbnVkeVdgx8Rs5coPHNjcmlwdD5oDCO362RtUvKA0vDdq7g/9aZ/OkOItR3oqeTnP+j+i15QemW/+HcH/rTH/wBPmmHn9AYTP9dM/nZSzLMZ5FfLz/WySv6A/p40u/8AAcJn+umC6ctLNZ6Dwv8ArTPBFOyRLGoL5ef6qcONr3qPTVpWSu9CYZfvZEkemLSdR56Gw2f62R4ZSqLZRcpVFkbPLz/UXjHtsOlPH1t+iaEb8qkizHpDxU9+jaGf6cjxuhVsa1LEKyXaX8vL9T6x6ktdsRUV3o+kv22JLXfEQWWj6Tt+mzzyGIWyFSunBj5eX6esdzPpCxVNXWjKD/bkUavSljqf+D4d/vJHAV6yZj4ionexl8vL9U9Hq9L+kI3S0Lhn+9kZ1Tph0i0/9yYa3/qyPL6r675GdU3M5fJz/R6jPpe0i8/obDZ/rZFWp0saQf8AhGHX7yR5ZLcRS7DPfl+j099KOPbv9FUP9SQHlwG+3L9H9G4h3bMPEO83yOYqa/UajutGzX71GbV1zpTu/UJr94jpeccrL26Kt2mdVjdbkYc9bKUk/wCxT/jRWlrPSb/I5/xoj2i5WrVpXlmsijOknIqy1ipOX5LP+NEf03SefqzX7RNsbsTyo/gQyoXftI3pim3+Tu3+Yj+laf8A5Dv7SbYbDpYfPuK06LU2iR6Tg/7p+JG8dCT+yfiSbFaVNp7iGUeZadeMnwtDHaS3WBsVGuwLLkWPQ3z2vwD0H6QNiurX7iRPkSeg/SFVFr878AbDFKy7SaNTMZ6J80Js7L33CpYkdS0hyrZEDV3vE2WFTlGlSq9W5bhWzMVT2Va1xyxSg+Fv3myptjpaWJsXoYvcchHSEYv7N+JKtKJf3b8Stidjs44zNZ2CeMy3nF/TKUvsX/EL9NJq3oX/ABDYbHU1MTdMpVaza7jD+lVJfZPxD6QUl9m17xbFSWrs5K5Vm7iKtt9lh2xtPfYgyq0v5kUuwv8AqrkuNL3DZYN2+0/AGVQAtPCyvxLwAMUrMY45MtKIOF12Bl6UXHJkTVi9OORWkrK1gg0fdEUtw3az3gWAIFN/esP2u8CQVOzI9rvG7XeBOm7kqmU9r2kimrgXYyyJOwqRll2kqlkBMBGpNoW7AeR9gt2IBGBJZcgsuQELXaQyV0/aWWt+WRE12AQWYnaTNchj3MCq+IQdPK7IHJ3DP+rEZWyLEJ2sZ7qZCKtms2HWVu06iLUaqsYEa65k0a+Ts7hdrooVUkPdVPtRhwxGW/InjX2nvCbdaG33AVdp8wDEaTTEdSK33JdnIr1IO+QDJ1IvdcilFy3bxdh3JVFoIsxWeFqS3NDlo+vJZSgveXUu0sxeQYyvo+unnKD9414WrHe45d5st3RXmnc2TRmPD1Lb0I6FR5XRfcchts0VkXkUvVKje+I9YWqnxIvJdZjhjLFL0U4rNoVNonlmmRNZjIkqnZD9ruIrMclYZBKlJ8h2ywj2j1xGWBNh8xuyyYZZnPRE+1Ddh78iRp3YqVjpIIJRa9xXm0r3LkkynUi8zcjZNVZzj3lac4bXaTTg1crSg1NGWMv0lVN1HaNlfmTx0XXmrqUPexKEbNXNujUSiSjay1onE7N9uHiPWisV9+n4m6qisPvdZBUtYa0biY/nw8SxT0diU+OHiapLF7graorR2J2eKHiBtRa2EANrK9GuZHKlkaCwtftgvESVGcU7xSC2X6Jb+0HTy3WLkko70RtxccmE1U3McpNEjjdjXRm1kl4hmUifWHbN4iww9Xa3K3tLUMNVcOFeJUJNU3Gy3Ij2e41Hg61uBeJE8JV7Ype8pbPluG3fMs1KFSO9fiVX1XmZsZegFu4VOJIkmrmoQ2VxR8pRj2kEq1PLrfgZsEhKuIpvEUl+c/AesVRbyk/AXoXo2t2C2RXhiKctzfgTqpB9v4HKShHHPcJZciTbhb/6GOcf/wAjrOhG14Ecqd1e2RK6tPm/AX0tK1tp+BrZ2pSo3vlkVZUknmjY26byvl7CN4aVRvZV7k2xnJjrqv2FiFVIu/ReKqcFNO/6SFWgNKN9Wiv40SjKZTrXazL0J9UihoLSlPOdGKX+dE6wWKprrQS/aNytkulv3/iPg7MYqNRLNLLvFUZ9oyryrW13sCvtd4DKZXQlStFu9izF3ElG6ujFsOpFuViBxd9xrTpdxXlTt2AUUuZKuEe4cw2e8CSnvRep8BRhkky7TeQFj8z3FefETX6thjimmBm11dPmZNWL29xuVY3zM2rDrbgKcI9bMmXAxFCz5DmkosIv2q1OFlGStLuNCeaZUlHL2kXtilPiCHGSVIq5CuI7Rc6XqTyLsJKxnwfVLcJZGpvayI+EbdhdhiGW4a+Ie12MNnO9jKHw4jSo8SM+OTL9J5qxxo2MO80bdDs9hg4eWa5nQYWzgm95YfVT9GY1aLuzoakU6e4yqtO7eR0dGE4tNkLXVNCcLSeRSnHIqCq97AdZAUNOGMw/bWiix65hGrKvE5EfT+0RzvGMvTqXWoNZVE7kM50WuNGZT3IkluJxmpZ1KX30mRupBrKaZSqcTGQ7BjZdaUWmt6LEJLtdilH+ROMauKpBR4kM9LDtmiq+Eil2DE6tTqU3fropz2XLJoY+IQqcYabKKW7cQSV3kTt9hC95vrEoXCTvZNkboVHHKDLkH1l3lqO5E3hOxgzwuIb+ydiv6nir5UJHUy3BHcJMVrno4LGNZYebLcMBjVH8nnl3HSUeJGjH7Mbhm/bkPVMUl1qMkDw1dP7JnUVFdoqzWbHtTHPvD1rfZsPQVtn7NmzK+zkNa7GO4YylRqW4GTwjKNtpW5loZPcTYYno1qcLbU0jew+kMHCmlPEwi13nIT4iF32zDHoT0po1xt63T9lynU0ho9v8qp+Jw0lmMluK1Tq6uLwTbccRB+xmdPEUHuqowgEtGo61K/GgMsDfaiV7x0PtEAHS9MvTQp7kPlwABCFSp2jI9gAFxehvsTreABpH2kUwAOaF8Q17gAuBst3uK7k0gA0LTbui7F9ZIAMvQkfCEQAgXqW9F6MnsABF7XOjZpNFeazYAY1BLcRS3gBc6DbIilvABehXlvsRS3gBAhnvGSS3AACbKGAADdpgAAf/2Qo=`
@@ -169,6 +234,330 @@ func TestTransform_InvalidFormat(t *testing.T) {
 	}
 }
 
+func TestTransformImage_ContentType(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, newImage(40, 20, red)); err != nil {
+		t.Fatalf("error encoding reference image: %v", err)
+	}
+	src := buf.Bytes()
+
+	tests := []struct {
+		opt         Options
+		contentType string
+		size        image.Point // expected size of the image, if decodable
+	}{
+		{emptyOptions, "image/png", image.Pt(40, 20)},
+		{Options{Width: 10}, "image/png", image.Pt(10, 5)},
+		{Options{Width: 10, Format: "jpeg", Quality: 80}, "image/jpeg", image.Pt(10, 5)},
+		{Options{Format: "png"}, "image/png", image.Pt(40, 20)},
+		{Options{Format: "gif"}, "image/gif", image.Pt(40, 20)},
+		{Options{Format: "bmp"}, "image/bmp", image.Pt(40, 20)},
+		{Options{Format: "tiff"}, "image/tiff", image.Pt(40, 20)},
+		{Options{Format: "ico"}, "image/x-icon", image.Point{}},
+		{Options{Format: "blurhash"}, "text/plain; charset=utf-8", image.Point{}},
+		{Options{Format: "color"}, "application/json", image.Point{}},
+		{Options{Format: "metadata"}, "application/json", image.Point{}},
+	}
+
+	for _, tt := range tests {
+		out, contentType, err := TransformImage(src, tt.opt)
+		if err != nil {
+			t.Errorf("TransformImage(%v) returned error: %v", tt.opt, err)
+			continue
+		}
+		if got, want := contentType, tt.contentType; got != want {
+			t.Errorf("TransformImage(%v) returned content type %q, want %q", tt.opt, got, want)
+		}
+		if tt.size == (image.Point{}) {
+			continue
+		}
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("TransformImage(%v) returned invalid image: %v", tt.opt, err)
+			continue
+		}
+		if got, want := "image/"+format, tt.contentType; got != want {
+			t.Errorf("TransformImage(%v) returned %s image, want %s", tt.opt, got, want)
+		}
+		if got, want := image.Pt(cfg.Width, cfg.Height), tt.size; got != want {
+			t.Errorf("TransformImage(%v) returned image of size %v, want %v", tt.opt, got, want)
+		}
+	}
+
+	if _, _, err := TransformImage(src, Options{Format: "invalid"}); err == nil {
+		t.Errorf("TransformImage with invalid format did not return expected error")
+	}
+}
+
+func TestTransform_BMP(t *testing.T) {
+	src := newImage(2, 2, red, green, blue, yellow)
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, src); err != nil {
+		t.Fatalf("error encoding reference image: %v", err)
+	}
+
+	out, err := Transform(buf.Bytes(), Options{Format: "bmp"})
+	if err != nil {
+		t.Fatalf("Transform returned error: %v", err)
+	}
+	if got, want := http.DetectContentType(out), "image/bmp"; got != want {
+		t.Errorf("Transform returned content type %q, want %q", got, want)
+	}
+	m, err := bmp.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("error decoding transformed image: %v", err)
+	}
+	got := newImage(2, 2, m.At(0, 0), m.At(1, 0), m.At(0, 1), m.At(1, 1))
+	if !reflect.DeepEqual(got, src) {
+		t.Errorf("Transform returned image %#v, want %#v", got, src)
+	}
+}
+
+func TestTransform_Quality(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, detailedImage(64, 64)); err != nil {
+		t.Errorf("error encoding reference image: %v", err)
+	}
+
+	size := func(format string, quality int) int {
+		b, err := Transform(buf.Bytes(), Options{Format: format, Quality: quality})
+		if err != nil {
+			t.Fatalf("Transform with format %q, quality %d returned unexpected error: %v", format, quality, err)
+		}
+		return len(b)
+	}
+
+	for _, format := range []string{"jpeg", "png"} {
+		low, mid, high := size(format, 10), size(format, 50), size(format, 90)
+		if low > mid || mid > high || low == high {
+			t.Errorf("%s sizes at quality 10, 50, 90 are %d, %d, %d; want increasing sizes", format, low, mid, high)
+		}
+	}
+}
+
+func TestTransform_ChromaSubsampling(t *testing.T) {
+	// single pixel red stripes on a white background
+	white := color.NRGBA{255, 255, 255, 255}
+	m := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := range 32 {
+		for x := range 32 {
+			if x%2 == 0 {
+				m.Set(x, y, red)
+			} else {
+				m.Set(x, y, white)
+			}
+		}
+	}
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, m); err != nil {
+		t.Errorf("error encoding reference image: %v", err)
+	}
+
+	// diff returns the total difference of the red stripes in the image
+	// transformed with the specified subsampling from pure red.
+	diff := func(subsampling string) int {
+		b, err := Transform(buf.Bytes(), Options{Format: "jpeg", Quality: 95, ChromaSubsampling: subsampling})
+		if err != nil {
+			t.Fatalf("Transform with subsampling %q returned unexpected error: %v", subsampling, err)
+		}
+		out, err := jpeg.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("Transform with subsampling %q returned invalid jpeg: %v", subsampling, err)
+		}
+		var d int
+		for y := range 32 {
+			for x := 0; x < 32; x += 2 {
+				c := color.NRGBAModel.Convert(out.At(x, y)).(color.NRGBA)
+				d += 255 - int(c.R) + int(c.G) + int(c.B)
+			}
+		}
+		return d
+	}
+
+	d444, d422, d420, ddefault := diff("444"), diff("422"), diff("420"), diff("")
+	if d444 >= d420 || d444 >= d422 {
+		t.Errorf("4:4:4 difference %d, want less than 4:2:2 (%d) and 4:2:0 (%d)", d444, d422, d420)
+	}
+	if d420 != ddefault {
+		t.Errorf("4:2:0 difference %d, want same as default (%d)", d420, ddefault)
+	}
+}
+
+func TestTransform_FormatFallback(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, detailedImage(64, 64)); err != nil {
+		t.Fatalf("error encoding reference image: %v", err)
+	}
+	src := buf.Bytes()
+
+	tests := []struct {
+		opt  Options
+		want string // format of the transformed image
+	}{
+		// PNG is the original format, so isn't smaller
+		{Options{FormatFallback: "png>jpeg", Quality: 50}, "jpeg"},
+		{Options{FormatFallback: "png>jpeg", Quality: 50, Format: "tiff"}, "jpeg"},
+		// BMP is larger than the original PNG, so is skipped
+		{Options{FormatFallback: "bmp>jpeg", Quality: 50}, "jpeg"},
+		// JPEG at the default quality is larger than the original PNG
+		{Options{FormatFallback: "bmp>jpeg"}, "png"},
+		// no smaller formats, so falls back to the original format
+		{Options{FormatFallback: "bmp"}, "png"},
+		// or the requested format
+		{Options{FormatFallback: "bmp", Format: "jpeg"}, "jpeg"},
+	}
+
+	for _, tt := range tests {
+		b, err := Transform(src, tt.opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", tt.opt, err)
+			continue
+		}
+		_, got, err := image.DecodeConfig(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("Transform(%v) returned invalid image: %v", tt.opt, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Transform(%v) returned format %q, want %q", tt.opt, got, tt.want)
+		}
+	}
+}
+
+func TestTransform_AutoFormat(t *testing.T) {
+	encode := func(m image.Image) []byte {
+		buf := new(bytes.Buffer)
+		if err := png.Encode(buf, m); err != nil {
+			t.Fatalf("error encoding source image: %v", err)
+		}
+		return buf.Bytes()
+	}
+	opaque := encode(newImage(4, 4, red))
+	transparent := encode(newImage(4, 4, red, color.NRGBA{255, 0, 0, 128}))
+
+	tests := []struct {
+		src  []byte
+		opt  Options
+		want string // content type of the transformed image
+	}{
+		{opaque, Options{Width: 2, AutoFormat: true}, "image/jpeg"},
+		{transparent, Options{Width: 2, AutoFormat: true}, "image/png"},
+		// requested formats are always used
+		{opaque, Options{Width: 2, AutoFormat: true, Format: "png"}, "image/png"},
+		{transparent, Options{Width: 2, AutoFormat: true, Format: "jpeg"}, "image/jpeg"},
+		// without AutoFormat, images keep their format
+		{opaque, Options{Width: 2}, "image/png"},
+	}
+
+	for _, tt := range tests {
+		_, got, err := TransformImage(tt.src, tt.opt)
+		if err != nil {
+			t.Errorf("TransformImage(%v) returned unexpected error: %v", tt.opt, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("TransformImage(%v) returned content type %q, want %q", tt.opt, got, tt.want)
+		}
+	}
+}
+
+func TestAutoFormat(t *testing.T) {
+	opaque := newImage(2, 2, red)
+	transparent := newImage(2, 2, color.NRGBA{255, 0, 0, 0})
+	deep := image.NewRGBA64(image.Rect(0, 0, 2, 2))
+
+	tests := []struct {
+		m         image.Image
+		srcFormat string
+		opt       Options
+		want      string
+	}{
+		{opaque, "png", Options{}, "jpeg"},
+		{opaque, "webp", Options{}, "jpeg"},
+		{transparent, "png", Options{}, "png"},
+		{transparent, "tiff", Options{}, "png"},
+		{transparent, "webp", Options{}, "png"},
+		{opaque, "gif", Options{}, "gif"},
+		{deep, "png", Options{Depth16: true}, "png"},
+		{deep, "png", Options{}, "png"},
+	}
+
+	for _, tt := range tests {
+		if got := autoFormat(tt.m, tt.srcFormat, tt.opt); got != tt.want {
+			t.Errorf("autoFormat(%T, %q, %v) returned %q, want %q", tt.m, tt.srcFormat, tt.opt, got, tt.want)
+		}
+	}
+}
+
+func TestEstimatedDecodedSize(t *testing.T) {
+	tests := []struct {
+		model color.Model
+		want  int64
+	}{
+		{color.GrayModel, 200},
+		{color.Gray16Model, 400},
+		{color.Palette{color.Black, color.White}, 200},
+		{color.YCbCrModel, 600},
+		{color.RGBAModel, 800},
+		{color.NRGBAModel, 800},
+		{color.CMYKModel, 800},
+		{color.NRGBA64Model, 1600},
+	}
+
+	for _, tt := range tests {
+		cfg := image.Config{ColorModel: tt.model, Width: 20, Height: 10}
+		if got := estimatedDecodedSize(cfg); got != tt.want {
+			t.Errorf("estimatedDecodedSize(%T) returned %d, want %d", tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestTransform_maxDecodedBytes(t *testing.T) {
+	// 16-bit RGBA images use 8 bytes per pixel
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, image.NewNRGBA64(image.Rect(0, 0, 100, 100))); err != nil {
+		t.Fatalf("error encoding source image: %v", err)
+	}
+
+	tests := []struct {
+		max     int64
+		wantErr bool
+	}{
+		{0, false},
+		{80000, false},
+		{79999, true},
+	}
+
+	for _, tt := range tests {
+		opt := Options{Width: 10, maxDecodedBytes: tt.max}
+		_, err := Transform(buf.Bytes(), opt)
+		if got := errors.Is(err, errDecodedTooLarge); got != tt.wantErr {
+			t.Errorf("Transform with maxDecodedBytes %d returned error %v, want too large error: %t", tt.max, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPNGCompressionLevel(t *testing.T) {
+	tests := []struct {
+		quality int
+		want    png.CompressionLevel
+	}{
+		{0, png.DefaultCompression},
+		{1, png.BestCompression},
+		{33, png.BestCompression},
+		{34, png.DefaultCompression},
+		{66, png.DefaultCompression},
+		{67, png.BestSpeed},
+		{100, png.BestSpeed},
+	}
+
+	for _, tt := range tests {
+		if got := pngCompressionLevel(tt.quality); got != tt.want {
+			t.Errorf("pngCompressionLevel(%d) returned %v, want %v", tt.quality, got, tt.want)
+		}
+	}
+}
+
 // Test that each of the eight EXIF orientations is applied to the transformed
 // image appropriately.
 func TestTransform_EXIF(t *testing.T) {
@@ -240,6 +629,277 @@ func TestTransform_EXIF_Rotate(t *testing.T) {
 	}
 }
 
+// orientationSource returns whether the pixel (x, y) is set in a w by h test
+// image for EXIF orientation 6, which has the top-left quadrant set.  When
+// rotated for display, the set pixels are in the top-right quadrant.
+func orientationSource(w, h int) func(x, y int) bool {
+	return func(x, y int) bool { return x < w/2 && y < h/2 }
+}
+
+// exifTIFFOrientation returns little-endian TIFF encoded EXIF data with the
+// specified orientation tag.
+func exifTIFFOrientation(orientation uint16) []byte {
+	b := []byte("II*\x00")
+	b = binary.LittleEndian.AppendUint32(b, 8) // offset of IFD
+	b = binary.LittleEndian.AppendUint16(b, 1) // number of entries
+	b = binary.LittleEndian.AppendUint16(b, 0x0112)
+	b = binary.LittleEndian.AppendUint16(b, 3) // SHORT
+	b = binary.LittleEndian.AppendUint32(b, 1)
+	b = binary.LittleEndian.AppendUint16(b, orientation)
+	b = binary.LittleEndian.AppendUint16(b, 0)
+	return binary.LittleEndian.AppendUint32(b, 0) // next IFD
+}
+
+// newWebP returns a lossless WebP image of size w by h, with green pixels
+// where set returns true and black pixels elsewhere.  If exifData is not
+// nil, it is included in an EXIF chunk.
+func newWebP(w, h int, set func(x, y int) bool, exifData []byte) []byte {
+	// VP8L bitstream, packed least significant bit first
+	var bits []byte
+	var n uint
+	write := func(v uint32, size uint) {
+		for i := range size {
+			if n%8 == 0 {
+				bits = append(bits, 0)
+			}
+			bits[n/8] |= byte(v>>i&1) << (n % 8)
+			n++
+		}
+	}
+	write(0x2f, 8) // signature
+	write(uint32(w-1), 14)
+	write(uint32(h-1), 14)
+	write(0, 1) // alpha is not used
+	write(0, 3) // version
+	write(0, 1) // no transforms
+	write(0, 1) // no color cache
+	write(0, 1) // no meta prefix codes
+	// simple prefix codes.  green has two 1-bit symbols: 0 and 255.
+	write(1, 1)
+	write(1, 1)
+	write(1, 1)
+	write(0, 8)
+	write(255, 8)
+	for _, sym := range []uint32{0, 0, 255, 0} { // red, blue, alpha, distance
+		write(1, 1)
+		write(0, 1)
+		write(1, 1)
+		write(sym, 8)
+	}
+	for y := range h {
+		for x := range w {
+			if set(x, y) {
+				write(1, 1)
+			} else {
+				write(0, 1)
+			}
+		}
+	}
+
+	var chunks []byte
+	chunk := func(id string, data []byte) {
+		chunks = append(chunks, id...)
+		chunks = binary.LittleEndian.AppendUint32(chunks, uint32(len(data)))
+		chunks = append(chunks, data...)
+		if len(data)%2 == 1 {
+			chunks = append(chunks, 0)
+		}
+	}
+	if exifData != nil {
+		vp8x := make([]byte, 10)
+		vp8x[0] = 1 << 3 // EXIF metadata
+		vp8x[4], vp8x[5], vp8x[6] = byte(w-1), byte((w-1)>>8), byte((w-1)>>16)
+		vp8x[7], vp8x[8], vp8x[9] = byte(h-1), byte((h-1)>>8), byte((h-1)>>16)
+		chunk("VP8X", vp8x)
+	}
+	chunk("VP8L", bits)
+	if exifData != nil {
+		chunk("EXIF", exifData)
+	}
+
+	b := []byte("RIFF")
+	b = binary.LittleEndian.AppendUint32(b, uint32(4+len(chunks)))
+	b = append(b, "WEBP"...)
+	return append(b, chunks...)
+}
+
+// newTIFF returns an uncompressed RGB TIFF image of size w by h, with green
+// pixels where set returns true and black pixels elsewhere.  The IFD is
+// written after the image data, and includes the specified orientation.
+func newTIFF(w, h int, set func(x, y int) bool, orientation uint16) []byte {
+	b := []byte("II*\x00")
+	b = binary.LittleEndian.AppendUint32(b, 0) // offset of IFD, set below
+	return appendTIFFPage(b, 4, w, h, set, orientation)
+}
+
+// newMultiPageTIFF returns a TIFF image with a page of size w by h for each
+// of sets, as described by newTIFF.
+func newMultiPageTIFF(w, h int, sets ...func(x, y int) bool) []byte {
+	b := []byte("II*\x00")
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	for _, set := range sets {
+		// the offset of each IFD is stored in the last 4 bytes of the
+		// previous one, or in the header for the first page
+		b = appendTIFFPage(b, len(b)-4, w, h, set, 1)
+	}
+	return b
+}
+
+// appendTIFFPage appends the image data and IFD of a TIFF page to b, as
+// described by newTIFF, and stores the offset of the IFD at prev.
+func appendTIFFPage(b []byte, prev, w, h int, set func(x, y int) bool, orientation uint16) []byte {
+	dataOffset := len(b)
+	for y := range h {
+		for x := range w {
+			if set(x, y) {
+				b = append(b, 0, 255, 0)
+			} else {
+				b = append(b, 0, 0, 0)
+			}
+		}
+	}
+	bitsOffset := len(b)
+	b = binary.LittleEndian.AppendUint16(b, 8)
+	b = binary.LittleEndian.AppendUint16(b, 8)
+	b = binary.LittleEndian.AppendUint16(b, 8)
+
+	binary.LittleEndian.PutUint32(b[prev:], uint32(len(b)))
+	entries := []struct {
+		tag, typ     uint16
+		count, value uint32
+	}{
+		{256, 4, 1, uint32(w)},                       // ImageWidth
+		{257, 4, 1, uint32(h)},                       // ImageLength
+		{258, 3, 3, uint32(bitsOffset)},              // BitsPerSample
+		{259, 3, 1, 1},                               // Compression: none
+		{262, 3, 1, 2},                               // PhotometricInterpretation: RGB
+		{273, 4, 1, uint32(dataOffset)},              // StripOffsets
+		{274, 3, 1, uint32(orientation)},             // Orientation
+		{277, 3, 1, 3},                               // SamplesPerPixel
+		{278, 4, 1, uint32(h)},                       // RowsPerStrip
+		{279, 4, 1, uint32(bitsOffset - dataOffset)}, // StripByteCounts
+	}
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(entries)))
+	for _, e := range entries {
+		b = binary.LittleEndian.AppendUint16(b, e.tag)
+		b = binary.LittleEndian.AppendUint16(b, e.typ)
+		b = binary.LittleEndian.AppendUint32(b, e.count)
+		b = binary.LittleEndian.AppendUint32(b, e.value)
+	}
+	return binary.LittleEndian.AppendUint32(b, 0) // next IFD
+}
+
+// Test that EXIF orientation is applied to WebP and TIFF images before
+// resizing.  Each source image has its top-left quadrant set and an EXIF
+// orientation of 6, so should display with the top-right quadrant set.
+func TestTransform_EXIF_Formats(t *testing.T) {
+	tests := []struct {
+		name string
+		src  []byte
+	}{
+		{"webp", newWebP(30, 20, orientationSource(30, 20), exifTIFFOrientation(6))},
+		{"webp with exif header", newWebP(30, 20, orientationSource(30, 20), append([]byte("Exif\x00\x00"), exifTIFFOrientation(6)...))},
+		// IFD beyond maxExifSize
+		{"tiff", newTIFF(900, 600, orientationSource(900, 600), 6)},
+	}
+
+	for _, tt := range tests {
+		out, err := Transform(tt.src, Options{Width: 10, Format: "png"})
+		if err != nil {
+			t.Errorf("Transform(%s) returned error: %v", tt.name, err)
+			continue
+		}
+		m, err := png.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("error decoding transformed %s image: %v", tt.name, err)
+			continue
+		}
+
+		if got, want := m.Bounds().Size(), image.Pt(10, 15); got != want {
+			t.Errorf("Transform(%s) returned image of size %v, want %v", tt.name, got, want)
+		}
+		isSet := func(x, y int) bool {
+			_, g, _, _ := m.At(x, y).RGBA()
+			return g > 0x8000
+		}
+		if !isSet(8, 2) || isSet(2, 2) || isSet(8, 12) || isSet(2, 12) {
+			t.Errorf("Transform(%s) returned image not correctly oriented", tt.name)
+		}
+	}
+
+	// without an orientation, the image is unchanged
+	out, err := Transform(newWebP(30, 20, orientationSource(30, 20), nil), Options{Width: 10, Format: "png"})
+	if err != nil {
+		t.Fatalf("Transform returned error: %v", err)
+	}
+	cfg, err := png.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("error decoding transformed image: %v", err)
+	}
+	if got, want := image.Pt(cfg.Width, cfg.Height), image.Pt(10, 7); got != want {
+		t.Errorf("Transform returned image of size %v, want %v", got, want)
+	}
+}
+
+func TestTransform_TIFFPage(t *testing.T) {
+	quadrant := orientationSource(20, 20)
+	all := func(x, y int) bool { return true }
+	src := newMultiPageTIFF(20, 20, quadrant, all)
+
+	tests := []struct {
+		page int
+		set  func(x, y int) bool
+	}{
+		{0, quadrant},
+		{1, all},
+	}
+	for _, tt := range tests {
+		out, err := Transform(src, Options{Page: tt.page, Format: "png"})
+		if err != nil {
+			t.Errorf("Transform with page %d returned error: %v", tt.page, err)
+			continue
+		}
+		m, err := png.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("error decoding transformed page %d: %v", tt.page, err)
+			continue
+		}
+		for _, p := range []image.Point{{2, 2}, {15, 2}, {2, 15}, {15, 15}} {
+			_, g, _, _ := m.At(p.X, p.Y).RGBA()
+			if got, want := g > 0x8000, tt.set(p.X, p.Y); got != want {
+				t.Errorf("Transform with page %d returned pixel %v set %t, want %t", tt.page, p, got, want)
+			}
+		}
+	}
+
+	if _, err := Transform(src, Options{Page: 2}); err == nil {
+		t.Errorf("Transform with missing page did not return expected error")
+	}
+}
+
+func TestTIFFPage(t *testing.T) {
+	if _, err := tiffPage([]byte("II*\x00\x08\x00\x00\x00\x01"), 1); err == nil {
+		t.Errorf("tiffPage with truncated IFD did not return expected error")
+	}
+	if _, err := tiffPage([]byte("GIF89a\x00\x00"), 1); err == nil {
+		t.Errorf("tiffPage with invalid header did not return expected error")
+	}
+}
+
+func TestWebPChunk(t *testing.T) {
+	exifData := []byte("odd")
+	img := newWebP(1, 1, func(x, y int) bool { return true }, exifData)
+	if got := webpChunk(img, "EXIF"); !bytes.Equal(got, exifData) {
+		t.Errorf("webpChunk(EXIF) returned %q, want %q", got, exifData)
+	}
+	if got := webpChunk(img, "XMP "); got != nil {
+		t.Errorf("webpChunk(XMP) returned %q, want nil", got)
+	}
+	if got := webpChunk([]byte("RIFF\x00\x00\x00\x00WEBPEXIF\xff\x00\x00\x00"), "EXIF"); got != nil {
+		t.Errorf("webpChunk with truncated chunk returned %q, want nil", got)
+	}
+}
+
 func TestTransformImage(t *testing.T) {
 	// ref is a 2x2 reference image containing four colors
 	ref := newImage(2, 2, red, green, blue, yellow)
@@ -390,6 +1050,134 @@ func TestTransformImage(t *testing.T) {
 	}
 }
 
+func TestTransformImage_CoverContain(t *testing.T) {
+	src := detailedImage(40, 20)
+	tests := []struct {
+		alias, want string
+	}{
+		{"10x10,cover", "10x10"},
+		{"10x10,contain", "10x10,fit"},
+		{"10x,cover", "10x"},
+		{"x10,contain", "x10,fit"},
+	}
+
+	for _, tt := range tests {
+		got := transformImage(src, ParseOptions(tt.alias))
+		want := transformImage(src, ParseOptions(tt.want))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("transformImage with %q returned %v image, want same as %q (%v)", tt.alias, got.Bounds(), tt.want, want.Bounds())
+		}
+	}
+}
+
+func TestTransformImage_BlurFill(t *testing.T) {
+	// left half red, right half blue
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(src, src.Bounds(), image.NewUniform(red), image.Point{}, draw.Src)
+	draw.Draw(src, image.Rect(20, 0, 40, 20), image.NewUniform(blue), image.Point{}, draw.Src)
+
+	m := transformImage(src, Options{Width: 40, Height: 40, ScaleUp: true, BlurFill: true})
+	if got, want := m.Bounds().Size(), image.Pt(40, 40); got != want {
+		t.Fatalf("transformImage returned size %v, want %v", got, want)
+	}
+
+	// the image is centered, unchanged
+	for _, x := range []int{0, 19} {
+		if got := color.NRGBAModel.Convert(m.At(x, 20)); got != red {
+			t.Errorf("pixel (%d, 20) is %v, want %v", x, got, red)
+		}
+	}
+	for _, x := range []int{20, 39} {
+		if got := color.NRGBAModel.Convert(m.At(x, 20)); got != blue {
+			t.Errorf("pixel (%d, 20) is %v, want %v", x, got, blue)
+		}
+	}
+
+	// the padding above and below is filled with a blurred copy, blending
+	// the colors rather than being a flat color
+	for _, y := range []int{0, 39} {
+		colors := make(map[color.Color]bool)
+		for x := range 40 {
+			colors[color.NRGBAModel.Convert(m.At(x, y))] = true
+		}
+		if len(colors) < 3 {
+			t.Errorf("padding row %d has %d distinct colors, want a blurred gradient", y, len(colors))
+		}
+		c := color.NRGBAModel.Convert(m.At(20, y)).(color.NRGBA)
+		if c.R == 0 || c.B == 0 {
+			t.Errorf("padding pixel (20, %d) is %v, want a blend of red and blue", y, c)
+		}
+	}
+
+	// without both dimensions, blurfill has no effect
+	m = transformImage(src, Options{Width: 20, BlurFill: true})
+	if got, want := m.Bounds().Size(), image.Pt(20, 10); got != want {
+		t.Errorf("transformImage with width only returned size %v, want %v", got, want)
+	}
+
+	// without scaleUp, the box is scaled down to fit within the image
+	m = transformImage(src, Options{Width: 100000, Height: 100000, BlurFill: true})
+	if got, want := m.Bounds().Size(), image.Pt(20, 20); got != want {
+		t.Errorf("transformImage with oversized box returned size %v, want %v", got, want)
+	}
+}
+
+func TestBlurFillParams(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	tests := []struct {
+		opt  Options
+		w, h int
+	}{
+		{Options{Width: 40, Height: 40}, 20, 20},
+		{Options{Width: 20, Height: 10}, 20, 10},
+		{Options{Width: 80, Height: 20}, 40, 10},
+		{Options{Width: 100000, Height: 100000}, 20, 20},
+		{Options{Width: 40, Height: 40, ScaleUp: true}, 40, 40},
+		{Options{Width: 100000, Height: 100000, ScaleUp: true}, 10000, 10000},
+		{Options{Width: 40}, 0, 0},
+	}
+	for _, tt := range tests {
+		w, h := blurFillParams(src, tt.opt)
+		if w != tt.w || h != tt.h {
+			t.Errorf("blurFillParams(%v) returned %dx%d, want %dx%d", tt.opt, w, h, tt.w, tt.h)
+		}
+		if w*h > maxImagePixels {
+			t.Errorf("blurFillParams(%v) returned %dx%d, more than %d pixels", tt.opt, w, h, maxImagePixels)
+		}
+	}
+}
+
+func TestTransformImage_Filter(t *testing.T) {
+	src := newImage(2, 2, red, green, blue, yellow)
+
+	// count the distinct colors in the image scaled up using filter
+	colors := func(filter string) int {
+		m := transformImage(src, Options{Width: 8, Height: 8, ScaleUp: true, Filter: filter})
+		seen := make(map[color.Color]bool)
+		b := m.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				seen[m.At(x, y)] = true
+			}
+		}
+		return len(seen)
+	}
+
+	// nearest neighbor produces blocks of the original colors, while
+	// other filters blend them
+	if got, want := colors("nearest"), 4; got != want {
+		t.Errorf("transformImage with nearest filter returned %d colors, want %d", got, want)
+	}
+	if got := colors("lanczos"); got <= 4 {
+		t.Errorf("transformImage with lanczos filter returned %d colors, want more than 4", got)
+	}
+
+	m := transformImage(src, Options{Width: 8, Height: 8, ScaleUp: true, Filter: "nearest"})
+	if got := m.At(3, 3); got != red {
+		t.Errorf("transformImage with nearest filter returned %v at (3,3), want %v", got, red)
+	}
+}
+
 func TestTrimEdges(t *testing.T) {
 	x := color.NRGBA{255, 255, 255, 255}
 	o := color.NRGBA{0, 0, 0, 255}
@@ -456,10 +1244,395 @@ func TestTrimEdges(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := trimEdges(tt.src)
+			got := trimEdges(tt.src, allEdges)
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("trimEdges() returned image %#v, want %#v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestTrimEdges_Directional(t *testing.T) {
+	x := color.NRGBA{255, 255, 255, 255}
+	o := color.NRGBA{0, 0, 0, 255}
+
+	src := newImage(5, 5,
+		x, x, x, x, x,
+		x, o, o, x, x,
+		x, o, o, x, x,
+		x, x, x, x, x,
+		x, x, x, x, x,
+	)
+
+	tests := []struct {
+		edges Edges
+		want  image.Image
+	}{
+		{
+			EdgeTop | EdgeBottom,
+			newImage(5, 2,
+				x, o, o, x, x,
+				x, o, o, x, x,
+			),
+		},
+		{
+			EdgeTop,
+			newImage(5, 4,
+				x, o, o, x, x,
+				x, o, o, x, x,
+				x, x, x, x, x,
+				x, x, x, x, x,
+			),
+		},
+		{
+			EdgeBottom,
+			newImage(5, 3,
+				x, x, x, x, x,
+				x, o, o, x, x,
+				x, o, o, x, x,
+			),
+		},
+		{
+			EdgeLeft | EdgeRight,
+			newImage(2, 5,
+				x, x,
+				o, o,
+				o, o,
+				x, x,
+				x, x,
+			),
+		},
+		{
+			EdgeRight,
+			newImage(3, 5,
+				x, x, x,
+				x, o, o,
+				x, o, o,
+				x, x, x,
+				x, x, x,
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.edges.String(), func(t *testing.T) {
+			got := trimEdges(src, tt.edges)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("trimEdges(%v) returned image %#v, want %#v", tt.edges, got, tt.want)
+			}
+		})
+	}
+}
+
+// recordingAnalyzer is a smartcrop.Analyzer that records the size of images
+// it analyzes.
+type recordingAnalyzer struct {
+	smartcrop.Analyzer
+	sizes []image.Point
+}
+
+func (a *recordingAnalyzer) FindBestCrop(img image.Image, width, height int) (image.Rectangle, error) {
+	a.sizes = append(a.sizes, img.Bounds().Size())
+	return a.Analyzer.FindBestCrop(img, width, height)
+}
+
+func TestFindBestCrop_maxPixels(t *testing.T) {
+	analyzer := &recordingAnalyzer{Analyzer: smartcropAnalyzer}
+	defer func(a smartcrop.Analyzer) { smartcropAnalyzer = a }(smartcropAnalyzer)
+	smartcropAnalyzer = analyzer
+
+	// a flat image with a detailed region right of center
+	src := image.NewNRGBA(image.Rect(0, 0, 1200, 600))
+	draw.Draw(src, src.Bounds(), &image.Uniform{color.NRGBA{128, 128, 128, 255}}, image.Point{}, draw.Src)
+	detail := image.Rect(800, 150, 1100, 450)
+	draw.Draw(src, detail, detailedImage(300, 300), image.Point{}, draw.Src)
+
+	want, err := findBestCrop(src, 300, 300, 0)
+	if err != nil {
+		t.Fatalf("findBestCrop returned error: %v", err)
+	}
+	got, err := findBestCrop(src, 300, 300, 20000)
+	if err != nil {
+		t.Fatalf("findBestCrop with max pixels returned error: %v", err)
+	}
+
+	// the guard triggers, analyzing a downsampled image
+	if len(analyzer.sizes) != 2 {
+		t.Fatalf("analyzer called %d times, want 2", len(analyzer.sizes))
+	}
+	if size := analyzer.sizes[1]; size.X*size.Y > 20000 {
+		t.Errorf("analyzed image of size %v, want at most 20000 pixels", size)
+	}
+
+	// and the crop is equivalent to that of the full size image
+	const tolerance = 60
+	if !got.In(src.Bounds()) {
+		t.Errorf("findBestCrop returned %v, outside image bounds %v", got, src.Bounds())
+	}
+	for _, d := range []int{got.Min.X - want.Min.X, got.Min.Y - want.Min.Y, got.Max.X - want.Max.X, got.Max.Y - want.Max.Y} {
+		if d < -tolerance || d > tolerance {
+			t.Errorf("findBestCrop with max pixels returned %v, want close to %v", got, want)
+			break
+		}
+	}
+	if !got.Overlaps(detail) {
+		t.Errorf("findBestCrop with max pixels returned %v, want crop of detailed region %v", got, detail)
+	}
+}
+
+func TestTransformImage_Thumb(t *testing.T) {
+	// a skin toned subject near the right edge of a flat background
+	skin := color.NRGBA{200, 145, 112, 255}
+	src := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	draw.Draw(src, src.Bounds(), image.NewUniform(color.NRGBA{128, 128, 128, 255}), image.Point{}, draw.Src)
+	subject := image.Rect(165, 35, 195, 65)
+	draw.Draw(src, subject, image.NewUniform(skin), image.Point{}, draw.Src)
+
+	// contains returns whether m contains the subject color
+	contains := func(m image.Image) bool {
+		b := m.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if color.NRGBAModel.Convert(m.At(x, y)) == skin {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		opt     string
+		size    image.Point
+		subject bool // whether the subject is retained
+	}{
+		{"thumb:1x1:face,50x", image.Pt(50, 50), true},
+		{"thumb:1x1:smart,50x", image.Pt(50, 50), true},
+		{"thumb:4x3,40x", image.Pt(40, 30), true},
+		// centered crops miss the subject
+		{"thumb:1x1:center,50x", image.Pt(50, 50), false},
+	}
+
+	for _, tt := range tests {
+		m := transformImage(src, ParseOptions(tt.opt))
+		if got := m.Bounds().Size(); got != tt.size {
+			t.Errorf("transformImage(%q) returned size %v, want %v", tt.opt, got, tt.size)
+		}
+		if got := contains(m); got != tt.subject {
+			t.Errorf("transformImage(%q) retained subject: %t, want %t", tt.opt, got, tt.subject)
+		}
+	}
+}
+
+func TestTransformImage_SmartCropDebug(t *testing.T) {
+	src := detailedImage(64, 48)
+	opt := Options{Width: 16, Height: 16, SmartCrop: true}
+	want := cropParams(src, opt)
+	if want.Eq(src.Bounds()) {
+		t.Fatalf("cropParams returned full image bounds %v", want)
+	}
+
+	opt.SmartCropDebug = true
+	got := transformImage(src, opt)
+	if !got.Bounds().Eq(src.Bounds()) {
+		t.Fatalf("transformImage returned image with bounds %v, want %v", got.Bounds(), src.Bounds())
+	}
+
+	// corners and edges of the crop are outlined
+	for _, p := range []image.Point{
+		want.Min,
+		{want.Max.X - 1, want.Min.Y},
+		{want.Min.X, want.Max.Y - 1},
+		{want.Max.X - 1, want.Max.Y - 1},
+		{(want.Min.X + want.Max.X) / 2, want.Min.Y},
+		{want.Min.X, (want.Min.Y + want.Max.Y) / 2},
+	} {
+		if c := got.At(p.X, p.Y); c != smartCropDebugColor {
+			t.Errorf("pixel %v is %v, want outline color %v", p, c, smartCropDebugColor)
+		}
+	}
+
+	// pixels inside and outside the crop are unchanged
+	for _, p := range []image.Point{
+		{(want.Min.X + want.Max.X) / 2, (want.Min.Y + want.Max.Y) / 2},
+		{want.Min.X - 1, want.Min.Y},
+		{want.Max.X, want.Max.Y - 1},
+	} {
+		if !p.In(src.Bounds()) {
+			continue
+		}
+		if got, want := got.At(p.X, p.Y), src.At(p.X, p.Y); got != want {
+			t.Errorf("pixel %v is %v, want unchanged %v", p, got, want)
+		}
+	}
+}
+
+func TestAspectRatioParams(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 64, 128))
+	tests := []struct {
+		opt            Options
+		x0, y0, x1, y1 int
+	}{
+		{emptyOptions, 0, 0, 64, 128},
+		{Options{AspectRatio: AspectRatio{1, 1}}, 0, 32, 64, 96},
+		{Options{AspectRatio: AspectRatio{1, 2}}, 0, 0, 64, 128},
+		{Options{AspectRatio: AspectRatio{16, 9}}, 0, 46, 64, 82},
+		{Options{AspectRatio: AspectRatio{1, 4}}, 16, 0, 48, 128},
+	}
+	for _, tt := range tests {
+		want := image.Rect(tt.x0, tt.y0, tt.x1, tt.y1)
+		if got := aspectRatioParams(src, tt.opt); !got.Eq(want) {
+			t.Errorf("aspectRatioParams(%v) returned %v, want %v", tt.opt, got, want)
+		}
+	}
+}
+
+func TestTransformImage_AspectRatio(t *testing.T) {
+	resampleFilter = imaging.Box
+
+	// square image with a red top half and blue bottom half
+	src := newImage(4, 4, red, red, red, red, red, red, red, red, blue, blue, blue, blue, blue, blue, blue, blue)
+
+	tests := []struct {
+		opt  Options
+		want image.Image
+	}{
+		// 16:9 of a 4px square is 4x2, centered
+		{Options{AspectRatio: AspectRatio{16, 9}}, newImage(4, 2, red, red, red, red, blue, blue, blue, blue)},
+		// already square
+		{Options{AspectRatio: AspectRatio{1, 1}}, src},
+		// height derived from ratio when only width is specified
+		{Options{AspectRatio: AspectRatio{2, 1}, Width: 2}, newImage(2, 1, color.NRGBA{128, 0, 128, 255}, color.NRGBA{128, 0, 128, 255})},
+	}
+
+	for _, tt := range tests {
+		if got := transformImage(src, tt.opt); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("transformImage(%v) returned image %#v, want %#v", tt.opt, got, tt.want)
+		}
+	}
+}
+
+func TestPosterize(t *testing.T) {
+	src := newImage(4, 1,
+		color.NRGBA{0, 63, 64, 255},
+		color.NRGBA{127, 128, 191, 255},
+		color.NRGBA{192, 255, 10, 128},
+		color.NRGBA{42, 43, 213, 0},
+	)
+
+	tests := []struct {
+		levels int
+		want   image.Image
+	}{
+		{2, newImage(4, 1,
+			color.NRGBA{0, 0, 0, 255},
+			color.NRGBA{0, 255, 255, 255},
+			color.NRGBA{255, 255, 0, 128},
+			color.NRGBA{0, 0, 255, 0},
+		)},
+		{4, newImage(4, 1,
+			color.NRGBA{0, 85, 85, 255},
+			color.NRGBA{85, 170, 170, 255},
+			color.NRGBA{170, 255, 0, 128},
+			color.NRGBA{0, 85, 255, 0},
+		)},
+	}
+
+	for _, tt := range tests {
+		if got := posterize(src, tt.levels); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("posterize(%d) returned image %#v, want %#v", tt.levels, got, tt.want)
+		}
+	}
+}
+
+func TestThreshold(t *testing.T) {
+	black := color.NRGBA{0, 0, 0, 255}
+	white := color.NRGBA{255, 255, 255, 255}
+	gray := color.NRGBA{128, 128, 128, 255}
+	src := newImage(5, 1, black, white, gray, red, color.NRGBA{255, 255, 255, 100})
+
+	tests := []struct {
+		pct  float64
+		want image.Image
+	}{
+		{50, newImage(5, 1, black, white, white, black, color.NRGBA{255, 255, 255, 100})},
+		{25, newImage(5, 1, black, white, white, white, color.NRGBA{255, 255, 255, 100})},
+		{100, newImage(5, 1, black, white, black, black, color.NRGBA{255, 255, 255, 100})},
+	}
+
+	for _, tt := range tests {
+		if got := threshold(src, tt.pct); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("threshold(%v) returned image %#v, want %#v", tt.pct, got, tt.want)
+		}
+	}
+}
+
+func TestTint(t *testing.T) {
+	black := color.NRGBA{0, 0, 0, 255}
+	white := color.NRGBA{255, 255, 255, 255}
+	gray := color.NRGBA{128, 128, 128, 255}
+	orange := color.NRGBA{255, 128, 0, 255}
+	src := newImage(4, 1, black, white, gray, color.NRGBA{128, 128, 128, 64})
+
+	want := newImage(4, 1, black, orange, color.NRGBA{128, 64, 0, 255}, color.NRGBA{128, 64, 0, 64})
+	if got := tint(src, orange); !reflect.DeepEqual(got, want) {
+		t.Errorf("tint(%v) returned image %#v, want %#v", orange, got, want)
+	}
+
+	// tint is applied after threshold
+	opt := Options{Threshold: 50, Tint: orange}
+	want = newImage(4, 1, black, orange, orange, color.NRGBA{255, 128, 0, 64})
+	if got := transformImage(src, opt); !reflect.DeepEqual(got, want) {
+		t.Errorf("transformImage(%v) returned image %#v, want %#v", opt, got, want)
+	}
+}
+
+func TestPixelate(t *testing.T) {
+	// 4x4 image with a different color in each row
+	src := newImage(4, 4,
+		red, red, green, green,
+		blue, blue, yellow, yellow,
+		red, green, blue, yellow,
+		red, green, blue, yellow,
+	)
+
+	for _, size := range []int{2, 3, 4} {
+		got := imaging.Clone(pixelate(src, size))
+		if !got.Bounds().Eq(src.Bounds()) {
+			t.Errorf("pixelate(%d) returned image with bounds %v, want %v", size, got.Bounds(), src.Bounds())
+			continue
+		}
+
+		// every pixel in a block should match the block's top left pixel
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 4; x++ {
+				block := got.NRGBAAt(x-x%size, y-y%size)
+				if c := got.NRGBAAt(x, y); c != block {
+					t.Errorf("pixelate(%d) pixel at (%d,%d) is %v, want %v", size, x, y, c, block)
+				}
+			}
+		}
+	}
+
+	// blocks are the average of their pixels
+	got := imaging.Clone(pixelate(src, 2))
+	if c, want := got.NRGBAAt(0, 0), (color.NRGBA{128, 0, 128, 255}); c != want {
+		t.Errorf("pixelate(2) top left block is %v, want %v", c, want)
+	}
+
+	// blocks larger than the image are limited to the image size
+	got = imaging.Clone(pixelate(src, 100000))
+	if !got.Bounds().Eq(src.Bounds()) {
+		t.Errorf("pixelate(100000) returned image with bounds %v, want %v", got.Bounds(), src.Bounds())
+	}
+	if c, want := got.NRGBAAt(3, 3), got.NRGBAAt(0, 0); c != want {
+		t.Errorf("pixelate(100000) bottom right pixel is %v, want %v", c, want)
+	}
+
+	// pixelate only a cropped region
+	opt := Options{CropWidth: 2, CropHeight: 2, Pixelate: 2}
+	want := newImage(2, 2, color.NRGBA{128, 0, 128, 255})
+	if got := transformImage(src, opt); !reflect.DeepEqual(got, want) {
+		t.Errorf("transformImage(%v) returned image %#v, want %#v", opt, got, want)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"image"
+	"image/color"
+	"log"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Watermark is an image overlaid on top of transformed images.
+type Watermark struct {
+	// Image to overlay.  It should be loaded once, when the proxy is
+	// configured, rather than for each request.
+	Image image.Image
+
+	// Position of the watermark within the transformed image.
+	Position imaging.Anchor
+
+	// Opacity of the watermark, between 0 and 1.  If zero, the watermark
+	// is fully opaque.
+	Opacity float64
+
+	// Scale of the watermark as a fraction of the transformed image width,
+	// between 0 and 1.  If zero, the watermark is drawn at its original
+	// size.
+	Scale float64
+
+	// If true, the watermark is only applied to requests that include the
+	// "wm" option.  Otherwise, it is applied to all requests that don't
+	// include the "nowm" option.
+	OptIn bool
+}
+
+// apply overlays the watermark on top of m.
+func (w *Watermark) apply(m image.Image) image.Image {
+	if w == nil || w.Image == nil {
+		return m
+	}
+
+	wm := w.Image
+	if w.Scale > 0 {
+		width := int(float64(m.Bounds().Dx()) * w.Scale)
+		if width == 0 {
+			return m
+		}
+		wm = imaging.Resize(wm, width, 0, resampleFilter)
+	}
+
+	opacity := w.Opacity
+	if opacity <= 0 || opacity > 1 {
+		opacity = 1
+	}
+
+	return imaging.Overlay(m, wm, watermarkPoint(m.Bounds(), wm.Bounds().Size(), w.Position), opacity)
+}
+
+// watermarkPoint returns the top left point at which an overlay of the
+// specified size is drawn in order to be positioned within b.
+func watermarkPoint(b image.Rectangle, size image.Point, pos imaging.Anchor) image.Point {
+	x := b.Min.X + (b.Dx()-size.X)/2
+	y := b.Min.Y + (b.Dy()-size.Y)/2
+
+	switch pos {
+	case imaging.TopLeft, imaging.Left, imaging.BottomLeft:
+		x = b.Min.X
+	case imaging.TopRight, imaging.Right, imaging.BottomRight:
+		x = b.Max.X - size.X
+	}
+	switch pos {
+	case imaging.TopLeft, imaging.Top, imaging.TopRight:
+		y = b.Min.Y
+	case imaging.BottomLeft, imaging.Bottom, imaging.BottomRight:
+		y = b.Max.Y - size.Y
+	}
+
+	return image.Pt(x, y)
+}
+
+// default size of text watermarks, in pixels
+const defaultTextWatermarkSize = 24
+
+// defaultFont returns the font used for text watermarks that don't specify one.
+var defaultFont = sync.OnceValues(func() (*opentype.Font, error) {
+	return opentype.Parse(goregular.TTF)
+})
+
+// TextWatermark is a text label drawn on top of transformed images, such as
+// "SAMPLE".  Text watermarks are only configured on the proxy, and can not be
+// controlled by requests.
+type TextWatermark struct {
+	// Text to draw.
+	Text string
+
+	// Font used to draw the text.  If nil, Go Regular is used.
+	Font *opentype.Font
+
+	// Size of the text, in pixels.  If zero, a default of 24 is used.
+	Size float64
+
+	// Color of the text.  If nil, white is used.
+	Color color.Color
+
+	// Position of the text within the transformed image.
+	Position imaging.Anchor
+}
+
+// apply draws the text watermark on top of m.
+func (w *TextWatermark) apply(m image.Image) image.Image {
+	if w == nil || w.Text == "" {
+		return m
+	}
+
+	face, err := w.face()
+	if err != nil {
+		log.Printf("error loading text watermark font: %v", err)
+		return m
+	}
+	defer face.Close()
+
+	var src image.Image = image.White
+	if w.Color != nil {
+		src = image.NewUniform(w.Color)
+	}
+
+	dst := imaging.Clone(m)
+	metrics := face.Metrics()
+	d := &font.Drawer{Dst: dst, Src: src, Face: face}
+	size := image.Pt(d.MeasureString(w.Text).Ceil(), (metrics.Ascent + metrics.Descent).Ceil())
+	pt := watermarkPoint(dst.Bounds(), size, w.Position)
+	d.Dot = fixed.P(pt.X, pt.Y).Add(fixed.Point26_6{Y: metrics.Ascent})
+	d.DrawString(w.Text)
+
+	return dst
+}
+
+// face returns a new font face for drawing the text watermark.
+func (w *TextWatermark) face() (font.Face, error) {
+	f := w.Font
+	if f == nil {
+		var err error
+		if f, err = defaultFont(); err != nil {
+			return nil, err
+		}
+	}
+
+	size := w.Size
+	if size <= 0 {
+		size = defaultTextWatermarkSize
+	}
+
+	// at 72 DPI, the font size in points is equal to its size in pixels
+	return opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+}
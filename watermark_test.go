@@ -0,0 +1,197 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestWatermark_apply(t *testing.T) {
+	resampleFilter = imaging.Box
+
+	// 4x4 blue image
+	src := newImage(4, 4, blue)
+	purple := color.NRGBA{127, 0, 127, 255}
+
+	tests := []struct {
+		name string
+		wm   *Watermark
+		// pixels expected to be covered by the watermark, and their color
+		covered []image.Point
+		want    color.Color
+	}{
+		{
+			name:    "top left",
+			wm:      &Watermark{Image: newImage(1, 1, red), Position: imaging.TopLeft},
+			covered: []image.Point{{0, 0}},
+			want:    red,
+		},
+		{
+			name:    "bottom right",
+			wm:      &Watermark{Image: newImage(2, 1, red), Position: imaging.BottomRight},
+			covered: []image.Point{{2, 3}, {3, 3}},
+			want:    red,
+		},
+		{
+			name:    "center",
+			wm:      &Watermark{Image: newImage(2, 2, red)},
+			covered: []image.Point{{1, 1}, {2, 1}, {1, 2}, {2, 2}},
+			want:    red,
+		},
+		{
+			name:    "half opacity",
+			wm:      &Watermark{Image: newImage(1, 1, red), Position: imaging.BottomLeft, Opacity: 0.5},
+			covered: []image.Point{{0, 3}},
+			want:    purple,
+		},
+		{
+			name:    "scaled to half width",
+			wm:      &Watermark{Image: newImage(1, 1, red), Position: imaging.TopRight, Scale: 0.5},
+			covered: []image.Point{{2, 0}, {3, 0}, {2, 1}, {3, 1}},
+			want:    red,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.wm.apply(src)
+
+			covered := make(map[image.Point]bool)
+			for _, p := range tt.covered {
+				covered[p] = true
+			}
+			for y := 0; y < 4; y++ {
+				for x := 0; x < 4; x++ {
+					want := color.Color(blue)
+					if covered[image.Pt(x, y)] {
+						want = tt.want
+					}
+					if c := color.NRGBAModel.Convert(got.At(x, y)); c != want {
+						t.Errorf("apply() pixel at (%d,%d) is %v, want %v", x, y, c, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestProxy_watermarked(t *testing.T) {
+	tests := []struct {
+		wm   *Watermark
+		opt  Options
+		want bool
+	}{
+		{nil, emptyOptions, false},
+		{nil, Options{Watermark: true}, false},
+		{&Watermark{}, emptyOptions, true},
+		{&Watermark{}, Options{NoWatermark: true}, false},
+		{&Watermark{}, Options{Format: optFormatBlurhash}, false},
+		{&Watermark{OptIn: true}, emptyOptions, false},
+		{&Watermark{OptIn: true}, Options{Watermark: true}, true},
+	}
+
+	for _, tt := range tests {
+		p := &Proxy{Watermark: tt.wm}
+		if got := p.watermarked(tt.opt); got != tt.want {
+			t.Errorf("watermarked(%v) with watermark %v returned %v, want %v", tt.opt, tt.wm, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_watermark(t *testing.T) {
+	p := NewProxy(&testTransport{}, nil)
+	p.Watermark = &Watermark{Image: newImage(1, 1, red)}
+
+	tests := []struct {
+		url  string
+		want color.Color
+	}{
+		{"/http://good.test/png", red},
+		{"/nowm/http://good.test/png", color.NRGBA{}},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.url, nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, http.StatusOK; got != want {
+			t.Errorf("ServeHTTP(%v) returned status %d, want %d", tt.url, got, want)
+			continue
+		}
+		m, _, err := image.Decode(bytes.NewReader(resp.Body.Bytes()))
+		if err != nil {
+			t.Errorf("ServeHTTP(%v) returned invalid image: %v", tt.url, err)
+			continue
+		}
+		if got := color.NRGBAModel.Convert(m.At(0, 0)); got != tt.want {
+			t.Errorf("ServeHTTP(%v) returned pixel %v, want %v", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestTextWatermark_apply(t *testing.T) {
+	src := newImage(100, 100, blue)
+
+	tests := []struct {
+		name string
+		wm   *TextWatermark
+		// region expected to contain text, with the rest of the image untouched
+		region image.Rectangle
+		want   color.Color
+	}{
+		{
+			name:   "top left",
+			wm:     &TextWatermark{Text: "SAMPLE", Size: 16, Position: imaging.TopLeft},
+			region: image.Rect(0, 0, 80, 20),
+			want:   color.White,
+		},
+		{
+			name:   "bottom right with color",
+			wm:     &TextWatermark{Text: "SAMPLE", Size: 16, Color: red, Position: imaging.BottomRight},
+			region: image.Rect(20, 80, 100, 100),
+			want:   red,
+		},
+		{
+			name:   "empty text",
+			wm:     &TextWatermark{},
+			region: image.Rectangle{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.wm.apply(src)
+			if !got.Bounds().Eq(src.Bounds()) {
+				t.Fatalf("apply() returned image with bounds %v, want %v", got.Bounds(), src.Bounds())
+			}
+
+			var labeled bool
+			for y := 0; y < 100; y++ {
+				for x := 0; x < 100; x++ {
+					c := color.NRGBAModel.Convert(got.At(x, y))
+					if c == blue {
+						continue
+					}
+					if !image.Pt(x, y).In(tt.region) {
+						t.Fatalf("apply() changed pixel at (%d,%d) outside of %v", x, y, tt.region)
+					}
+					if c == color.NRGBAModel.Convert(tt.want) {
+						labeled = true
+					}
+				}
+			}
+			if !tt.region.Empty() && !labeled {
+				t.Errorf("apply() did not draw any %v pixels in %v", tt.want, tt.region)
+			}
+		})
+	}
+}